@@ -0,0 +1,381 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derat/aread/common"
+	"github.com/derat/aread/db"
+)
+
+const (
+	// maxAPIListSize is the maximum number of pages returned by a single list request.
+	maxAPIListSize = 500
+	// maxAPIBodyBytes is the maximum size of API request bodies.
+	maxAPIBodyBytes = 64 * 1024
+)
+
+// apiPage is the JSON representation of a page.
+type apiPage struct {
+	ID            string     `json:"id"`
+	URL           string     `json:"url"`
+	Title         string     `json:"title"`
+	Author        string     `json:"author,omitempty"`
+	TimeAdded     time.Time  `json:"timeAdded"`
+	TimePublished *time.Time `json:"timePublished,omitempty"`
+	WordCount     int        `json:"wordCount"`
+	ReadingTime   int        `json:"readingTime"` // minutes
+	Excerpt       string     `json:"excerpt,omitempty"`
+	Language      string     `json:"language,omitempty"`
+	LeadImageURL  string     `json:"leadImageUrl,omitempty"`
+	Archived      bool       `json:"archived"`
+	Trashed       bool       `json:"trashed"`
+	Tags          []string   `json:"tags"`
+	ContentURL    string     `json:"contentUrl"`
+}
+
+// apiJob is the JSON representation of a queued request to add a page.
+type apiJob struct {
+	ID        int64           `json:"id"`
+	PageID    string          `json:"pageId"`
+	URL       string          `json:"url"`
+	State     common.JobState `json:"state"`
+	Error     string          `json:"error,omitempty"`
+	Attempts  int             `json:"attempts"`
+	TimeAdded time.Time       `json:"timeAdded"`
+}
+
+// apiAddRequest is the JSON body of a request to add a page.
+type apiAddRequest struct {
+	URL     string   `json:"url"`
+	Archive bool     `json:"archive"`
+	Kindle  bool     `json:"kindle"`
+	Tags    []string `json:"tags"`
+}
+
+// apiListResponse is the JSON response to a request to list pages.
+type apiListResponse struct {
+	Pages []apiPage `json:"pages"`
+	// NextCursor can be passed via the "cursor" parameter to get the next
+	// batch of pages. It is empty if there are no more pages.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+func (h handler) makeAPIPage(pi common.PageInfo) apiPage {
+	tags := pi.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	contentURL := joinURLAndPath(h.cfg.BaseURL, common.PagesURLPath+"/"+pi.Id+"/")
+	ap := apiPage{
+		ID:          pi.Id,
+		URL:         pi.OriginalURL,
+		Title:       pi.Title,
+		Author:      pi.Author,
+		TimeAdded:   time.Unix(pi.TimeAdded, 0).UTC(),
+		WordCount:   pi.WordCount,
+		ReadingTime: pi.ReadingTime,
+		Excerpt:     pi.Excerpt,
+		Language:    pi.Language,
+		Archived:    pi.Archived,
+		Trashed:     pi.TimeDeleted != 0,
+		Tags:        tags,
+		ContentURL:  contentURL,
+	}
+	if pi.TimePublished != 0 {
+		t := time.Unix(pi.TimePublished, 0).UTC()
+		ap.TimePublished = &t
+	}
+	if pi.LeadImage != "" {
+		ap.LeadImageURL = contentURL + pi.LeadImage
+	}
+	return ap
+}
+
+func makeAPIJob(j common.Job) apiJob {
+	return apiJob{
+		ID:        j.Id,
+		PageID:    j.PageId,
+		URL:       j.URL,
+		State:     j.State,
+		Error:     j.Error,
+		Attempts:  j.Attempts,
+		TimeAdded: time.Unix(j.TimeAdded, 0).UTC(),
+	}
+}
+
+// encodeCursor returns an opaque cursor identifying pi's position in a list.
+func encodeCursor(pi common.PageInfo) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", pi.TimeAdded, pi.Id)))
+}
+
+// decodeCursor parses a cursor returned by encodeCursor.
+func decodeCursor(s string) (timeAdded int64, id string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, "", errors.New("bad cursor")
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", errors.New("bad cursor")
+	}
+	if timeAdded, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, "", errors.New("bad cursor")
+	}
+	return timeAdded, parts[1], nil
+}
+
+// writeAPIResponse writes v as JSON with the supplied status code.
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// writeAPIError writes a JSON object containing msg with the supplied status code.
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIResponse(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// handleAPI handles an authenticated API request. p contains the portion of
+// the path after common.APIURLPath, without leading or trailing slashes.
+// user is the authenticated user, and tok is nil if the request was
+// authenticated via a session.
+func (h handler) handleAPI(w http.ResponseWriter, r *http.Request, p string, user *common.User, tok *common.APIToken) {
+	parts := strings.Split(p, "/")
+	if parts[0] != "pages" || len(parts) > 3 {
+		writeAPIError(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+
+	// Checks the request's method and writes an error if it isn't one of ms.
+	checkMethod := func(ms ...string) bool {
+		for _, m := range ms {
+			if r.Method == m {
+				return true
+			}
+		}
+		w.Header().Set("Allow", strings.Join(ms, ", "))
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	// Checks that tok has scope and writes an error if it doesn't.
+	checkScope := func(scope string) bool {
+		if tok == nil || tok.HasScope(scope) {
+			return true
+		}
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("token lacks %q scope", scope))
+		return false
+	}
+
+	if len(parts) == 1 {
+		if checkMethod(http.MethodGet, http.MethodPost) {
+			if r.Method == http.MethodGet {
+				if checkScope(common.ScopeRead) {
+					h.handleAPIList(w, r, user)
+				}
+			} else if checkScope(common.ScopeAdd) {
+				h.handleAPIAdd(w, r, user, tok)
+			}
+		}
+		return
+	}
+
+	pi, err := h.getPage(user, parts[1])
+	if err == db.ErrPageNotFound {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		h.cfg.Logger.Println(err)
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if len(parts) == 2 {
+		if !checkMethod(http.MethodGet, http.MethodDelete) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			if checkScope(common.ScopeRead) {
+				writeAPIResponse(w, http.StatusOK, h.makeAPIPage(pi))
+			}
+			return
+		} else if !checkScope(common.ScopeWrite) {
+			return
+		}
+		// Pages are moved to the trash unless permanent deletion is requested.
+		permanent, _ := strconv.ParseBool(r.FormValue("permanent"))
+		if permanent {
+			err = h.deletePage(user, pi.Id)
+		} else {
+			err = h.setPageTrashed(pi.Id, true)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+		} else {
+			writeAPIResponse(w, http.StatusNoContent, nil)
+		}
+		return
+	}
+
+	switch parts[2] {
+	case "archive", "unarchive":
+		if !checkMethod(http.MethodPost) || !checkScope(common.ScopeWrite) {
+			return
+		}
+		archived := parts[2] == "archive"
+		if err := h.setPageArchived(pi.Id, archived); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		pi.Archived = archived
+		writeAPIResponse(w, http.StatusOK, h.makeAPIPage(pi))
+	case "restore":
+		if !checkMethod(http.MethodPost) || !checkScope(common.ScopeWrite) {
+			return
+		}
+		if err := h.setPageTrashed(pi.Id, false); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		pi.TimeDeleted = 0
+		writeAPIResponse(w, http.StatusOK, h.makeAPIPage(pi))
+	case "kindle":
+		if !checkMethod(http.MethodPost) || !checkScope(common.ScopeKindle) {
+			return
+		}
+		if err := h.sendPage(user, pi.Id); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeAPIResponse(w, http.StatusNoContent, nil)
+	case "reprocess":
+		if !checkMethod(http.MethodPost) || !checkScope(common.ScopeWrite) {
+			return
+		}
+		j, err := h.reprocessPage(user, pi)
+		if err != nil {
+			writeAPIError(w, getQueueErrorStatus(err), err.Error())
+			return
+		}
+		writeAPIResponse(w, http.StatusAccepted, makeAPIJob(j))
+	default:
+		writeAPIError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+// handleAPIList handles a request to list pages. The following parameters
+// are accepted:
+//
+//	archived: "1" or "true" to list archived rather than unarchived pages
+//	trashed:  "1" or "true" to list pages in the trash
+//	tag:      only list pages with this tag
+//	author:   only list pages by this author
+//	sort:     "added" (default), "published", "shortest", or "longest"
+//	limit:    maximum number of pages to return
+//	cursor:   nextCursor value from a previous response (only with "added" sort)
+func (h handler) handleAPIList(w http.ResponseWriter, r *http.Request, user *common.User) {
+	q := db.PageQuery{
+		UserId: user.Id,
+		Tag:    r.FormValue(common.TagParam),
+		Author: r.FormValue(common.AuthorParam),
+		Max:    h.cfg.MaxListSize,
+	}
+
+	var err error
+	if q.Order, err = db.ParsePageOrder(r.FormValue(common.SortParam)); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if v := r.FormValue("archived"); v != "" {
+		if q.Archived, err = strconv.ParseBool(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad archived value")
+			return
+		}
+	}
+	if v := r.FormValue("trashed"); v != "" {
+		if q.Trashed, err = strconv.ParseBool(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad trashed value")
+			return
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if q.Max, err = strconv.Atoi(v); err != nil || q.Max <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "bad limit")
+			return
+		}
+	}
+	if q.Max > maxAPIListSize {
+		q.Max = maxAPIListSize
+	}
+	if v := r.FormValue("cursor"); v != "" {
+		if q.Order != db.OrderAdded {
+			writeAPIError(w, http.StatusBadRequest, "cursor only supported with default sort")
+			return
+		}
+		if q.BeforeTime, q.BeforeId, err = decodeCursor(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Request an extra page to find out if there are more.
+	limit := q.Max
+	q.Max++
+	pages, err := h.db.QueryPages(q)
+	if err != nil {
+		h.cfg.Logger.Printf("Unable to get pages: %v\n", err)
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := apiListResponse{Pages: []apiPage{}}
+	if len(pages) > limit {
+		pages = pages[:limit]
+		if q.Order == db.OrderAdded {
+			resp.NextCursor = encodeCursor(pages[limit-1])
+		}
+	}
+	for _, pi := range pages {
+		resp.Pages = append(resp.Pages, h.makeAPIPage(pi))
+	}
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+// handleAPIAdd handles a request to add a page. The request body should
+// contain a JSON-marshaled apiAddRequest.
+func (h handler) handleAPIAdd(w http.ResponseWriter, r *http.Request, user *common.User, tok *common.APIToken) {
+	var req apiAddRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBodyBytes)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("bad request body: %v", err))
+		return
+	}
+	if req.URL == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing URL")
+		return
+	}
+	if req.Kindle && tok != nil && !tok.HasScope(common.ScopeKindle) {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("token lacks %q scope", common.ScopeKindle))
+		return
+	}
+	j, err := h.addPage(user, req.URL, false, req.Archive, req.Kindle, common.ParseTags(strings.Join(req.Tags, ",")))
+	if err != nil {
+		writeAPIError(w, getQueueErrorStatus(err), err.Error())
+		return
+	}
+	writeAPIResponse(w, http.StatusAccepted, makeAPIJob(j))
+}
@@ -0,0 +1,327 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/derat/aread/common"
+	"github.com/derat/aread/db"
+	"github.com/derat/aread/proc"
+)
+
+// newTestHandler returns a handler using a temporary directory.
+// The returned function should be called to clean up.
+func newTestHandler(t *testing.T) (handler, func()) {
+	td, err := ioutil.TempDir("", "api_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &common.Config{
+		BaseURL:        "https://example.org/aread",
+		PageDir:        filepath.Join(td, "pages"),
+		StaticDir:      filepath.Join(td, "static"),
+		Username:       "user",
+		Password:       "pass",
+		MaxListSize:    50,
+		JobWorkers:     1,
+		MaxJobAttempts: 1,
+		Logger:         log.New(os.Stderr, "", log.LstdFlags),
+	}
+	d, err := db.New(filepath.Join(td, "test.db"))
+	if err != nil {
+		os.RemoveAll(td)
+		t.Fatal(err)
+	}
+	p := proc.New(cfg)
+	// The queue isn't started, so added jobs remain queued.
+	return newHandler(cfg, p, d, proc.NewQueue(cfg, p, d)), func() {
+		d.Close()
+		os.RemoveAll(td)
+	}
+}
+
+// newTestToken creates a token in h's database with the supplied scopes.
+func newTestToken(t *testing.T, h handler, scopes ...string) string {
+	secret, err := h.db.AddToken(common.ConfigUserId, "test", scopes)
+	if err != nil {
+		t.Fatal("AddToken failed: ", err)
+	}
+	return secret
+}
+
+// doAPIRequest sends an API request to h authenticated by token and returns
+// the response. If out is non-nil, the response body is unmarshaled into it.
+func doAPIRequest(t *testing.T, h handler, token, method, path, body string, out interface{}) *http.Response {
+	req := httptest.NewRequest(method, "https://example.org/aread/api/v1/"+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	resp := rec.Result()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Errorf("Failed to decode response to %v %v: %v", method, path, err)
+		}
+	}
+	return resp
+}
+
+func TestAPI_Pages(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	tok := newTestToken(t, h, common.AllScopes...)
+
+	for _, pi := range []common.PageInfo{
+		{Id: "a1", OriginalURL: "https://example.com/1", Title: "One", TimeAdded: 100},
+		{Id: "a2", OriginalURL: "https://example.com/2", Title: "Two", TimeAdded: 200},
+		{Id: "a3", OriginalURL: "https://example.com/3", Title: "Three", TimeAdded: 200},
+		{Id: "a4", OriginalURL: "https://example.com/4", Title: "Four", TimeAdded: 300},
+	} {
+		pi.UserId = common.ConfigUserId
+		if err := h.db.AddPage(pi); err != nil {
+			t.Fatal("AddPage failed: ", err)
+		}
+	}
+	if err := h.db.AddPageTags("a2", []string{"foo"}); err != nil {
+		t.Fatal("AddPageTags failed: ", err)
+	}
+
+	// Page through the unarchived pages.
+	var ids []string
+	var cursor string
+	for i := 0; i < 10; i++ {
+		var res apiListResponse
+		if resp := doAPIRequest(t, h, tok, "GET", "pages?limit=2&cursor="+cursor, "", &res); resp.StatusCode != http.StatusOK {
+			t.Fatalf("List returned %v", resp.Status)
+		}
+		for _, p := range res.Pages {
+			ids = append(ids, p.ID)
+		}
+		if cursor = res.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if want := []string{"a4", "a3", "a2", "a1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Listed pages %v; want %v", ids, want)
+	}
+
+	var res apiListResponse
+	doAPIRequest(t, h, tok, "GET", "pages?tag=foo", "", &res)
+	if len(res.Pages) != 1 || res.Pages[0].ID != "a2" || !reflect.DeepEqual(res.Pages[0].Tags, []string{"foo"}) {
+		t.Errorf("Listing tag returned %+v", res)
+	}
+
+	var p apiPage
+	if resp := doAPIRequest(t, h, tok, "POST", "pages/a1/archive", "", &p); resp.StatusCode != http.StatusOK {
+		t.Errorf("Archive returned %v", resp.Status)
+	} else if !p.Archived {
+		t.Errorf("Archive returned unarchived page %+v", p)
+	}
+	doAPIRequest(t, h, tok, "GET", "pages?archived=true", "", &res)
+	if len(res.Pages) != 1 || res.Pages[0].ID != "a1" {
+		t.Errorf("Listing archived pages returned %+v", res)
+	}
+	if resp := doAPIRequest(t, h, tok, "POST", "pages/a1/unarchive", "", &p); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unarchive returned %v", resp.Status)
+	} else if p.Archived {
+		t.Errorf("Unarchive returned archived page %+v", p)
+	}
+
+	if resp := doAPIRequest(t, h, tok, "GET", "pages/a1", "", &p); resp.StatusCode != http.StatusOK {
+		t.Errorf("Get returned %v", resp.Status)
+	} else if p.Title != "One" || p.ContentURL != "https://example.org/aread/pages/a1/" {
+		t.Errorf("Get returned %+v", p)
+	}
+	if resp := doAPIRequest(t, h, tok, "DELETE", "pages/a1", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Delete returned %v", resp.Status)
+	}
+	if resp := doAPIRequest(t, h, tok, "GET", "pages/a1", "", &p); resp.StatusCode != http.StatusOK {
+		t.Errorf("Get after delete returned %v", resp.Status)
+	} else if !p.Trashed {
+		t.Errorf("Get after delete returned untrashed page %+v", p)
+	}
+	res = apiListResponse{}
+	doAPIRequest(t, h, tok, "GET", "pages?trashed=1", "", &res)
+	if len(res.Pages) != 1 || res.Pages[0].ID != "a1" {
+		t.Errorf("Listing trashed pages returned %+v", res)
+	}
+	if resp := doAPIRequest(t, h, tok, "POST", "pages/a1/restore", "", &p); resp.StatusCode != http.StatusOK {
+		t.Errorf("Restore returned %v", resp.Status)
+	} else if p.Trashed {
+		t.Errorf("Restore returned trashed page %+v", p)
+	}
+	if doAPIRequest(t, h, tok, "GET", "pages/a1", "", &p); p.Trashed {
+		t.Errorf("Get after restore returned trashed page %+v", p)
+	}
+	var rj apiJob
+	if resp := doAPIRequest(t, h, tok, "POST", "pages/a1/reprocess", "", &rj); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Reprocess returned %v", resp.Status)
+	} else if jobs, err := h.db.GetAllJobs(common.ConfigUserId); err != nil {
+		t.Error("GetAllJobs failed: ", err)
+	} else if len(jobs) == 0 || jobs[0].Id != rj.ID || jobs[0].PageId != "a1" || !jobs[0].Reprocess {
+		t.Errorf("Reprocess queued %+v; got response %+v", jobs, rj)
+	}
+	if resp := doAPIRequest(t, h, tok, "POST", "pages/a1/reprocess", "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Reprocess with pending job returned %v", resp.Status)
+	}
+	if resp := doAPIRequest(t, h, tok, "DELETE", "pages/a1?permanent=1", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Permanent delete returned %v", resp.Status)
+	}
+	if resp := doAPIRequest(t, h, tok, "GET", "pages/a1", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Get after permanent delete returned %v", resp.Status)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "pages?cursor=bogus", http.StatusBadRequest},
+		{"GET", "pages?limit=0", http.StatusBadRequest},
+		{"PUT", "pages", http.StatusMethodNotAllowed},
+		{"GET", "pages/a2/archive", http.StatusMethodNotAllowed},
+		{"POST", "pages/a2/bogus", http.StatusNotFound},
+		{"GET", "bogus", http.StatusNotFound},
+	} {
+		var e struct{ Error string }
+		if resp := doAPIRequest(t, h, tok, tc.method, tc.path, "", &e); resp.StatusCode != tc.status {
+			t.Errorf("%v %v returned %v; want %v", tc.method, tc.path, resp.StatusCode, tc.status)
+		} else if e.Error == "" {
+			t.Errorf("%v %v didn't return error message", tc.method, tc.path)
+		}
+	}
+}
+
+func TestAPI_Add(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	tok := newTestToken(t, h, common.ScopeAdd)
+
+	var j apiJob
+	if resp := doAPIRequest(t, h, tok, "POST", "pages",
+		`{"url": "https://example.com/", "archive": true, "tags": ["Foo", "bar"]}`, &j); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Add returned %v", resp.Status)
+	}
+	if j.URL != "https://example.com/" || j.State != common.JobQueued || j.PageID == "" {
+		t.Errorf("Add returned %+v", j)
+	}
+	if jobs, err := h.db.GetAllJobs(common.ConfigUserId); err != nil {
+		t.Error("GetAllJobs failed: ", err)
+	} else if len(jobs) != 1 || jobs[0].Id != j.ID || !jobs[0].Archive {
+		t.Errorf("GetAllJobs returned %+v", jobs)
+	}
+	if tags, err := h.db.GetTags(common.ConfigUserId, false); err != nil {
+		t.Error("GetTags failed: ", err)
+	} else if len(tags) != 0 {
+		t.Errorf("GetTags(false) returned %v before page was added", tags)
+	}
+
+	if resp := doAPIRequest(t, h, tok, "POST", "pages", `{"archive": true}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Add without URL returned %v", resp.Status)
+	}
+	if resp := doAPIRequest(t, h, tok, "POST", "pages", `bogus`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Add with bad body returned %v", resp.Status)
+	}
+}
+
+func TestAPI_Auth(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	addTok := newTestToken(t, h, common.ScopeAdd)
+	readTok := newTestToken(t, h, common.ScopeRead)
+	revokedTok := newTestToken(t, h, common.AllScopes...)
+	if toks, err := h.db.GetAllTokens(common.ConfigUserId); err != nil {
+		t.Fatal("GetAllTokens failed: ", err)
+	} else if err := h.db.RevokeToken(common.ConfigUserId, toks[0].Id); err != nil {
+		t.Fatal("RevokeToken failed: ", err)
+	}
+	if err := h.db.AddPage(common.PageInfo{Id: "a1", UserId: common.ConfigUserId, OriginalURL: "https://example.com/"}); err != nil {
+		t.Fatal("AddPage failed: ", err)
+	}
+
+	for _, tc := range []struct {
+		auth   string // Authorization header
+		param  string // token query parameter
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"", "", "GET", "pages", "", http.StatusUnauthorized},
+		{"Bearer bogus", "", "GET", "pages", "", http.StatusUnauthorized},
+		{"Basic " + readTok, "", "GET", "pages", "", http.StatusUnauthorized},
+		{"Bearer " + revokedTok, "", "GET", "pages", "", http.StatusUnauthorized},
+		{"Bearer " + readTok, "", "GET", "pages", "", http.StatusOK},
+		{"", readTok, "GET", "pages", "", http.StatusOK},
+		{"", readTok, "GET", "pages/a1", "", http.StatusOK},
+		{"Bearer " + addTok, "", "GET", "pages", "", http.StatusForbidden},
+		{"Bearer " + readTok, "", "POST", "pages/a1/archive", "", http.StatusForbidden},
+		{"Bearer " + readTok, "", "DELETE", "pages/a1", "", http.StatusForbidden},
+		{"Bearer " + readTok, "", "POST", "pages/a1/kindle", "", http.StatusForbidden},
+		{"Bearer " + readTok, "", "POST", "pages", `{"url":"https://example.net/"}`, http.StatusForbidden},
+		{"Bearer " + addTok, "", "POST", "pages", `{"url":"https://example.net/","kindle":true}`, http.StatusForbidden},
+		{"Bearer " + addTok, "", "POST", "pages", `{"url":"https://example.net/"}`, http.StatusAccepted},
+	} {
+		u := "https://example.org/aread/api/v1/" + tc.path
+		if tc.param != "" {
+			u += "?t=" + tc.param
+		}
+		req := httptest.NewRequest(tc.method, u, strings.NewReader(tc.body))
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%v %v with auth %q and param %q returned %v; want %v",
+				tc.method, tc.path, tc.auth, tc.param, rec.Code, tc.status)
+		}
+	}
+
+	if toks, err := h.db.GetAllTokens(common.ConfigUserId); err != nil {
+		t.Fatal("GetAllTokens failed: ", err)
+	} else if toks[1].Id == 0 || toks[1].LastUsed == 0 || toks[0].LastUsed != 0 {
+		t.Errorf("GetAllTokens returned %+v; want read token used and revoked token unused", toks)
+	}
+}
+
+func TestHandleAdd_Token(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	addTok := newTestToken(t, h, common.ScopeAdd)
+	readTok := newTestToken(t, h, common.ScopeRead)
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"u=https://example.com/1&t=" + addTok, http.StatusFound},
+		{"u=https://example.com/2&k=1&t=" + addTok, http.StatusForbidden},
+		{"u=https://example.com/3&t=" + readTok, http.StatusForbidden},
+		{"u=https://example.com/4&t=bogus", http.StatusForbidden},
+		{"u=https://example.com/5", http.StatusFound}, // redirected to auth page
+	} {
+		req := httptest.NewRequest("GET", "https://example.org/aread/add?"+tc.query, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("Add with %q returned %v; want %v", tc.query, rec.Code, tc.status)
+		}
+	}
+	if jobs, err := h.db.GetAllJobs(common.ConfigUserId); err != nil {
+		t.Fatal("GetAllJobs failed: ", err)
+	} else if len(jobs) != 1 || jobs[0].URL != "https://example.com/1" {
+		t.Errorf("GetAllJobs returned %+v; want single job", jobs)
+	}
+}
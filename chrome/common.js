@@ -17,6 +17,7 @@ function add(url, token, options = {}) {
   let req = `${url}/add?u=${encodeURIComponent(page)}&t=${token}`;
   if (options.archive) req += '&a=1';
   if (options.kindle) req += '&k=1';
+  if (options.tags) req += `&tags=${encodeURIComponent(options.tags)}`;
   console.log(`XXX ${req}`);
 
   // TODO: Open the page in the background if options.url was supplied, maybe.
@@ -31,6 +32,7 @@ function add(url, token, options = {}) {
 // |options| may contain the following properties:
 // - 'archive' indicates that the page should be marked as read.
 // - 'kindle' indicates that the page should be emailed to the Kindle gateway.
+// - 'tags' is a comma-separated list of tags to apply to the page.
 // - 'url' is the URL to add; if missing, the current URL is used.
 export function addPage(options = {}) {
   return chrome.storage.sync.get(['url', 'token']).then(async (items) => {
@@ -2,7 +2,6 @@
 // All rights reserved.
 
 import { $ } from './common.js';
-import crypto from './sha1.js';
 
 function saveOptions() {
   const items = {};
@@ -11,11 +10,8 @@ function saveOptions() {
   if (url.endsWith('/')) url = url.slice(0, -1);
   items.url = url;
 
-  const username = $('username').value.trim();
-  const password = $('password').value.trim();
-  if (username && password) {
-    items.token = String(crypto.SHA1(`${username}|${password}`));
-  }
+  const token = $('token').value.trim();
+  if (token) items.token = token;
 
   chrome.storage.sync.set(items);
 }
@@ -4,17 +4,17 @@
 import { $, openReadingList, addPage } from './common.js';
 
 $('save-page').addEventListener('click', () =>
-  addPage({ archive: true })
+  addPage({ archive: true, tags: $('tags').value })
     .then(window.close)
     .catch((e) => alert(e))
 );
 $('read-later').addEventListener('click', () =>
-  addPage()
+  addPage({ tags: $('tags').value })
     .then(window.close)
     .catch((e) => alert(e))
 );
 $('send-to-kindle').addEventListener('click', () =>
-  addPage({ kindle: true })
+  addPage({ kindle: true, tags: $('tags').value })
     .then(window.close)
     .catch((e) => alert(e))
 );
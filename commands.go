@@ -0,0 +1,391 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/derat/aread/common"
+	"github.com/derat/aread/db"
+	"github.com/derat/aread/proc"
+)
+
+// command describes a subcommand that can be passed on the command line
+// instead of URLs.
+type command struct {
+	usage string // argument summary, e.g. "[-dry-run]"
+	desc  string // short description
+	run   func(cfg *common.Config, args []string) error
+}
+
+var commands = map[string]command{
+	"gc": {
+		usage: "[-dry-run] [-trash-days N]",
+		desc:  "Purge old trashed pages and delete unreferenced page directories",
+		run:   runGC,
+	},
+	"hash-password": {
+		desc: "Read a password from stdin and print a hash for the config's \"password\" field",
+		run:  runHashPassword,
+	},
+	"migrate": {
+		usage: "[-dry-run]",
+		desc:  "Apply pending database migrations",
+		run:   runMigrate,
+	},
+	"reindex": {
+		desc: "Rebuild the full-text search index from saved pages (requires -tags sqlite_fts5)",
+		run:  runReindex,
+	},
+	"reprocess": {
+		usage: "[-dry-run] [-host host] [-since YYYY-MM-DD] [-until YYYY-MM-DD] [-user name]",
+		desc:  "Reprocess saved pages using the current rules, preserving their metadata",
+		run:   runReprocess,
+	},
+	"user": {
+		usage: "add [-recipient addr] [-config path] <name> | disable <name> | enable <name> | list",
+		desc:  "Manage additional users (passwords are read from stdin)",
+		run:   runUser,
+	},
+}
+
+// printCommands writes a description of each command to os.Stderr.
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", name, c.usage, c.desc)
+	}
+}
+
+// readPassword prompts for a password and reads it from a line on stdin.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && pw == "" {
+		return "", fmt.Errorf("failed reading password: %v", err)
+	}
+	if pw = strings.TrimRight(pw, "\r\n"); pw == "" {
+		return "", errors.New("empty password")
+	}
+	return pw, nil
+}
+
+func runHashPassword(cfg *common.Config, args []string) error {
+	if len(args) != 0 {
+		return errors.New("unexpected arguments")
+	}
+	pw, err := readPassword()
+	if err != nil {
+		return err
+	}
+	hash, err := common.HashPassword(pw)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+func runGC(cfg *common.Config, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Print what would be deleted without deleting it")
+	trashDays := fs.Int("trash-days", defaultTrashDays,
+		"Purge pages trashed and jobs that permanently failed more than this many days ago")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("unexpected arguments")
+	}
+	if *trashDays < 0 {
+		return errors.New("negative -trash-days")
+	}
+
+	d, err := db.New(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	stats, err := collectGarbage(cfg, d, time.Now(), time.Duration(*trashDays)*24*time.Hour, *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "Reclaimed"
+	if *dryRun {
+		verb = "Would reclaim"
+	}
+	fmt.Printf("%s %d byte(s) from %d trashed page(s) and %d orphaned directory(s)\n",
+		verb, stats.bytes, stats.purgedPages, stats.orphanDirs)
+	if stats.purgedJobs > 0 {
+		verb = "Purged"
+		if *dryRun {
+			verb = "Would purge"
+		}
+		fmt.Printf("%s %d failed job(s)\n", verb, stats.purgedJobs)
+	}
+	return nil
+}
+
+func runMigrate(cfg *common.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Print pending migrations without applying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	d, err := db.Open(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	pending, err := d.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Println("Database is up to date")
+		return nil
+	}
+	for _, m := range pending {
+		fmt.Printf("%d: %s\n", m.Version, m.Desc)
+	}
+	if *dryRun {
+		return nil
+	}
+	if err := d.Migrate(); err != nil {
+		return err
+	}
+	fmt.Printf("Applied %d migration(s)\n", len(pending))
+	return nil
+}
+
+func runReprocess(cfg *common.Config, args []string) error {
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Print matching pages without reprocessing them")
+	host := fs.String("host", "", "Only reprocess pages from this host and its subdomains")
+	since := fs.String("since", "", "Only reprocess pages added on or after this date")
+	until := fs.String("until", "", "Only reprocess pages added on or before this date")
+	username := fs.String("user", "", "Only reprocess this user's pages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("unexpected arguments")
+	}
+	const dateLayout = "2006-01-02"
+	var start, end int64
+	if *since != "" {
+		t, err := time.ParseInLocation(dateLayout, *since, time.Local)
+		if err != nil {
+			return fmt.Errorf("bad -since date: %v", err)
+		}
+		start = t.Unix()
+	}
+	if *until != "" {
+		t, err := time.ParseInLocation(dateLayout, *until, time.Local)
+		if err != nil {
+			return fmt.Errorf("bad -until date: %v", err)
+		}
+		end = t.AddDate(0, 0, 1).Unix()
+	}
+
+	d, err := db.New(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.SetConfigUsername(cfg.Username); err != nil {
+		return err
+	}
+
+	users := make(map[int64]*common.User)
+	all, err := d.GetAllUsers()
+	if err != nil {
+		return err
+	}
+	for i := range all {
+		if *username == "" || all[i].Username == *username {
+			users[all[i].Id] = &all[i]
+		}
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("no user named %q", *username)
+	}
+
+	pages, err := d.GetPagesAddedBetween(start, end)
+	if err != nil {
+		return err
+	}
+	p := proc.New(cfg)
+	procs := make(map[int64]*proc.Processor) // keyed by user ID
+	var done, failed int
+	for _, pi := range pages {
+		u := users[pi.UserId]
+		if u == nil || (*host != "" && !common.HostMatches(*host, common.GetHost(pi.OriginalURL))) {
+			continue
+		}
+		fmt.Printf("%v %v (%v)\n", pi.Id, pi.OriginalURL, pi.Title)
+		if *dryRun {
+			done++
+			continue
+		}
+		up := procs[u.Id]
+		if up == nil {
+			if up, err = p.ForUser(u); err != nil {
+				return err
+			}
+			procs[u.Id] = up
+		}
+		np, err := up.ReprocessPage(pi)
+		if err == nil {
+			err = d.UpdatePage(np)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed reprocessing %v: %v\n", pi.Id, err)
+			failed++
+			continue
+		}
+		done++
+	}
+
+	if *dryRun {
+		fmt.Printf("Would reprocess %d page(s)\n", done)
+		return nil
+	}
+	fmt.Printf("Reprocessed %d page(s)\n", done)
+	if failed > 0 {
+		return fmt.Errorf("failed reprocessing %d page(s)", failed)
+	}
+	return nil
+}
+
+func runReindex(cfg *common.Config, args []string) error {
+	if len(args) != 0 {
+		return errors.New("unexpected arguments")
+	}
+
+	d, err := db.New(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.SetConfigUsername(cfg.Username); err != nil {
+		return err
+	}
+
+	done, failed, err := reindexPages(cfg, d)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d page(s)\n", done)
+	if failed > 0 {
+		return fmt.Errorf("failed indexing %d page(s)", failed)
+	}
+	return nil
+}
+
+func runUser(cfg *common.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing subcommand")
+	}
+
+	d, err := db.New(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.SetConfigUsername(cfg.Username); err != nil {
+		return err
+	}
+
+	// Returns the non-config user named by the single positional argument in fs.
+	getNamedUser := func(fs *flag.FlagSet) (*common.User, error) {
+		if fs.NArg() != 1 {
+			return nil, errors.New("expected username")
+		}
+		u, _, err := d.GetUserByName(fs.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		if u.Id == common.ConfigUserId {
+			return nil, errors.New("config user must be managed via the config file")
+		}
+		return u, nil
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "add":
+		recipient := fs.String("recipient", "", "Email address to which the user's pages are sent")
+		configFile := fs.String("config", "", "JSON file overriding rule files for the user")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("expected username")
+		}
+		name := fs.Arg(0)
+		if name == "" || name == cfg.Username {
+			return fmt.Errorf("invalid username %q", name)
+		}
+		pw, err := readPassword()
+		if err != nil {
+			return err
+		}
+		hash, err := common.HashPassword(pw)
+		if err != nil {
+			return err
+		}
+		u := common.User{
+			Username:   name,
+			Recipient:  *recipient,
+			ConfigFile: *configFile,
+		}
+		if err := d.AddUser(&u, hash); err != nil {
+			return err
+		}
+		fmt.Printf("Added user %v with ID %d\n", u.Username, u.Id)
+	case "disable", "enable":
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		u, err := getNamedUser(fs)
+		if err != nil {
+			return err
+		}
+		if err := d.SetUserDisabled(u.Id, args[0] == "disable"); err != nil {
+			return err
+		}
+	case "list":
+		users, err := d.GetAllUsers()
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			state := "enabled"
+			if u.Disabled {
+				state = "disabled"
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", u.Id, u.Username, state, u.Recipient)
+		}
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+	return nil
+}
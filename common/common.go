@@ -13,7 +13,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"unicode"
 )
 
 const (
@@ -32,11 +34,144 @@ var supportedImageExts = map[string]struct{}{
 
 type PageInfo struct {
 	Id          string
+	UserId      int64
 	OriginalURL string
 	Title       string
-	TimeAdded   int64 // time_t
-	Token       string
+	Author      string
+	TimeAdded   int64  // time_t
+	Token       string // legacy per-page token; no longer generated or checked
+	Archived    bool
+	TimeDeleted int64 // time_t when moved to trash, or 0 if not in trash
+	FromFriend  bool
+	Tags        []string
+	Text        string // plain-text content; only set by proc.Processor.ProcessURL
+
+	// Metadata extracted from the page.
+	TimePublished int64  // time_t; 0 if unknown
+	WordCount     int    // number of words in Text
+	ReadingTime   int    // estimated reading time in minutes
+	Excerpt       string // short plain-text summary
+	Language      string // BCP 47 language tag, e.g. "en-US"
+	LeadImage     string // filename of the lead image in the page's directory
+}
+
+// JobState describes the state of a Job.
+type JobState string
+
+const (
+	JobQueued   JobState = "queued"
+	JobFetching JobState = "fetching"
+	JobBuilding JobState = "building"
+	JobSending  JobState = "sending"
+	JobFailed   JobState = "failed"
+)
+
+// Job describes a queued request to add a page.
+type Job struct {
+	Id          int64
+	UserId      int64
+	PageId      string
+	URL         string
 	FromFriend  bool
+	Archive     bool
+	Kindle      bool
+	Reprocess   bool     // reprocess an existing page rather than adding a new one
+	Saved       bool     // page was saved by an earlier attempt and only needs to be sent
+	Tags        []string // tags to apply to the page once it's saved
+	State       JobState
+	Error       string
+	Attempts    int
+	TimeAdded   int64 // time_t
+	NextAttempt int64 // time_t; 0 if the job won't be retried
+	LastActive  int64 // time_t when a worker last claimed or reported progress on the job
+}
+
+// ConfigUserId is the ID of the user described by Config.Username and
+// Config.Password. This user's pages are stored directly in Config.PageDir.
+const ConfigUserId int64 = 1
+
+// User describes an account.
+type User struct {
+	Id       int64
+	Username string
+	// Recipient contains the email address where the user's documents should
+	// be mailed. It overrides Config.Recipient.
+	Recipient string
+	// ConfigFile optionally contains the path to a JSON file containing the
+	// user's rule files. See Config.ForUser.
+	ConfigFile  string
+	Disabled    bool
+	TimeCreated int64 // time_t
+}
+
+// Session describes a logged-in browser session.
+type Session struct {
+	Id        int64 // not the secret value stored in the cookie
+	UserId    int64
+	IPAddress string
+	UserAgent string
+	TimeAdded int64 // time_t
+	LastSeen  int64 // time_t
+}
+
+// Scopes that can be granted to APIToken.
+const (
+	ScopeAdd    = "add"    // add pages
+	ScopeRead   = "read"   // list and get pages
+	ScopeWrite  = "write"  // archive, unarchive, and delete pages
+	ScopeKindle = "kindle" // send pages to Kindle devices
+)
+
+// AllScopes lists all scopes that can be granted to APIToken.
+var AllScopes = []string{ScopeAdd, ScopeRead, ScopeWrite, ScopeKindle}
+
+// IsValidScope returns true if s is in AllScopes.
+func IsValidScope(s string) bool {
+	for _, sc := range AllScopes {
+		if s == sc {
+			return true
+		}
+	}
+	return false
+}
+
+// APIToken describes a token used by a client to make requests.
+// The token's secret value is only available when it is created.
+type APIToken struct {
+	Id          int64
+	UserId      int64
+	Name        string
+	Scopes      []string
+	TimeCreated int64 // time_t
+	LastUsed    int64 // time_t; 0 if never used
+	Revoked     bool
+}
+
+// HasScope returns true if t has been granted scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTags splits s on commas and whitespace and returns a sorted list of
+// unique, lowercase tags.
+func ParseTags(s string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, t := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		if !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	return tags
 }
 
 func GetHost(urlStr string) string {
@@ -47,6 +182,12 @@ func GetHost(urlStr string) string {
 	return u.Host
 }
 
+// HostMatches returns true if host matches pattern, which may be "*" to match
+// all hosts or a hostname to match it and its subdomains.
+func HostMatches(pattern, host string) bool {
+	return pattern == "*" || pattern == host || strings.HasSuffix(host, "."+pattern)
+}
+
 func SHA1String(input string) string {
 	h := sha1.New()
 	io.WriteString(h, input)
@@ -66,18 +207,26 @@ func WriteTemplate(w io.Writer, cfg *Config, t string, d interface{}, fm templat
 	return nil
 }
 
+// DocInfo contains optional metadata describing a saved page.
+type DocInfo struct {
+	Author    string
+	PubDate   string // RFC 3339
+	SourceURL string
+	Language  string
+}
+
 // WriteHeader writes everything up to the closing </head> tag.
-func WriteHeader(w io.Writer, cfg *Config, stylesheets []string, title, favicon, author string) {
+func WriteHeader(w io.Writer, cfg *Config, stylesheets []string, title, favicon string, info DocInfo) {
 	d := struct {
 		Title       string
 		Stylesheets []string
 		Favicon     string
-		Author      string
+		DocInfo
 	}{
 		Title:       title,
 		Stylesheets: stylesheets,
 		Favicon:     cfg.GetPath(StaticURLPath, faviconFile),
-		Author:      author,
+		DocInfo:     info,
 	}
 
 	if len(favicon) > 0 {
@@ -85,7 +234,7 @@ func WriteHeader(w io.Writer, cfg *Config, stylesheets []string, title, favicon,
 	}
 
 	t := `<!DOCTYPE html>
-<html>
+<html{{if .Language}} lang="{{.Language}}"{{end}}>
   <head>
     <meta content="text/html; charset=utf-8" http-equiv="Content-Type"/>
     <meta name="viewport" content="width=device-width, initial-scale=1.0"/>
@@ -95,6 +244,12 @@ func WriteHeader(w io.Writer, cfg *Config, stylesheets []string, title, favicon,
     <meta name="author" content="{{.Author}}"/>
     <meta name="DCTERMS.creator" content="{{.Author}}"/>
     {{- end}}
+    {{if .PubDate -}}
+    <meta name="DCTERMS.date" content="{{.PubDate}}"/>
+    {{- end}}
+    {{if .SourceURL -}}
+    <meta name="DCTERMS.source" content="{{.SourceURL}}"/>
+    {{- end}}
     {{range .Stylesheets}}<link rel="stylesheet" href="{{.}}"/>{{end}}
     <link rel="icon" href="{{.Favicon}}"/>
   </head>
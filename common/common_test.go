@@ -4,6 +4,7 @@
 package common
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -30,3 +31,19 @@ func TestGetLocalImageFilename(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTags(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"foo", []string{"foo"}},
+		{" b, a  c,,", []string{"a", "b", "c"}},
+		{"Foo foo FOO", []string{"foo"}},
+	} {
+		if got := ParseTags(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseTags(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -4,9 +4,25 @@
 package common
 
 import (
+	"fmt"
 	"log"
 	"net/url"
 	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Values for Config.Extractor.
+const (
+	MercuryExtractor = "mercury"
+	NativeExtractor  = "native"
+)
+
+// Values for Config.DocFormat.
+const (
+	EPUBFormat = "epub"
+	MOBIFormat = "mobi"
 )
 
 // Config contains the server's configuration.
@@ -15,13 +31,52 @@ type Config struct {
 	// e.g. "/home/user/.node/bin/mercury-parser". See installation instructions
 	// at https://github.com/postlight/mercury-parser.
 	ParserPath string `json:"parserPath"`
+	// Extractor specifies how articles are extracted from web pages:
+	// MercuryExtractor ("mercury", the default) runs ParserPath, while
+	// NativeExtractor ("native") uses a built-in Readability-style extractor.
+	Extractor string `json:"extractor"`
+	// ExtractorsFile is the path to a file describing which extractors
+	// should be used for different sites, e.g. "/var/lib/aread/extractors.json".
+	// The file consists of a JSON object, where keys are URL wildcards (as in
+	// HiddenTagsFile) and values are objects describing extractors. The most
+	// specific matching key is used, and Extractor is used if no keys match.
+	// "type" defaults to Extractor and may be "mercury", "native", "command"
+	// (an external command that reads the page's HTML from stdin, receives the
+	// page's URL in the AREAD_URL environment variable, and writes
+	// mercury-parser-style JSON to stdout), or "selector" (CSS selectors
+	// matching the page's content and optionally its title, author, date, next
+	// page link, and elements to remove). For example:
+	//
+	//   {
+	//     "*": {"type": "native"},
+	//     "example.com": {"type": "command", "command": ["/usr/local/bin/extract", "-json"]},
+	//     "example.org": {
+	//       "type": "selector",
+	//       "content": "div.story-body",
+	//       "title": "h1.headline",
+	//       "author": "span.byline a",
+	//       "date": "time.published",
+	//       "nextPage": "a.next-page",
+	//       "remove": ["div.ad", "aside"]
+	//     }
+	//   }
+	ExtractorsFile string `json:"extractorsFile"`
 	// KindlegenPath contains the path to the kindlegen executable,
 	// e.g. "/usr/local/bin/kindlegen". kindlegen is available from
 	// https://www.amazon.com/gp/feature.html?ie=UTF8&docId=1000765211.
 	KindlegenPath string `json:"kindlegenPath"`
+	// DocFormat specifies the format of documents that are sent to Kindle
+	// devices: MOBIFormat ("mobi") uses KindlegenPath, while EPUBFormat
+	// ("epub") uses a built-in EPUB 3 writer. It defaults to "mobi" if
+	// KindlegenPath is set and "epub" otherwise.
+	DocFormat string `json:"docFormat"`
 	// BaseURL contains the base URL at which the site is served,
 	// e.g. "https://example.org/aread".
 	BaseURL string `json:"baseUrl"`
+	// TrustedProxies contains IP addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For and X-Forwarded-Proto headers should be honored,
+	// e.g. ["127.0.0.1", "10.0.0.0/8"].
+	TrustedProxies []string `json:"trustedProxies"`
 	// StaticDir is the path to this repository's static/ directory,
 	// e.g. "/home/user/aread/static".
 	StaticDir string `json:"staticDir"`
@@ -65,6 +120,17 @@ type Config struct {
 	//     ]
 	//   }
 	HiddenTagsFile string `json:"hiddenTagsFile"`
+	// AutoTagsFile is the path to a file listing tags that should be
+	// automatically applied to pages when they're added. The file consists
+	// of a JSON object, where keys are URL wildcards (as in HiddenTagsFile)
+	// and values are arrays of tags. For example:
+	//
+	//   {
+	//     "github.com": ["code"],
+	//     "nytimes.com": ["news"],
+	//     "example.org": ["project-x", "work"]
+	//   }
+	AutoTagsFile string `json:"autoTagsFile"`
 	// Database is the path to the SQLite database containing page information,
 	// e.g. "/var/lib/aread/data/aread.db".
 	Database string `json:"database"`
@@ -77,14 +143,21 @@ type Config struct {
 	// Sender contains the sender email address used when mailing documents,
 	// e.g. "user@example.org".
 	Sender string `json:"sender"`
-	// Username contains a basic HTTP authentication username.
+	// Username contains the username of the site's primary user. Additional
+	// users can be created using the "user" command.
 	Username string `json:"username"`
-	// Password contains a basic HTTP authentication password.
+	// Password contains a bcrypt hash of the primary user's password, as printed
+	// by the "hash-password" command. Plaintext passwords are still accepted
+	// but a warning is logged.
 	Password          string `json:"password"`
 	FriendBaseURL     string `json:"friendBaseUrl"`
 	FriendRemoteToken string `json:"friendRemoteToken"`
 	FriendLocalToken  string `json:"friendLocalToken"`
 	FriendTitlePrefix string `json:"friendTitlePrefix"`
+	// MaxPages contains the maximum number of pages to follow via next-page
+	// links when saving multi-page articles. It defaults to 10 and must be
+	// at least 1; the first page is always saved.
+	MaxPages int `json:"maxPages"`
 	// DownloadImages controls whether a page's images should be downloaded.
 	// It is true by default.
 	DownloadImages bool `json:"downloadImages"`
@@ -103,12 +176,35 @@ type Config struct {
 	// MaxImageProcs contains the maximum number of images to process
 	// simultaneously. It defaults to 3.
 	MaxImageProcs int `json:"maxImageProcs"`
+	// EInkImages controls whether separate copies of images are written for
+	// documents sent to Kindle devices. The copies are converted to 16-level
+	// grayscale with stretched contrast, while web pages keep full-color images.
+	// It defaults to false.
+	EInkImages bool `json:"einkImages"`
+	// EInkDither controls whether Floyd-Steinberg dithering is used when
+	// reducing EInkImages copies to 16 gray levels. It defaults to false.
+	EInkDither bool `json:"einkDither"`
+	// EInkJPEGQuality contains the quality (up to 100) to use when saving
+	// EInkImages copies of JPEG images. It defaults to 75.
+	EInkJPEGQuality int `json:"einkJpegQuality"`
 	// DownloadFavicons controls whether pages' favicon images are saved.
 	// It defaults to false.
 	DownloadFavicons bool `json:"downloadFavicons"`
+	// JobWorkers contains the number of pages that can be processed
+	// simultaneously in the background. It defaults to 2.
+	JobWorkers int `json:"jobWorkers"`
+	// MaxJobAttempts contains the maximum number of times that processing a
+	// page will be attempted before giving up. It defaults to 5.
+	MaxJobAttempts int `json:"maxJobAttempts"`
 	// MaxListSize contains the maximum number of pages to list on the website.
 	// It defaults to 50.
 	MaxListSize int `json:"maxListSize"`
+	// SessionIdleHours contains the number of hours after which an unused
+	// login session expires. It defaults to 336 (two weeks); 0 disables the limit.
+	SessionIdleHours int `json:"sessionIdleHours"`
+	// SessionMaxHours contains the number of hours after which a login session
+	// expires regardless of use. It defaults to 2160 (90 days); 0 disables the limit.
+	SessionMaxHours int `json:"sessionMaxHours"`
 	// Verbose controls whether verbose logs are written.
 	Verbose bool `json:"verbose"`
 	// Logger is used to log messages.
@@ -118,27 +214,101 @@ type Config struct {
 // ReadConfig returns a new Config based on the JSON file at p.
 func ReadConfig(p string, lg *log.Logger) (*Config, error) {
 	cfg := Config{
-		Logger:         lg,
-		PageDir:        "/tmp",
-		DownloadImages: true,
-		MaxImageWidth:  1024,
-		MaxImageHeight: 768,
-		MaxImageBytes:  1 * 1024 * 1024,
-		JPEGQuality:    85,
-		MaxImageProcs:  3,
-		MaxListSize:    50,
+		Logger:           lg,
+		PageDir:          "/tmp",
+		MaxPages:         10,
+		DownloadImages:   true,
+		MaxImageWidth:    1024,
+		MaxImageHeight:   768,
+		MaxImageBytes:    1 * 1024 * 1024,
+		JPEGQuality:      85,
+		MaxImageProcs:    3,
+		EInkJPEGQuality:  75,
+		JobWorkers:       2,
+		MaxJobAttempts:   5,
+		MaxListSize:      50,
+		SessionIdleHours: 14 * 24,
+		SessionMaxHours:  90 * 24,
 	}
 
 	if err := ReadJSONFile(p, &cfg); err != nil {
 		return nil, err
 	}
 
+	if cfg.DocFormat == "" {
+		if cfg.KindlegenPath != "" {
+			cfg.DocFormat = MOBIFormat
+		} else {
+			cfg.DocFormat = EPUBFormat
+		}
+	}
+	if cfg.MaxPages < 1 {
+		return nil, fmt.Errorf("maxPages is %v; must be at least 1", cfg.MaxPages)
+	}
 	if cfg.BaseURL[len(cfg.BaseURL)-1] == '/' {
 		cfg.BaseURL = cfg.BaseURL[:len(cfg.BaseURL)-1]
 	}
+	if cfg.Password != "" && !IsPasswordHash(cfg.Password) && lg != nil {
+		lg.Println("Config contains a plaintext password; use the hash-password command to hash it")
+	}
 	return &cfg, nil
 }
 
+// userConfig contains the fields that can be set in User.ConfigFile.
+type userConfig struct {
+	ExtractorsFile  string `json:"extractorsFile"`
+	URLPatternsFile string `json:"urlPatternsFile"`
+	BadContentFile  string `json:"badContentFile"`
+	HiddenTagsFile  string `json:"hiddenTagsFile"`
+	AutoTagsFile    string `json:"autoTagsFile"`
+}
+
+// GetSessionLimits returns the idle and absolute lifetimes of login sessions.
+// 0 is returned for disabled limits.
+func (cfg *Config) GetSessionLimits() (idle, max time.Duration) {
+	return time.Duration(cfg.SessionIdleHours) * time.Hour, time.Duration(cfg.SessionMaxHours) * time.Hour
+}
+
+// GetUserPageDir returns the directory where u's pages are saved.
+func (cfg *Config) GetUserPageDir(u *User) string {
+	if u.Id == ConfigUserId {
+		return cfg.PageDir
+	}
+	return filepath.Join(cfg.PageDir, "users", strconv.FormatInt(u.Id, 10))
+}
+
+// ForUser returns a copy of cfg that should be used when processing u's pages.
+// PageDir and Recipient are updated to u's values, and rule files listed in
+// u.ConfigFile (a JSON object with keys like "urlPatternsFile" and
+// "hiddenTagsFile") override cfg's. cfg is returned unchanged for the user
+// described by cfg.
+func (cfg *Config) ForUser(u *User) (*Config, error) {
+	c := *cfg
+	if u.Id == ConfigUserId {
+		return &c, nil
+	}
+	c.PageDir = cfg.GetUserPageDir(u)
+	c.Recipient = u.Recipient
+	if u.ConfigFile != "" {
+		var uc userConfig
+		if err := ReadJSONFile(u.ConfigFile, &uc); err != nil {
+			return nil, fmt.Errorf("unable to read user config: %v", err)
+		}
+		for dst, src := range map[*string]string{
+			&c.ExtractorsFile:  uc.ExtractorsFile,
+			&c.URLPatternsFile: uc.URLPatternsFile,
+			&c.BadContentFile:  uc.BadContentFile,
+			&c.HiddenTagsFile:  uc.HiddenTagsFile,
+			&c.AutoTagsFile:    uc.AutoTagsFile,
+		} {
+			if src != "" {
+				*dst = src
+			}
+		}
+	}
+	return &c, nil
+}
+
 func (cfg *Config) GetPath(p ...string) string {
 	u, err := url.Parse(cfg.BaseURL)
 	if err != nil {
@@ -0,0 +1,55 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package common
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns a bcrypt hash of pw suitable for Config.Password.
+func HashPassword(pw string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	return string(b), err
+}
+
+// IsPasswordHash returns true if s looks like a hash produced by HashPassword.
+func IsPasswordHash(s string) bool {
+	for _, p := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPassword returns true if pw matches stored, which may be either
+// a hash produced by HashPassword or a (deprecated) plaintext password.
+func CheckPassword(stored, pw string) bool {
+	if stored == "" {
+		return false
+	}
+	if IsPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pw)) == nil
+	}
+	return SecureEqual(stored, pw)
+}
+
+// SecureEqual compares a and b in constant time.
+func SecureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// RandomString returns a URL-safe string encoding n random bytes.
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
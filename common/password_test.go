@@ -0,0 +1,33 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package common
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		stored string
+		pw     string
+		want   bool
+	}{
+		{string(hash), "secret", true},
+		{string(hash), "Secret", false},
+		{string(hash), "", false},
+		{"plain", "plain", true},
+		{"plain", "plain2", false},
+		{"", "", false},
+	} {
+		if got := CheckPassword(tc.stored, tc.pw); got != tc.want {
+			t.Errorf("CheckPassword(%q, %q) = %v; want %v", tc.stored, tc.pw, got, tc.want)
+		}
+	}
+}
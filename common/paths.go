@@ -4,12 +4,21 @@
 package common
 
 const (
-	AddURLPath     = "add"
-	ArchiveURLPath = "archive"
-	AuthURLPath    = "auth"
-	KindleURLPath  = "kindle"
-	PagesURLPath   = "pages"
-	StaticURLPath  = "static"
+	AddURLPath       = "add"
+	APIURLPath       = "api/v1"
+	ArchiveURLPath   = "archive"
+	AuthURLPath      = "auth"
+	KindleURLPath    = "kindle"
+	LogoutURLPath    = "logout"
+	MetricsURLPath   = "metrics"
+	PagesURLPath     = "pages"
+	ReprocessURLPath = "reprocess"
+	SearchURLPath    = "search"
+	SessionsURLPath  = "sessions"
+	TagsURLPath      = "tags"
+	TokensURLPath    = "tokens"
+	TrashURLPath     = "trash"
+	StaticURLPath    = "static"
 
 	AppCSSFile    = "app.css"
 	CommonCSSFile = "common.css"
@@ -19,7 +28,17 @@ const (
 	AddKindleParam = "k"
 	AddURLParam    = "u"
 	ArchiveParam   = "a"
+	AuthorParam    = "author"
+	CSRFParam      = "csrf"
 	IDParam        = "i"
 	RedirectParam  = "r"
+	SearchParam    = "q"
+	SortParam      = "sort"
+	TagParam       = "tag"  // single tag used to filter lists
+	TagsParam      = "tags" // comma-separated list of tags
 	TokenParam     = "t"
+
+	// CSRFPlaceholder is written to saved pages in place of the CSRF token,
+	// which is substituted when the page is served.
+	CSRFPlaceholder = "__AREAD_CSRF_TOKEN__"
 )
@@ -7,97 +7,542 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/derat/aread/common"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ErrPageNotFound is returned by GetPage if the requested page doesn't exist.
+var ErrPageNotFound = errors.New("page not found in database")
+
+// ErrJobPending is returned by AddJob if the page already has a pending job.
+var ErrJobPending = errors.New("page already has a pending job")
+
+// ErrSearchUnavailable is returned by SearchPages if full-text search is unavailable.
+var ErrSearchUnavailable = errors.New("full-text search unavailable; build with -tags sqlite_fts5")
+
 type Database struct {
-	db *sql.DB
+	db     *sql.DB
+	search bool // true if the PageText FTS5 table is available
 }
 
+// New opens the database at path, applying any pending migrations.
 func New(path string) (*Database, error) {
+	d, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Migrate(); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("unable to initialize database: %v", err)
+	}
+	if err := d.initSearch(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Open opens the database at path without applying migrations.
+// Most callers should use New instead.
+func Open(path string) (*Database, error) {
 	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
 	}
+	return &Database{db: db}, nil
+}
+
+// Close closes the database.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
 
-	for _, q := range []string{
-		`CREATE TABLE IF NOT EXISTS Pages (
-			Id STRING PRIMARY KEY NOT NULL,
-			OriginalUrl STRING NOT NULL,
-			Title STRING NOT NULL,
-			TimeAdded INTEGER NOT NULL,
-			Token STRING NOT NULL,
-			Archived BOOLEAN NOT NULL DEFAULT 0)`,
-		`CREATE TABLE IF NOT EXISTS Sessions (
-			Id STRING NOT NULL,
-			TimeAdded INTEGER,
-			IpAddress STRING)`,
-	} {
-		if _, err = db.Exec(q); err != nil {
-			return nil, fmt.Errorf("unable to initialize database: %v", err)
+// initSearch updates d.search to reflect whether the PageText table can be used.
+func (d *Database) initSearch() error {
+	rows, err := d.db.Query("SELECT PageId FROM PageText LIMIT 0")
+	if err != nil {
+		if !isMissingFTS5(err) && !strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("unable to initialize search: %v", err)
 		}
+		d.search = false
+		return nil
 	}
+	d.search = true
+	return rows.Close()
+}
 
-	return &Database{db: db}, nil
+// createPageText creates the PageText FTS5 table if it doesn't already exist.
+func createPageText(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS PageText USING fts5(
+		PageId UNINDEXED, Title, Author, Host, Body, tokenize = 'porter unicode61')`)
+	return err
+}
+
+// isMissingFTS5 returns true if err was caused by go-sqlite3 being built without
+// the sqlite_fts5 tag.
+func isMissingFTS5(err error) bool {
+	return strings.Contains(err.Error(), "no such module")
 }
 
-func (d *Database) ValidSession(id string) (bool, error) {
-	rows, err := d.db.Query("SELECT * FROM Sessions WHERE Id = ?", id)
+// ResetSearch empties the PageText table, creating it if needed.
+// Pages should then be passed to IndexPage to make them searchable again.
+// ErrSearchUnavailable is returned if FTS5 support isn't compiled in.
+func (d *Database) ResetSearch() error {
+	tx, err := d.db.Begin()
 	if err != nil {
-		return false, err
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DROP TABLE IF EXISTS PageText")
+	if err == nil {
+		err = createPageText(tx)
+	}
+	if err != nil {
+		if isMissingFTS5(err) {
+			return ErrSearchUnavailable
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.search = true
+	return nil
+}
+
+// IndexPage replaces the searchable text of the page with ID pi.Id
+// using pi's title, author, URL, and text.
+func (d *Database) IndexPage(pi common.PageInfo) error {
+	if !d.search {
+		return ErrSearchUnavailable
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := indexPageText(tx, pi); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SearchAvailable returns true if SearchPages can be used.
+func (d *Database) SearchAvailable() bool {
+	return d.search
+}
+
+// sessionExpiryClause is a WHERE clause matching sessions that have expired.
+// Its arguments are the minimum LastSeen and TimeAdded values; 0 disables either check.
+const sessionExpiryClause = "(LastSeen < ?1 AND ?1 > 0) OR (TimeAdded < ?2 AND ?2 > 0)"
+
+// getSessionCutoffs returns the arguments for sessionExpiryClause.
+func getSessionCutoffs(now time.Time, idle, max time.Duration) (minSeen, minAdded int64) {
+	if idle > 0 {
+		minSeen = now.Add(-idle).Unix()
+	}
+	if max > 0 {
+		minAdded = now.Add(-max).Unix()
+	}
+	return minSeen, minAdded
+}
+
+// UseSession returns the session with the supplied ID and its enabled user after
+// updating the session's last-seen time to now. nils are returned if the session
+// doesn't exist, has expired, or belongs to a disabled user. Sessions expire after
+// being unused for idle or after max has elapsed since their creation; 0 disables
+// either limit.
+func (d *Database) UseSession(id string, now time.Time, idle, max time.Duration) (*common.Session, *common.User, error) {
+	minSeen, minAdded := getSessionCutoffs(now, idle, max)
+	rows, err := d.db.Query("SELECT s.rowid, s.UserId, s.IpAddress, s.UserAgent, s.TimeAdded, s.LastSeen, "+
+		prefixCols(userCols, "u")+" FROM Sessions s JOIN Users u ON u.Id = s.UserId "+
+		"WHERE s.Id = ?3 AND u.Disabled = 0 AND NOT ("+sessionExpiryClause+")", minSeen, minAdded, id)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer rows.Close()
-	return rows.Next(), nil
+	if !rows.Next() {
+		return nil, nil, rows.Err()
+	}
+	var s common.Session
+	var u common.User
+	if err := rows.Scan(&s.Id, &s.UserId, &s.IPAddress, &s.UserAgent, &s.TimeAdded, &s.LastSeen,
+		&u.Id, &u.Username, &u.Recipient, &u.ConfigFile, &u.Disabled, &u.TimeCreated); err != nil {
+		return nil, nil, err
+	}
+	rows.Close()
+
+	s.LastSeen = now.Unix()
+	if _, err := d.db.Exec("UPDATE Sessions SET LastSeen = ? WHERE rowid = ?", s.LastSeen, s.Id); err != nil {
+		return nil, nil, err
+	}
+	return &s, &u, nil
 }
 
-func (d *Database) AddSession(id, ip string) error {
-	if _, err := d.db.Exec("INSERT OR REPLACE INTO Sessions (Id, TimeAdded, IpAddress) VALUES(?, ?, ?)", id, time.Now().Unix(), ip); err != nil {
+// AddSession records a session with the supplied ID for the user with the supplied ID.
+func (d *Database) AddSession(id, ip, userAgent string, userId int64) error {
+	now := time.Now().Unix()
+	if _, err := d.db.Exec("INSERT INTO Sessions (Id, TimeAdded, LastSeen, IpAddress, UserAgent, UserId) "+
+		"VALUES(?, ?, ?, ?, ?, ?)", id, now, now, ip, userAgent, userId); err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetSessions returns the user's sessions, ordered by descending last-seen time.
+func (d *Database) GetSessions(userId int64) (sessions []common.Session, err error) {
+	rows, err := d.db.Query("SELECT rowid, UserId, IpAddress, UserAgent, TimeAdded, LastSeen "+
+		"FROM Sessions WHERE UserId = ? ORDER BY LastSeen DESC, rowid DESC", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s common.Session
+		if err := rows.Scan(&s.Id, &s.UserId, &s.IPAddress, &s.UserAgent, &s.TimeAdded, &s.LastSeen); err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes the user's session with the supplied common.Session ID.
+func (d *Database) RevokeSession(userId, id int64) error {
+	_, err := d.db.Exec("DELETE FROM Sessions WHERE UserId = ? AND rowid = ?", userId, id)
+	return err
+}
+
+// DeleteSession deletes the session with the supplied cookie value.
+func (d *Database) DeleteSession(id string) error {
+	_, err := d.db.Exec("DELETE FROM Sessions WHERE Id = ?", id)
+	return err
+}
+
+// PruneSessions deletes sessions that have expired as described in UseSession.
+// The number of deleted sessions is returned.
+func (d *Database) PruneSessions(now time.Time, idle, max time.Duration) (int64, error) {
+	minSeen, minAdded := getSessionCutoffs(now, idle, max)
+	res, err := d.db.Exec("DELETE FROM Sessions WHERE "+sessionExpiryClause, minSeen, minAdded)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// AddPage inserts or replaces pi. If search is available, pi's text is also indexed.
 func (d *Database) AddPage(pi common.PageInfo) error {
-	q := "INSERT OR REPLACE INTO Pages (Id, OriginalUrl, Title, TimeAdded, Token) VALUES(?, ?, ?, ?, ?)"
-	if _, err := d.db.Exec(q, pi.Id, pi.OriginalURL, pi.Title, pi.TimeAdded, pi.Token); err != nil {
+	tx, err := d.db.Begin()
+	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	q := `INSERT OR REPLACE INTO Pages (Id, UserId, OriginalUrl, Title, TimeAdded, Token,
+		Author, TimePublished, WordCount, ReadingTime, Excerpt, Language, LeadImage, FromFriend)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(q, pi.Id, pi.UserId, pi.OriginalURL, pi.Title, pi.TimeAdded, pi.Token,
+		pi.Author, pi.TimePublished, pi.WordCount, pi.ReadingTime, pi.Excerpt, pi.Language, pi.LeadImage,
+		pi.FromFriend); err != nil {
+		return err
+	}
+	if d.search {
+		if err := indexPageText(tx, pi); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// indexPageText replaces pi's text in the PageText table.
+func indexPageText(tx *sql.Tx, pi common.PageInfo) error {
+	if _, err := tx.Exec("DELETE FROM PageText WHERE PageId = ?", pi.Id); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO PageText (PageId, Title, Author, Host, Body) VALUES(?, ?, ?, ?, ?)",
+		pi.Id, pi.Title, pi.Author, common.GetHost(pi.OriginalURL), pi.Text)
+	return err
+}
+
+// UpdatePage updates the existing page with ID pi.Id using pi's URL, title, text,
+// and metadata. The page's time added, archived and trashed states, and tags are preserved.
+// ErrPageNotFound is returned if the page doesn't exist.
+func (d *Database) UpdatePage(pi common.PageInfo) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE Pages SET OriginalUrl = ?, Title = ?, Author = ?, TimePublished = ?,
+		WordCount = ?, ReadingTime = ?, Excerpt = ?, Language = ?, LeadImage = ? WHERE Id = ?`,
+		pi.OriginalURL, pi.Title, pi.Author, pi.TimePublished, pi.WordCount, pi.ReadingTime,
+		pi.Excerpt, pi.Language, pi.LeadImage, pi.Id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrPageNotFound
+	}
+	if d.search {
+		if err := indexPageText(tx, pi); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPagesAddedBetween returns all users' pages that aren't in the trash and were
+// added in the range [start, end), with the oldest first. If end is 0, the range is unbounded.
+func (d *Database) GetPagesAddedBetween(start, end int64) (pages []common.PageInfo, err error) {
+	q := "SELECT " + pageCols + " FROM Pages p WHERE p.TimeDeleted = 0 AND p.TimeAdded >= ?"
+	args := []interface{}{start}
+	if end != 0 {
+		q += " AND p.TimeAdded < ?"
+		args = append(args, end)
+	}
+	rows, err := d.db.Query(q+" ORDER BY p.TimeAdded ASC, p.Id ASC", args...)
+	if err != nil {
+		return pages, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		pi, err := scanPage(rows)
+		if err != nil {
+			return pages, err
+		}
+		pages = append(pages, pi)
+	}
+	return pages, rows.Err()
+}
+
+// pageCols lists the Pages columns (aliased as "p") that are read by scanPage.
+const pageCols = "p.Id, p.UserId, p.OriginalUrl, p.Title, p.TimeAdded, p.Token, p.Archived, p.TimeDeleted, " +
+	"p.Author, p.TimePublished, p.WordCount, p.ReadingTime, p.Excerpt, p.Language, p.LeadImage, p.FromFriend"
+
+// scanPage scans pageCols from rows into a PageInfo.
+// Additional columns following pageCols are scanned into extra.
+func scanPage(rows *sql.Rows, extra ...interface{}) (pi common.PageInfo, err error) {
+	dest := []interface{}{&pi.Id, &pi.UserId, &pi.OriginalURL, &pi.Title, &pi.TimeAdded, &pi.Token,
+		&pi.Archived, &pi.TimeDeleted, &pi.Author, &pi.TimePublished, &pi.WordCount, &pi.ReadingTime,
+		&pi.Excerpt, &pi.Language, &pi.LeadImage, &pi.FromFriend}
+	err = rows.Scan(append(dest, extra...)...)
+	return pi, err
 }
 
+// GetPage returns the page with the supplied ID, even if it's in the trash.
 func (d *Database) GetPage(id string) (pi common.PageInfo, err error) {
-	rows, err := d.db.Query("SELECT Id, OriginalUrl, Title, TimeAdded, Token FROM Pages WHERE Id = ?", id)
+	rows, err := d.db.Query("SELECT "+pageCols+", "+pageTagsCol+" FROM Pages p WHERE p.Id = ?", id)
 	if err != nil {
 		return pi, err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		return pi, errors.New("page not found in database")
+		if err := rows.Err(); err != nil {
+			return pi, err
+		}
+		return pi, ErrPageNotFound
 	}
-	if err = rows.Scan(&pi.Id, &pi.OriginalURL, &pi.Title, &pi.TimeAdded, &pi.Token); err != nil {
+	var tags string
+	if pi, err = scanPage(rows, &tags); err != nil {
 		return pi, err
 	}
+	pi.Tags = common.ParseTags(tags)
 	return pi, nil
 }
 
-func (d *Database) GetAllPages(archived bool, maxPages int) (pages []common.PageInfo, err error) {
-	q := "SELECT Id, OriginalUrl, Title, TimeAdded, Token FROM Pages WHERE Archived = ? ORDER BY TimeAdded DESC LIMIT ?"
-	rows, err := d.db.Query(q, archived, maxPages)
+// pageTagsCol is a column expression that returns a page's tags separated by commas.
+const pageTagsCol = `(SELECT IFNULL(GROUP_CONCAT(t.Name, ','), '') FROM PageTags pt
+	JOIN Tags t ON t.Id = pt.TagId WHERE pt.PageId = p.Id)`
+
+// GetAllPages returns up to maxPages of the user's archived or unarchived pages
+// that aren't in the trash, with the newest first. If tag is non-empty, only pages with the tag are returned.
+func (d *Database) GetAllPages(userId int64, archived bool, tag string, maxPages int) (pages []common.PageInfo, err error) {
+	return d.QueryPages(PageQuery{UserId: userId, Archived: archived, Tag: tag, Max: maxPages})
+}
+
+// PageQuery describes pages to be returned by QueryPages.
+type PageQuery struct {
+	// UserId contains the ID of the user whose pages are returned.
+	UserId int64
+	// Archived specifies whether archived or unarchived pages are returned.
+	Archived bool
+	// Trashed specifies that only pages in the trash should be returned.
+	// Archived is ignored if it is true.
+	Trashed bool
+	// Tag optionally specifies a tag that returned pages must have.
+	Tag string
+	// Author optionally specifies the author of returned pages.
+	Author string
+	// Order specifies the order in which pages are returned.
+	Order PageOrder
+	// BeforeTime and BeforeId optionally specify the position of the last page
+	// from a previous call. Only older pages will be returned. They are only
+	// supported with OrderAdded.
+	BeforeTime int64
+	BeforeId   string
+	// Max contains the maximum number of pages to return.
+	Max int
+}
+
+// PageOrder describes the order of pages returned by QueryPages.
+type PageOrder string
+
+const (
+	// OrderAdded returns the most-recently-added pages first.
+	OrderAdded PageOrder = ""
+	// OrderPublished returns the most-recently-published pages first.
+	OrderPublished PageOrder = "published"
+	// OrderShortest returns the pages with the shortest reading times first.
+	OrderShortest PageOrder = "shortest"
+	// OrderLongest returns the pages with the longest reading times first.
+	OrderLongest PageOrder = "longest"
+)
+
+// pageOrderClauses maps from each PageOrder to the corresponding ORDER BY clause.
+// Pages saved before word counts were recorded have zero counts and are listed last.
+var pageOrderClauses = map[PageOrder]string{
+	OrderAdded:     "p.TimeAdded DESC, p.Id DESC",
+	OrderPublished: "p.TimePublished DESC, p.TimeAdded DESC, p.Id DESC",
+	OrderShortest:  "p.WordCount = 0, p.WordCount ASC, p.TimeAdded DESC, p.Id DESC",
+	OrderLongest:   "p.WordCount DESC, p.TimeAdded DESC, p.Id DESC",
+}
+
+// ParsePageOrder returns the PageOrder named by s.
+func ParsePageOrder(s string) (PageOrder, error) {
+	o := PageOrder(s)
+	if s == "added" {
+		o = OrderAdded
+	}
+	if _, ok := pageOrderClauses[o]; !ok {
+		return OrderAdded, fmt.Errorf("invalid order %q", s)
+	}
+	return o, nil
+}
+
+// QueryPages returns pages matching q in the order specified by q.Order.
+func (d *Database) QueryPages(pq PageQuery) (pages []common.PageInfo, err error) {
+	q := "SELECT " + pageCols + ", " + pageTagsCol + " FROM Pages p WHERE p.UserId = ?"
+	args := []interface{}{pq.UserId}
+	if pq.Trashed {
+		q += " AND p.TimeDeleted > 0"
+	} else {
+		q += " AND p.TimeDeleted = 0 AND p.Archived = ?"
+		args = append(args, pq.Archived)
+	}
+	if pq.Tag != "" {
+		q += " AND p.Id IN (SELECT pt.PageId FROM PageTags pt JOIN Tags t ON t.Id = pt.TagId WHERE t.Name = ?)"
+		args = append(args, pq.Tag)
+	}
+	if pq.Author != "" {
+		q += " AND p.Author = ?"
+		args = append(args, pq.Author)
+	}
+	if pq.BeforeId != "" {
+		if pq.Order != OrderAdded {
+			return nil, errors.New("position only supported when ordering by time added")
+		}
+		q += " AND (p.TimeAdded < ? OR (p.TimeAdded = ? AND p.Id < ?))"
+		args = append(args, pq.BeforeTime, pq.BeforeTime, pq.BeforeId)
+	}
+	order, ok := pageOrderClauses[pq.Order]
+	if !ok {
+		return nil, fmt.Errorf("invalid order %q", pq.Order)
+	}
+	q += " ORDER BY " + order + " LIMIT ?"
+	args = append(args, pq.Max)
+
+	rows, err := d.db.Query(q, args...)
 	if err != nil {
 		return pages, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		pi := common.PageInfo{}
-		if err = rows.Scan(&pi.Id, &pi.OriginalURL, &pi.Title, &pi.TimeAdded, &pi.Token); err != nil {
+		var tags string
+		pi, err := scanPage(rows, &tags)
+		if err != nil {
 			return pages, err
 		}
+		pi.Tags = common.ParseTags(tags)
 		pages = append(pages, pi)
 	}
-	return pages, nil
+	return pages, rows.Err()
+}
+
+// Markers surrounding matched terms in SearchResult.Snippet.
+const (
+	SnippetStart = "\x02"
+	SnippetEnd   = "\x03"
+)
+
+// SearchResult describes a page matched by SearchPages.
+type SearchResult struct {
+	Page common.PageInfo
+	// Snippet contains matching text, with matched terms surrounded by
+	// SnippetStart and SnippetEnd. It is not escaped.
+	Snippet string
+}
+
+// makeFTSQuery converts a user-supplied query into an FTS5 query that
+// matches pages containing all of the query's terms. A trailing '*'
+// can be used to match a prefix.
+func makeFTSQuery(query string) string {
+	var terms []string
+	for _, t := range strings.Fields(query) {
+		prefix := strings.HasSuffix(t, "*")
+		if t = strings.TrimRight(t, "*"); t == "" {
+			continue
+		}
+		t = `"` + strings.Replace(t, `"`, `""`, -1) + `"`
+		if prefix {
+			t += "*"
+		}
+		terms = append(terms, t)
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchPages returns up to maxResults of the user's archived and unarchived
+// pages matching query, with the best matches first. Pages in the trash are excluded.
+func (d *Database) SearchPages(userId int64, query string, maxResults int) (results []SearchResult, err error) {
+	if !d.search {
+		return nil, ErrSearchUnavailable
+	}
+	fq := makeFTSQuery(query)
+	if fq == "" {
+		return nil, nil
+	}
+	// Matches in titles are weighted most heavily, followed by authors, hosts, and bodies.
+	rows, err := d.db.Query(`SELECT `+pageCols+`, snippet(PageText, -1, ?, ?, '…', 24)
+		FROM PageText JOIN Pages p ON p.Id = PageText.PageId
+		WHERE PageText MATCH ? AND p.UserId = ? AND p.TimeDeleted = 0
+		ORDER BY bm25(PageText, 0.0, 10.0, 5.0, 2.0, 1.0) LIMIT ?`,
+		SnippetStart, SnippetEnd, fq, userId, maxResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r SearchResult
+		if r.Page, err = scanPage(rows, &r.Snippet); err != nil {
+			return results, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+func (d *Database) SetPageArchived(id string, archived bool) error {
+	if _, err := d.db.Exec("UPDATE Pages SET Archived = ? WHERE Id = ?", archived, id); err != nil {
+		return err
+	}
+	return nil
 }
 
 func (d *Database) TogglePageArchived(id string) error {
@@ -106,3 +551,354 @@ func (d *Database) TogglePageArchived(id string) error {
 	}
 	return nil
 }
+
+// SetPageTrashed moves the page with the supplied ID to or from the trash.
+// Pages in the trash are omitted from lists and searches and are permanently
+// deleted by the "gc" command.
+func (d *Database) SetPageTrashed(id string, trashed bool) error {
+	var t int64
+	if trashed {
+		t = time.Now().Unix()
+	}
+	res, err := d.db.Exec("UPDATE Pages SET TimeDeleted = ? WHERE Id = ?", t, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrPageNotFound
+	}
+	return nil
+}
+
+// GetEveryPage returns all users' pages, including ones in the trash, with the oldest first.
+func (d *Database) GetEveryPage() (pages []common.PageInfo, err error) {
+	rows, err := d.db.Query("SELECT " + pageCols + " FROM Pages p ORDER BY p.TimeAdded ASC, p.Id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		pi, err := scanPage(rows)
+		if err != nil {
+			return pages, err
+		}
+		pages = append(pages, pi)
+	}
+	return pages, rows.Err()
+}
+
+// GetTrashedPages returns all users' pages that were moved to the trash before
+// the supplied time, with the oldest first.
+func (d *Database) GetTrashedPages(before int64) (pages []common.PageInfo, err error) {
+	rows, err := d.db.Query("SELECT "+pageCols+" FROM Pages p WHERE p.TimeDeleted > 0 AND p.TimeDeleted < ? "+
+		"ORDER BY p.TimeDeleted ASC", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		pi, err := scanPage(rows)
+		if err != nil {
+			return pages, err
+		}
+		pages = append(pages, pi)
+	}
+	return pages, rows.Err()
+}
+
+// GetPageIds returns the IDs of all of the user's pages, including trashed ones.
+func (d *Database) GetPageIds(userId int64) (map[string]bool, error) {
+	rows, err := d.db.Query("SELECT Id FROM Pages WHERE UserId = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// DeletePage permanently deletes the page with the supplied ID, along with its
+// tags, indexed text, and queued jobs.
+func (d *Database) DeletePage(id string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmts := []string{
+		"DELETE FROM Pages WHERE Id = ?",
+		"DELETE FROM PageTags WHERE PageId = ?",
+		"DELETE FROM Jobs WHERE PageId = ?",
+	}
+	if d.search {
+		stmts = append(stmts, "DELETE FROM PageText WHERE PageId = ?")
+	}
+	for _, q := range stmts {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM Tags WHERE Id NOT IN (SELECT TagId FROM PageTags)"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const jobCols = "Id, UserId, PageId, Url, FromFriend, Archive, Kindle, Reprocess, State, Error, Attempts, " +
+	"TimeAdded, NextAttempt, LastActive, Saved, Tags"
+
+func scanJob(rows *sql.Rows) (j common.Job, err error) {
+	var tags string
+	err = rows.Scan(&j.Id, &j.UserId, &j.PageId, &j.URL, &j.FromFriend, &j.Archive, &j.Kindle, &j.Reprocess,
+		&j.State, &j.Error, &j.Attempts, &j.TimeAdded, &j.NextAttempt, &j.LastActive, &j.Saved, &tags)
+	j.Tags = common.ParseTags(tags)
+	return j, err
+}
+
+// AddJob inserts j into the queue, replacing any jobs for the same page that failed
+// and won't be retried. ErrJobPending is returned if the page has any other jobs.
+// j.Id is updated.
+func (d *Database) AddJob(j *common.Job) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var pending int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM Jobs WHERE PageId = ? AND NOT (State = ? AND NextAttempt = 0)",
+		j.PageId, common.JobFailed).Scan(&pending); err != nil {
+		return err
+	} else if pending > 0 {
+		return ErrJobPending
+	}
+	if _, err := tx.Exec("DELETE FROM Jobs WHERE PageId = ?", j.PageId); err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO Jobs (UserId, PageId, Url, FromFriend, Archive, Kindle, Reprocess, State, Error, "+
+		"Attempts, TimeAdded, NextAttempt, Tags) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		j.UserId, j.PageId, j.URL, j.FromFriend, j.Archive, j.Kindle, j.Reprocess, j.State, j.Error, j.Attempts,
+		j.TimeAdded, j.NextAttempt, strings.Join(j.Tags, ","))
+	if err != nil {
+		return err
+	}
+	if j.Id, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimJob returns the oldest job that's ready to run at time now after setting
+// its state to common.JobFetching, incrementing its attempt count, and setting
+// its last-active time to now.
+// A nil job is returned if no jobs are ready.
+func (d *Database) ClaimJob(now int64) (*common.Job, error) {
+	for {
+		rows, err := d.db.Query("SELECT "+jobCols+" FROM Jobs WHERE State IN (?, ?) "+
+			"AND NextAttempt > 0 AND NextAttempt <= ? ORDER BY NextAttempt ASC, Id ASC LIMIT 1",
+			common.JobQueued, common.JobFailed, now)
+		if err != nil {
+			return nil, err
+		}
+		if !rows.Next() {
+			rows.Close()
+			return nil, rows.Err()
+		}
+		j, err := scanJob(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// Only claim the job if another worker didn't get to it first.
+		res, err := d.db.Exec("UPDATE Jobs SET State = ?, Attempts = Attempts + 1, LastActive = ? "+
+			"WHERE Id = ? AND State = ?", common.JobFetching, now, j.Id, j.State)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 1 {
+			j.State = common.JobFetching
+			j.Attempts++
+			j.LastActive = now
+			return &j, nil
+		}
+	}
+}
+
+// SetJobState updates the state of the job with the supplied ID.
+func (d *Database) SetJobState(id int64, state common.JobState) error {
+	if _, err := d.db.Exec("UPDATE Jobs SET State = ? WHERE Id = ?", state, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// FailJob marks the job with the supplied ID as failed. If nextAttempt is
+// nonzero, the job will be retried at that time.
+func (d *Database) FailJob(id int64, msg string, nextAttempt int64) error {
+	if _, err := d.db.Exec("UPDATE Jobs SET State = ?, Error = ?, NextAttempt = ? WHERE Id = ?",
+		common.JobFailed, msg, nextAttempt, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteJob deletes the job with the supplied ID.
+func (d *Database) DeleteJob(id int64) error {
+	if _, err := d.db.Exec("DELETE FROM Jobs WHERE Id = ?", id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetJobSaved records that the job with the supplied ID has saved its page,
+// so later attempts only need to perform the remaining steps.
+func (d *Database) SetJobSaved(id int64) error {
+	if _, err := d.db.Exec("UPDATE Jobs SET Saved = 1 WHERE Id = ?", id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TouchJob sets the last-active time of the job with the supplied ID to now.
+// Running jobs should be touched periodically so they won't be reset by ResetJobs.
+func (d *Database) TouchJob(id, now int64) error {
+	if _, err := d.db.Exec("UPDATE Jobs SET LastActive = ? WHERE Id = ?", now, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResetJobs returns running jobs that were last active before staleBefore to
+// the queue with a next attempt time of now. These jobs were presumably
+// interrupted (e.g. by their server being restarted); jobs that are still being
+// run by another process are left alone.
+func (d *Database) ResetJobs(now, staleBefore int64) (int64, error) {
+	res, err := d.db.Exec("UPDATE Jobs SET State = ?, NextAttempt = ? WHERE State IN (?, ?, ?) AND LastActive < ?",
+		common.JobQueued, now, common.JobFetching, common.JobBuilding, common.JobSending, staleBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetAllJobs returns all of the user's jobs, with the newest ones first.
+func (d *Database) GetAllJobs(userId int64) (jobs []common.Job, err error) {
+	rows, err := d.db.Query("SELECT "+jobCols+" FROM Jobs WHERE UserId = ? ORDER BY TimeAdded DESC, Id DESC", userId)
+	if err != nil {
+		return jobs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// GetExhaustedJobs returns all users' failed jobs that won't be retried and were
+// last attempted before the supplied time, with the oldest first.
+func (d *Database) GetExhaustedJobs(before int64) (jobs []common.Job, err error) {
+	rows, err := d.db.Query("SELECT "+jobCols+" FROM Jobs WHERE State = ? AND NextAttempt = 0 AND LastActive < ? "+
+		"ORDER BY LastActive ASC, Id ASC", common.JobFailed, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// TagCount describes a tag and the number of pages that have it.
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+// addPageTags adds tags to the page with the supplied ID within tx.
+func addPageTags(tx *sql.Tx, id string, tags []string) error {
+	for _, t := range tags {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO Tags (Name) VALUES(?)", t); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO PageTags (PageId, TagId) "+
+			"SELECT ?, Id FROM Tags WHERE Name = ?", id, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddPageTags adds tags to the page with the supplied ID.
+// The page does not need to exist yet.
+func (d *Database) AddPageTags(id string, tags []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := addPageTags(tx, id, tags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetPageTags replaces the tags of the page with the supplied ID.
+func (d *Database) SetPageTags(id string, tags []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM PageTags WHERE PageId = ?", id); err != nil {
+		return err
+	}
+	if err := addPageTags(tx, id, tags); err != nil {
+		return err
+	}
+	// Drop tags that are no longer used.
+	if _, err := tx.Exec("DELETE FROM Tags WHERE Id NOT IN (SELECT TagId FROM PageTags)"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetTags returns all tags used by the user's archived or unarchived pages,
+// sorted by name.
+func (d *Database) GetTags(userId int64, archived bool) (tags []TagCount, err error) {
+	rows, err := d.db.Query(`SELECT t.Name, COUNT(*) FROM Tags t
+		JOIN PageTags pt ON pt.TagId = t.Id
+		JOIN Pages p ON p.Id = pt.PageId
+		WHERE p.UserId = ? AND p.Archived = ? AND p.TimeDeleted = 0 GROUP BY t.Id ORDER BY t.Name ASC`, userId, archived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Name, &tc.Count); err != nil {
+			return tags, err
+		}
+		tags = append(tags, tc)
+	}
+	return tags, rows.Err()
+}
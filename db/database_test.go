@@ -0,0 +1,616 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derat/aread/common"
+)
+
+// newTestDatabase returns a new Database in a temporary directory.
+// The returned function should be called to clean up.
+func newTestDatabase(t *testing.T) (*Database, func()) {
+	td, err := ioutil.TempDir("", "database_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(filepath.Join(td, "test.db"))
+	if err != nil {
+		os.RemoveAll(td)
+		t.Fatal(err)
+	}
+	return d, func() { os.RemoveAll(td) }
+}
+
+func TestDatabase_Jobs(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	const now = 1000
+	j1 := common.Job{UserId: common.ConfigUserId, PageId: "1", URL: "https://example.org/1", State: common.JobQueued, TimeAdded: now, NextAttempt: now}
+	j2 := common.Job{UserId: common.ConfigUserId, PageId: "2", URL: "https://example.org/2", State: common.JobQueued, TimeAdded: now, NextAttempt: now + 10}
+	for _, j := range []*common.Job{&j1, &j2} {
+		if err := d.AddJob(j); err != nil {
+			t.Fatal("AddJob failed: ", err)
+		}
+	}
+
+	// Only the first job should be ready.
+	if j, err := d.ClaimJob(now); err != nil {
+		t.Fatal("ClaimJob failed: ", err)
+	} else if j == nil || j.Id != j1.Id || j.State != common.JobFetching || j.Attempts != 1 {
+		t.Fatalf("ClaimJob(%v) returned %+v; want job %v", now, j, j1.Id)
+	}
+	if j, err := d.ClaimJob(now); err != nil {
+		t.Fatal("ClaimJob failed: ", err)
+	} else if j != nil {
+		t.Fatalf("ClaimJob(%v) unexpectedly returned %+v", now, j)
+	}
+
+	// After the first job fails, it should be retried at the requested time.
+	if err := d.FailJob(j1.Id, "oops", now+20); err != nil {
+		t.Fatal("FailJob failed: ", err)
+	}
+	if j, err := d.ClaimJob(now + 15); err != nil {
+		t.Fatal("ClaimJob failed: ", err)
+	} else if j == nil || j.Id != j2.Id {
+		t.Fatalf("ClaimJob(%v) returned %+v; want job %v", now+15, j, j2.Id)
+	}
+	if j, err := d.ClaimJob(now + 20); err != nil {
+		t.Fatal("ClaimJob failed: ", err)
+	} else if j == nil || j.Id != j1.Id || j.Attempts != 2 || j.Error != "oops" {
+		t.Fatalf("ClaimJob(%v) returned %+v; want job %v", now+20, j, j1.Id)
+	}
+
+	// Only jobs that haven't been active recently should be requeued.
+	// The first job was claimed at now+20 and the second at now+15.
+	getStates := func() map[int64]common.Job {
+		jobs, err := d.GetAllJobs(common.ConfigUserId)
+		if err != nil {
+			t.Fatal("GetAllJobs failed: ", err)
+		}
+		m := make(map[int64]common.Job, len(jobs))
+		for _, j := range jobs {
+			m[j.Id] = j
+		}
+		return m
+	}
+	if n, err := d.ResetJobs(now+30, now+18); err != nil {
+		t.Fatal("ResetJobs failed: ", err)
+	} else if n != 1 {
+		t.Errorf("ResetJobs(%v, %v) reset %v job(s); want 1", now+30, now+18, n)
+	}
+	if jobs := getStates(); jobs[j1.Id].State != common.JobFetching ||
+		jobs[j2.Id].State != common.JobQueued || jobs[j2.Id].NextAttempt != now+30 {
+		t.Errorf("Got jobs %+v after reset", jobs)
+	}
+
+	// Touching a job should keep it from being reset.
+	if err := d.TouchJob(j1.Id, now+40); err != nil {
+		t.Fatal("TouchJob failed: ", err)
+	}
+	if n, err := d.ResetJobs(now+50, now+40); err != nil {
+		t.Fatal("ResetJobs failed: ", err)
+	} else if n != 0 {
+		t.Errorf("ResetJobs(%v, %v) reset %v job(s); want 0", now+50, now+40, n)
+	}
+	if n, err := d.ResetJobs(now+50, now+41); err != nil {
+		t.Fatal("ResetJobs failed: ", err)
+	} else if n != 1 {
+		t.Errorf("ResetJobs(%v, %v) reset %v job(s); want 1", now+50, now+41, n)
+	}
+	if j := getStates()[j1.Id]; j.State != common.JobQueued || j.NextAttempt != now+50 {
+		t.Errorf("Job %v has state %q and next attempt %v after reset", j.Id, j.State, j.NextAttempt)
+	}
+
+	if err := d.SetJobSaved(j2.Id); err != nil {
+		t.Fatal("SetJobSaved failed: ", err)
+	}
+	if jobs := getStates(); jobs[j1.Id].Saved || !jobs[j2.Id].Saved {
+		t.Errorf("Got jobs %+v after saving job %v", jobs, j2.Id)
+	}
+
+	if err := d.DeleteJob(j1.Id); err != nil {
+		t.Fatal("DeleteJob failed: ", err)
+	}
+	if jobs, err := d.GetAllJobs(common.ConfigUserId); err != nil {
+		t.Fatal("GetAllJobs failed: ", err)
+	} else if len(jobs) != 1 || jobs[0].Id != j2.Id {
+		t.Errorf("GetAllJobs returned %+v after deleting job %v", jobs, j1.Id)
+	}
+
+	// Pending jobs shouldn't be replaced, but jobs that won't be retried should be.
+	j3 := common.Job{UserId: common.ConfigUserId, PageId: j2.PageId, URL: j2.URL, Reprocess: true,
+		State: common.JobQueued, TimeAdded: now, NextAttempt: now}
+	if err := d.AddJob(&j3); err != ErrJobPending {
+		t.Errorf("AddJob with pending job returned %v; want %v", err, ErrJobPending)
+	}
+	if err := d.FailJob(j2.Id, "oops", now+100); err != nil {
+		t.Fatal("FailJob failed: ", err)
+	}
+	if err := d.AddJob(&j3); err != ErrJobPending {
+		t.Errorf("AddJob with retrying job returned %v; want %v", err, ErrJobPending)
+	}
+	if err := d.FailJob(j2.Id, "oops", 0); err != nil {
+		t.Fatal("FailJob failed: ", err)
+	}
+	if err := d.AddJob(&j3); err != nil {
+		t.Error("AddJob with failed job failed: ", err)
+	} else if jobs, err := d.GetAllJobs(common.ConfigUserId); err != nil {
+		t.Fatal("GetAllJobs failed: ", err)
+	} else if len(jobs) != 1 || jobs[0].Id != j3.Id {
+		t.Errorf("GetAllJobs returned %+v after replacing job %v", jobs, j2.Id)
+	}
+}
+
+func TestMakeFTSQuery(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"", ""},
+		{"foo", `"foo"`},
+		{" foo  bar ", `"foo" "bar"`},
+		{`say "hi"`, `"say" """hi"""`},
+		{"pre* *", `"pre"*`},
+		{"foo-bar OR", `"foo-bar" "OR"`},
+	} {
+		if got := makeFTSQuery(tc.in); got != tc.want {
+			t.Errorf("makeFTSQuery(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDatabase_SearchPages(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+	if !d.SearchAvailable() {
+		t.Skip("Search unavailable; build with -tags sqlite_fts5")
+	}
+
+	for _, pi := range []common.PageInfo{
+		{Id: "1", OriginalURL: "https://cats.example.com/", Title: "All about cats", Text: "Cats sleep a lot."},
+		{Id: "2", OriginalURL: "https://dogs.example.com/", Title: "Dogs", Author: "Jane Doe",
+			Text: "Dogs are friendly, unlike cats."},
+		{Id: "3", OriginalURL: "https://birds.example.com/", Title: "Birds", Text: "Birds sing."},
+	} {
+		pi.UserId = common.ConfigUserId
+		if err := d.AddPage(pi); err != nil {
+			t.Fatal("AddPage failed: ", err)
+		}
+	}
+	if err := d.TogglePageArchived("2"); err != nil {
+		t.Fatal("TogglePageArchived failed: ", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		ids   []string
+	}{
+		{"cats", []string{"1", "2"}}, // title matches rank first
+		{"dogs friendly", []string{"2"}},
+		{"jane", []string{"2"}},
+		{"birds.example.com", []string{"3"}},
+		{"sle*", []string{"1"}},
+		{"fish", nil},
+		{`"unbalanced`, nil},
+	} {
+		res, err := d.SearchPages(common.ConfigUserId, tc.query, 10)
+		if err != nil {
+			t.Errorf("SearchPages(%q) failed: %v", tc.query, err)
+			continue
+		}
+		var ids []string
+		for _, r := range res {
+			ids = append(ids, r.Page.Id)
+		}
+		if !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("SearchPages(%q) returned %v; want %v", tc.query, ids, tc.ids)
+		}
+	}
+
+	res, err := d.SearchPages(common.ConfigUserId, "friendly", 10)
+	if err != nil {
+		t.Fatal("SearchPages failed: ", err)
+	}
+	if len(res) != 1 || !res[0].Page.Archived ||
+		!strings.Contains(res[0].Snippet, SnippetStart+"friendly"+SnippetEnd) {
+		t.Errorf("SearchPages(%q) returned %+v", "friendly", res)
+	}
+}
+
+func TestDatabase_ResetSearch(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+	if !d.SearchAvailable() {
+		if err := d.ResetSearch(); err != ErrSearchUnavailable {
+			t.Errorf("ResetSearch returned %v; want %v", err, ErrSearchUnavailable)
+		}
+		return
+	}
+
+	pi := common.PageInfo{Id: "1", UserId: common.ConfigUserId,
+		OriginalURL: "https://cats.example.com/", Title: "Cats", Text: "Cats sleep a lot."}
+	if err := d.AddPage(pi); err != nil {
+		t.Fatal("AddPage failed: ", err)
+	}
+	search := func() int {
+		res, err := d.SearchPages(common.ConfigUserId, "sleep", 10)
+		if err != nil {
+			t.Fatal("SearchPages failed: ", err)
+		}
+		return len(res)
+	}
+	if err := d.ResetSearch(); err != nil {
+		t.Fatal("ResetSearch failed: ", err)
+	}
+	if n := search(); n != 0 {
+		t.Errorf("SearchPages returned %v result(s) after ResetSearch; want 0", n)
+	}
+	if err := d.IndexPage(pi); err != nil {
+		t.Fatal("IndexPage failed: ", err)
+	}
+	if n := search(); n != 1 {
+		t.Errorf("SearchPages returned %v result(s) after IndexPage; want 1", n)
+	}
+}
+
+func TestDatabase_Tags(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	for _, pi := range []common.PageInfo{
+		{Id: "1", OriginalURL: "https://example.org/1", TimeAdded: 1},
+		{Id: "2", OriginalURL: "https://example.org/2", TimeAdded: 2},
+		{Id: "3", OriginalURL: "https://example.org/3", TimeAdded: 3},
+	} {
+		pi.UserId = common.ConfigUserId
+		if err := d.AddPage(pi); err != nil {
+			t.Fatal("AddPage failed: ", err)
+		}
+	}
+	if err := d.AddPageTags("1", []string{"go", "news"}); err != nil {
+		t.Fatal("AddPageTags failed: ", err)
+	}
+	if err := d.AddPageTags("1", []string{"go"}); err != nil {
+		t.Fatal("AddPageTags failed: ", err)
+	}
+	if err := d.AddPageTags("2", []string{"go", "old"}); err != nil {
+		t.Fatal("AddPageTags failed: ", err)
+	}
+	if err := d.SetPageTags("2", []string{"go"}); err != nil {
+		t.Fatal("SetPageTags failed: ", err)
+	}
+	if err := d.AddPageTags("3", []string{"news"}); err != nil {
+		t.Fatal("AddPageTags failed: ", err)
+	}
+	if err := d.SetPageArchived("3", true); err != nil {
+		t.Fatal("SetPageArchived failed: ", err)
+	}
+
+	if pi, err := d.GetPage("1"); err != nil {
+		t.Fatal("GetPage failed: ", err)
+	} else if want := []string{"go", "news"}; !reflect.DeepEqual(pi.Tags, want) {
+		t.Errorf("GetPage(%q) returned tags %v; want %v", "1", pi.Tags, want)
+	}
+
+	for _, tc := range []struct {
+		archived bool
+		tag      string
+		ids      []string
+	}{
+		{false, "", []string{"1", "2"}},
+		{false, "go", []string{"1", "2"}},
+		{false, "news", []string{"1"}},
+		{false, "old", nil},
+		{true, "news", []string{"3"}},
+	} {
+		pages, err := d.GetAllPages(common.ConfigUserId, tc.archived, tc.tag, 10)
+		if err != nil {
+			t.Errorf("GetAllPages(%v, %q) failed: %v", tc.archived, tc.tag, err)
+			continue
+		}
+		var ids []string
+		for _, pi := range pages {
+			ids = append(ids, pi.Id)
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("GetAllPages(%v, %q) returned %v; want %v", tc.archived, tc.tag, ids, tc.ids)
+		}
+	}
+
+	for _, tc := range []struct {
+		archived bool
+		tags     []TagCount
+	}{
+		{false, []TagCount{{"go", 2}, {"news", 1}}},
+		{true, []TagCount{{"news", 1}}},
+	} {
+		if tags, err := d.GetTags(common.ConfigUserId, tc.archived); err != nil {
+			t.Errorf("GetTags(%v) failed: %v", tc.archived, err)
+		} else if !reflect.DeepEqual(tags, tc.tags) {
+			t.Errorf("GetTags(%v) returned %v; want %v", tc.archived, tags, tc.tags)
+		}
+	}
+}
+
+func TestDatabase_Sessions(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	const (
+		idle = time.Hour
+		max  = 24 * time.Hour
+	)
+	for _, id := range []string{"s1", "s2"} {
+		if err := d.AddSession(id, "127.0.0.1", "agent-"+id, common.ConfigUserId); err != nil {
+			t.Fatal("AddSession failed: ", err)
+		}
+	}
+	start := time.Now()
+
+	// Using a session should update its last-seen time.
+	now := start.Add(idle / 2)
+	if s, u, err := d.UseSession("s1", now, idle, max); err != nil {
+		t.Fatal("UseSession failed: ", err)
+	} else if s == nil || u == nil || s.UserAgent != "agent-s1" || s.LastSeen != now.Unix() || u.Id != common.ConfigUserId {
+		t.Fatalf("UseSession(%q) returned %+v, %+v", "s1", s, u)
+	}
+
+	// s2 has been idle for too long, but s1 is still valid.
+	now = start.Add(idle + time.Minute)
+	if s, _, err := d.UseSession("s2", now, idle, max); err != nil {
+		t.Error("UseSession failed: ", err)
+	} else if s != nil {
+		t.Errorf("UseSession(%q) returned idle session %+v", "s2", s)
+	}
+	if s, _, err := d.UseSession("s1", now, idle, max); err != nil {
+		t.Error("UseSession failed: ", err)
+	} else if s == nil {
+		t.Errorf("UseSession(%q) didn't return session", "s1")
+	}
+	if n, err := d.PruneSessions(now, idle, max); err != nil {
+		t.Error("PruneSessions failed: ", err)
+	} else if n != 1 {
+		t.Errorf("PruneSessions pruned %v session(s); want 1", n)
+	}
+	sessions, err := d.GetSessions(common.ConfigUserId)
+	if err != nil {
+		t.Fatal("GetSessions failed: ", err)
+	} else if len(sessions) != 1 || sessions[0].UserAgent != "agent-s1" {
+		t.Fatalf("GetSessions returned %+v", sessions)
+	}
+
+	// s1 should expire once it's too old, even if it was used recently.
+	if s, _, err := d.UseSession("s1", start.Add(max+time.Minute), 0, max); err != nil {
+		t.Error("UseSession failed: ", err)
+	} else if s != nil {
+		t.Errorf("UseSession(%q) returned old session %+v", "s1", s)
+	}
+
+	if err := d.RevokeSession(common.ConfigUserId+1, sessions[0].Id); err != nil {
+		t.Error("RevokeSession failed: ", err)
+	} else if sessions, err := d.GetSessions(common.ConfigUserId); err != nil {
+		t.Error("GetSessions failed: ", err)
+	} else if len(sessions) != 1 {
+		t.Errorf("GetSessions returned %+v after revoking other user's session", sessions)
+	}
+	if err := d.RevokeSession(common.ConfigUserId, sessions[0].Id); err != nil {
+		t.Error("RevokeSession failed: ", err)
+	}
+	if sessions, err := d.GetSessions(common.ConfigUserId); err != nil {
+		t.Error("GetSessions failed: ", err)
+	} else if len(sessions) != 0 {
+		t.Errorf("GetSessions returned %+v after revoking", sessions)
+	}
+}
+
+func TestDatabase_Trash(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	for _, pi := range []common.PageInfo{
+		{Id: "1", OriginalURL: "https://example.org/1", TimeAdded: 1},
+		{Id: "2", OriginalURL: "https://example.org/2", TimeAdded: 2},
+	} {
+		pi.UserId = common.ConfigUserId
+		if err := d.AddPage(pi); err != nil {
+			t.Fatal("AddPage failed: ", err)
+		}
+	}
+	if err := d.AddPageTags("1", []string{"go"}); err != nil {
+		t.Fatal("AddPageTags failed: ", err)
+	}
+	if err := d.SetPageTrashed("1", true); err != nil {
+		t.Fatal("SetPageTrashed failed: ", err)
+	}
+	if err := d.SetPageTrashed("bogus", true); err != ErrPageNotFound {
+		t.Errorf("SetPageTrashed(%q) returned %v; want %v", "bogus", err, ErrPageNotFound)
+	}
+
+	getIds := func(pages []common.PageInfo) []string {
+		var ids []string
+		for _, pi := range pages {
+			ids = append(ids, pi.Id)
+		}
+		return ids
+	}
+	for _, tc := range []struct {
+		trashed bool
+		ids     []string
+	}{
+		{false, []string{"2"}},
+		{true, []string{"1"}},
+	} {
+		pages, err := d.QueryPages(PageQuery{UserId: common.ConfigUserId, Trashed: tc.trashed, Max: 10})
+		if err != nil {
+			t.Errorf("QueryPages(trashed=%v) failed: %v", tc.trashed, err)
+		} else if ids := getIds(pages); !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("QueryPages(trashed=%v) returned %v; want %v", tc.trashed, ids, tc.ids)
+		}
+	}
+	if tags, err := d.GetTags(common.ConfigUserId, false); err != nil {
+		t.Error("GetTags failed: ", err)
+	} else if len(tags) != 0 {
+		t.Errorf("GetTags returned %v for trashed page", tags)
+	}
+	if pi, err := d.GetPage("1"); err != nil {
+		t.Error("GetPage failed: ", err)
+	} else if pi.TimeDeleted == 0 {
+		t.Error("GetPage returned zero TimeDeleted for trashed page")
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	if pages, err := d.GetTrashedPages(future); err != nil {
+		t.Error("GetTrashedPages failed: ", err)
+	} else if ids := getIds(pages); !reflect.DeepEqual(ids, []string{"1"}) {
+		t.Errorf("GetTrashedPages(%v) returned %v; want %v", future, ids, []string{"1"})
+	}
+	if pages, err := d.GetTrashedPages(1); err != nil {
+		t.Error("GetTrashedPages failed: ", err)
+	} else if len(pages) != 0 {
+		t.Errorf("GetTrashedPages(1) returned %v", getIds(pages))
+	}
+
+	if err := d.SetPageTrashed("1", false); err != nil {
+		t.Fatal("SetPageTrashed failed: ", err)
+	}
+	if ids, err := d.GetPageIds(common.ConfigUserId); err != nil {
+		t.Error("GetPageIds failed: ", err)
+	} else if want := map[string]bool{"1": true, "2": true}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("GetPageIds returned %v; want %v", ids, want)
+	}
+	if pages, err := d.GetTrashedPages(future); err != nil {
+		t.Error("GetTrashedPages failed: ", err)
+	} else if len(pages) != 0 {
+		t.Errorf("GetTrashedPages returned restored page(s) %v", getIds(pages))
+	}
+}
+
+func TestDatabase_PageMetadata(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	pages := []common.PageInfo{
+		{Id: "1", Author: "Ann", TimeAdded: 1, TimePublished: 30, WordCount: 500, ReadingTime: 3,
+			Excerpt: "First", Language: "en", LeadImage: "a.jpg", FromFriend: true},
+		{Id: "2", Author: "Bob", TimeAdded: 2, TimePublished: 10, WordCount: 100, ReadingTime: 1},
+		{Id: "3", Author: "Ann", TimeAdded: 3, TimePublished: 20, WordCount: 2000, ReadingTime: 9},
+		{Id: "4", Author: "Bob", TimeAdded: 4}, // saved before metadata was recorded
+	}
+	for _, pi := range pages {
+		pi.UserId = common.ConfigUserId
+		pi.OriginalURL = "https://example.org/" + pi.Id
+		if err := d.AddPage(pi); err != nil {
+			t.Fatal("AddPage failed: ", err)
+		}
+	}
+
+	want := pages[0]
+	want.UserId = common.ConfigUserId
+	want.OriginalURL = "https://example.org/1"
+	if got, err := d.GetPage("1"); err != nil {
+		t.Error("GetPage failed: ", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetPage returned %+v; want %+v", got, want)
+	}
+
+	for _, tc := range []struct {
+		author string
+		order  PageOrder
+		ids    []string
+	}{
+		{"", OrderAdded, []string{"4", "3", "2", "1"}},
+		{"", OrderPublished, []string{"1", "3", "2", "4"}},
+		{"", OrderShortest, []string{"2", "1", "3", "4"}},
+		{"", OrderLongest, []string{"3", "1", "2", "4"}},
+		{"Ann", OrderShortest, []string{"1", "3"}},
+		{"Carl", OrderAdded, nil},
+	} {
+		pages, err := d.QueryPages(PageQuery{UserId: common.ConfigUserId, Author: tc.author, Order: tc.order, Max: 10})
+		if err != nil {
+			t.Errorf("QueryPages(%q, %q) failed: %v", tc.author, tc.order, err)
+			continue
+		}
+		var ids []string
+		for _, pi := range pages {
+			ids = append(ids, pi.Id)
+		}
+		if !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("QueryPages(%q, %q) returned %v; want %v", tc.author, tc.order, ids, tc.ids)
+		}
+	}
+	if _, err := d.QueryPages(PageQuery{UserId: common.ConfigUserId, Order: OrderShortest,
+		BeforeId: "1", Max: 10}); err == nil {
+		t.Error("QueryPages unexpectedly accepted position with non-default order")
+	}
+}
+
+func TestDatabase_UpdatePage(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	orig := common.PageInfo{Id: "1", UserId: common.ConfigUserId, OriginalURL: "https://example.org/1",
+		Title: "Old", WordCount: 10, TimeAdded: 100}
+	if err := d.AddPage(orig); err != nil {
+		t.Fatal("AddPage failed: ", err)
+	}
+	if err := d.AddPage(common.PageInfo{Id: "2", UserId: common.ConfigUserId, TimeAdded: 200}); err != nil {
+		t.Fatal("AddPage failed: ", err)
+	}
+	if err := d.AddPageTags("1", []string{"foo"}); err != nil {
+		t.Fatal("AddPageTags failed: ", err)
+	}
+	if err := d.SetPageArchived("1", true); err != nil {
+		t.Fatal("SetPageArchived failed: ", err)
+	}
+
+	upd := common.PageInfo{Id: "1", OriginalURL: "https://example.org/new", Title: "New", WordCount: 20}
+	if err := d.UpdatePage(upd); err != nil {
+		t.Fatal("UpdatePage failed: ", err)
+	}
+	want := orig
+	want.OriginalURL = upd.OriginalURL
+	want.Title = upd.Title
+	want.WordCount = upd.WordCount
+	want.Archived = true
+	want.Tags = []string{"foo"}
+	if got, err := d.GetPage("1"); err != nil {
+		t.Error("GetPage failed: ", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetPage returned %+v; want %+v", got, want)
+	}
+	if err := d.UpdatePage(common.PageInfo{Id: "bogus"}); err != ErrPageNotFound {
+		t.Errorf("UpdatePage(%q) returned %v; want %v", "bogus", err, ErrPageNotFound)
+	}
+
+	for _, tc := range []struct {
+		start, end int64
+		ids        []string
+	}{
+		{0, 0, []string{"1", "2"}},
+		{100, 200, []string{"1"}},
+		{101, 0, []string{"2"}},
+		{300, 0, nil},
+	} {
+		pages, err := d.GetPagesAddedBetween(tc.start, tc.end)
+		if err != nil {
+			t.Errorf("GetPagesAddedBetween(%v, %v) failed: %v", tc.start, tc.end, err)
+			continue
+		}
+		var ids []string
+		for _, pi := range pages {
+			ids = append(ids, pi.Id)
+		}
+		if !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("GetPagesAddedBetween(%v, %v) returned %v; want %v", tc.start, tc.end, ids, tc.ids)
+		}
+	}
+}
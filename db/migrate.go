@@ -0,0 +1,266 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration describes a change to the database schema.
+type Migration struct {
+	Version int    // 1-based position in migrations
+	Desc    string // human-readable description
+}
+
+// migration is an entry in migrations.
+type migration struct {
+	desc string
+	run  func(tx *sql.Tx) error
+}
+
+// migrations contains all schema changes in the order in which they should be
+// applied. The version of each migration is its 1-based index in the slice.
+// Never remove or reorder entries; append new migrations to the end instead.
+var migrations = []migration{
+	{
+		// Databases created before versioning was added will already have some
+		// or all of these tables, so they're created conditionally.
+		desc: "Create initial tables",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS Pages (
+					Id STRING PRIMARY KEY NOT NULL,
+					OriginalUrl STRING NOT NULL,
+					Title STRING NOT NULL,
+					TimeAdded INTEGER NOT NULL,
+					Token STRING NOT NULL,
+					Archived BOOLEAN NOT NULL DEFAULT 0)`,
+				`CREATE TABLE IF NOT EXISTS Sessions (
+					Id STRING NOT NULL,
+					TimeAdded INTEGER,
+					IpAddress STRING)`,
+				`CREATE TABLE IF NOT EXISTS Jobs (
+					Id INTEGER PRIMARY KEY AUTOINCREMENT,
+					PageId STRING NOT NULL,
+					Url STRING NOT NULL,
+					FromFriend BOOLEAN NOT NULL DEFAULT 0,
+					Archive BOOLEAN NOT NULL DEFAULT 0,
+					Kindle BOOLEAN NOT NULL DEFAULT 0,
+					State STRING NOT NULL,
+					Error STRING NOT NULL DEFAULT '',
+					Attempts INTEGER NOT NULL DEFAULT 0,
+					TimeAdded INTEGER NOT NULL,
+					NextAttempt INTEGER NOT NULL DEFAULT 0)`,
+				`CREATE TABLE IF NOT EXISTS Tags (
+					Id INTEGER PRIMARY KEY AUTOINCREMENT,
+					Name STRING UNIQUE NOT NULL)`,
+				`CREATE TABLE IF NOT EXISTS PageTags (
+					PageId STRING NOT NULL,
+					TagId INTEGER NOT NULL,
+					PRIMARY KEY (PageId, TagId))`,
+			)
+		},
+	},
+	{
+		desc: "Add Tokens table",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE Tokens (
+					Id INTEGER PRIMARY KEY AUTOINCREMENT,
+					Name STRING NOT NULL,
+					Hash STRING UNIQUE NOT NULL,
+					Scopes STRING NOT NULL,
+					TimeCreated INTEGER NOT NULL,
+					LastUsed INTEGER NOT NULL DEFAULT 0,
+					Revoked BOOLEAN NOT NULL DEFAULT 0)`,
+			)
+		},
+	},
+	{
+		// Existing data belongs to the user described by the config file, whose
+		// row is created here so that it receives common.ConfigUserId.
+		desc: "Add Users table and owners",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE Users (
+					Id INTEGER PRIMARY KEY AUTOINCREMENT,
+					Username STRING UNIQUE NOT NULL,
+					PasswordHash STRING NOT NULL DEFAULT '',
+					Recipient STRING NOT NULL DEFAULT '',
+					ConfigFile STRING NOT NULL DEFAULT '',
+					Disabled BOOLEAN NOT NULL DEFAULT 0,
+					TimeCreated INTEGER NOT NULL DEFAULT 0)`,
+				`INSERT INTO Users (Id, Username) VALUES(1, '')`,
+				`ALTER TABLE Pages ADD COLUMN UserId INTEGER NOT NULL DEFAULT 1`,
+				`ALTER TABLE Sessions ADD COLUMN UserId INTEGER NOT NULL DEFAULT 1`,
+				`ALTER TABLE Jobs ADD COLUMN UserId INTEGER NOT NULL DEFAULT 1`,
+				`ALTER TABLE Tokens ADD COLUMN UserId INTEGER NOT NULL DEFAULT 1`,
+				`CREATE INDEX PagesUserIdTimeAdded ON Pages (UserId, TimeAdded)`,
+			)
+		},
+	},
+	{
+		desc: "Add session activity columns",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE Sessions ADD COLUMN UserAgent STRING NOT NULL DEFAULT ''`,
+				`ALTER TABLE Sessions ADD COLUMN LastSeen INTEGER NOT NULL DEFAULT 0`,
+				`UPDATE Sessions SET TimeAdded = 0 WHERE TimeAdded IS NULL`,
+				`UPDATE Sessions SET LastSeen = TimeAdded`,
+				`CREATE INDEX SessionsId ON Sessions (Id)`,
+			)
+		},
+	},
+	{
+		desc: "Add Pages.TimeDeleted",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx, `ALTER TABLE Pages ADD COLUMN TimeDeleted INTEGER NOT NULL DEFAULT 0`)
+		},
+	},
+	{
+		desc: "Add page metadata columns",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE Pages ADD COLUMN Author STRING NOT NULL DEFAULT ''`,
+				`ALTER TABLE Pages ADD COLUMN TimePublished INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE Pages ADD COLUMN WordCount INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE Pages ADD COLUMN ReadingTime INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE Pages ADD COLUMN Excerpt STRING NOT NULL DEFAULT ''`,
+				`ALTER TABLE Pages ADD COLUMN Language STRING NOT NULL DEFAULT ''`,
+				`ALTER TABLE Pages ADD COLUMN LeadImage STRING NOT NULL DEFAULT ''`,
+			)
+		},
+	},
+	{
+		desc: "Add Jobs.Reprocess",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx, `ALTER TABLE Jobs ADD COLUMN Reprocess INTEGER NOT NULL DEFAULT 0`)
+		},
+	},
+	{
+		// Older binaries created this table at startup, so it may already exist.
+		// FTS5 is only available when built with -tags sqlite_fts5; without it,
+		// the table is skipped and can be created later by the reindex command.
+		desc: "Add PageText table",
+		run: func(tx *sql.Tx) error {
+			if err := createPageText(tx); err != nil && !isMissingFTS5(err) {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		// Friends' pages were previously only identifiable by their title prefixes.
+		// Recover what we can from jobs that haven't been deleted yet.
+		desc: "Add Pages.FromFriend",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE Pages ADD COLUMN FromFriend BOOLEAN NOT NULL DEFAULT 0`,
+				`UPDATE Pages SET FromFriend = 1 WHERE Id IN (SELECT PageId FROM Jobs WHERE FromFriend = 1)`,
+			)
+		},
+	},
+	{
+		desc: "Add Jobs.LastActive",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx, `ALTER TABLE Jobs ADD COLUMN LastActive INTEGER NOT NULL DEFAULT 0`)
+		},
+	},
+	{
+		desc: "Add Jobs.Saved",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx, `ALTER TABLE Jobs ADD COLUMN Saved BOOLEAN NOT NULL DEFAULT 0`)
+		},
+	},
+	{
+		desc: "Add Jobs.Tags",
+		run: func(tx *sql.Tx) error {
+			return execAll(tx, `ALTER TABLE Jobs ADD COLUMN Tags TEXT NOT NULL DEFAULT ''`)
+		},
+	},
+}
+
+// execAll executes each of the supplied statements within tx.
+func execAll(tx *sql.Tx, stmts ...string) error {
+	for _, s := range stmts {
+		if _, err := tx.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the most-recently-applied migration,
+// or 0 if no migrations have been applied.
+func (d *Database) SchemaVersion() (int, error) {
+	var n int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'table' AND name = 'schema_version'`).Scan(&n); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, nil
+	}
+	var ver sql.NullInt64
+	if err := d.db.QueryRow(`SELECT MAX(Version) FROM schema_version`).Scan(&ver); err != nil {
+		return 0, err
+	}
+	return int(ver.Int64), nil
+}
+
+// PendingMigrations returns migrations that have not yet been applied.
+func (d *Database) PendingMigrations() ([]Migration, error) {
+	ver, err := d.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if ver > len(migrations) {
+		return nil, fmt.Errorf("database version %v is newer than latest known version %v", ver, len(migrations))
+	}
+	var pending []Migration
+	for i := ver; i < len(migrations); i++ {
+		pending = append(pending, Migration{i + 1, migrations[i].desc})
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations. Each migration runs in its own
+// transaction, so a failure leaves the database at the previous version.
+func (d *Database) Migrate() error {
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+			Version INTEGER PRIMARY KEY NOT NULL,
+			TimeApplied INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	pending, err := d.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err := d.applyMigration(m.Version); err != nil {
+			return fmt.Errorf("migration %v (%v) failed: %v", m.Version, m.Desc, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs the migration with the supplied version and records it
+// in schema_version.
+func (d *Database) applyMigration(ver int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := migrations[ver-1].run(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (Version, TimeApplied) VALUES(?, ?)`,
+		ver, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
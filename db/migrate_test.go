@@ -0,0 +1,144 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDatabase_Migrate(t *testing.T) {
+	td, err := ioutil.TempDir("", "migrate_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	p := filepath.Join(td, "test.db")
+
+	// Create a database that predates versioning.
+	sdb, err := sql.Open("sqlite3", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`CREATE TABLE Pages (
+			Id STRING PRIMARY KEY NOT NULL,
+			OriginalUrl STRING NOT NULL,
+			Title STRING NOT NULL,
+			TimeAdded INTEGER NOT NULL,
+			Token STRING NOT NULL,
+			Archived BOOLEAN NOT NULL DEFAULT 0)`,
+		`INSERT INTO Pages (Id, OriginalUrl, Title, TimeAdded, Token) VALUES('1', 'https://example.org/', 'Title', 1, '')`,
+		`CREATE TABLE Jobs (
+			Id INTEGER PRIMARY KEY AUTOINCREMENT,
+			PageId STRING NOT NULL,
+			Url STRING NOT NULL,
+			FromFriend BOOLEAN NOT NULL DEFAULT 0,
+			Archive BOOLEAN NOT NULL DEFAULT 0,
+			Kindle BOOLEAN NOT NULL DEFAULT 0,
+			State STRING NOT NULL,
+			Error STRING NOT NULL DEFAULT '',
+			Attempts INTEGER NOT NULL DEFAULT 0,
+			TimeAdded INTEGER NOT NULL,
+			NextAttempt INTEGER NOT NULL DEFAULT 0)`,
+		`INSERT INTO Jobs (PageId, Url, FromFriend, Kindle, State, TimeAdded)
+			VALUES('1', 'https://example.org/', 1, 1, 'sending', 1)`,
+	} {
+		if _, err := sdb.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sdb.Close()
+
+	d, err := Open(p)
+	if err != nil {
+		t.Fatal("Open failed: ", err)
+	}
+	defer d.Close()
+	if ver, err := d.SchemaVersion(); err != nil {
+		t.Fatal("SchemaVersion failed: ", err)
+	} else if ver != 0 {
+		t.Errorf("SchemaVersion() = %v; want 0", ver)
+	}
+	if pending, err := d.PendingMigrations(); err != nil {
+		t.Fatal("PendingMigrations failed: ", err)
+	} else if len(pending) != len(migrations) {
+		t.Errorf("PendingMigrations() returned %v; want %v migration(s)", pending, len(migrations))
+	}
+
+	if err := d.Migrate(); err != nil {
+		t.Fatal("Migrate failed: ", err)
+	}
+	if ver, err := d.SchemaVersion(); err != nil {
+		t.Fatal("SchemaVersion failed: ", err)
+	} else if ver != len(migrations) {
+		t.Errorf("SchemaVersion() = %v; want %v", ver, len(migrations))
+	}
+	if pending, err := d.PendingMigrations(); err != nil {
+		t.Fatal("PendingMigrations failed: ", err)
+	} else if len(pending) != 0 {
+		t.Errorf("PendingMigrations() returned %v after migrating", pending)
+	}
+	if pi, err := d.GetPage("1"); err != nil {
+		t.Error("GetPage failed after migrating: ", err)
+	} else if pi.Title != "Title" || !pi.FromFriend {
+		t.Errorf("GetPage returned %+v; want title %q from friend", pi, "Title")
+	}
+
+	// Migrating again should be a no-op.
+	if err := d.Migrate(); err != nil {
+		t.Fatal("Second Migrate failed: ", err)
+	}
+}
+
+func TestDatabase_MigrateFailure(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	orig := migrations
+	defer func() { migrations = orig }()
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		migration{"Add table", func(tx *sql.Tx) error {
+			return execAll(tx, `CREATE TABLE Foo (Id INTEGER)`)
+		}},
+		migration{"Fail", func(tx *sql.Tx) error {
+			if err := execAll(tx, `CREATE TABLE Bar (Id INTEGER)`); err != nil {
+				return err
+			}
+			return errors.New("intentional failure")
+		}},
+	)
+
+	if err := d.Migrate(); err == nil {
+		t.Fatal("Migrate unexpectedly succeeded")
+	}
+	// The first new migration should've been applied, but the failing one
+	// should've been rolled back.
+	if ver, err := d.SchemaVersion(); err != nil {
+		t.Fatal("SchemaVersion failed: ", err)
+	} else if ver != len(orig)+1 {
+		t.Errorf("SchemaVersion() = %v; want %v", ver, len(orig)+1)
+	}
+	var tables []string
+	rows, err := d.db.Query(`SELECT name FROM sqlite_master WHERE name IN ('Foo', 'Bar') ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	if want := []string{"Foo"}; !reflect.DeepEqual(tables, want) {
+		t.Errorf("Got tables %v; want %v", tables, want)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/derat/aread/common"
+)
+
+// tokenBytes is the number of random bytes in a token's secret.
+const tokenBytes = 24
+
+// hashToken returns the hash of secret that is stored in the Tokens table.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// AddToken creates a new token for the user with the supplied name and scopes.
+// The token's secret value is returned; only its hash is stored.
+func (d *Database) AddToken(userId int64, name string, scopes []string) (secret string, err error) {
+	if secret, err = common.RandomString(tokenBytes); err != nil {
+		return "", err
+	}
+	if _, err := d.db.Exec("INSERT INTO Tokens (UserId, Name, Hash, Scopes, TimeCreated) VALUES(?, ?, ?, ?, ?)",
+		userId, name, hashToken(secret), strings.Join(scopes, ","), time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+const tokenCols = "Id, UserId, Name, Scopes, TimeCreated, LastUsed, Revoked"
+
+func scanToken(rows *sql.Rows) (t common.APIToken, err error) {
+	var scopes string
+	if err = rows.Scan(&t.Id, &t.UserId, &t.Name, &scopes, &t.TimeCreated, &t.LastUsed, &t.Revoked); err != nil {
+		return t, err
+	}
+	if scopes != "" {
+		t.Scopes = strings.Split(scopes, ",")
+	}
+	return t, nil
+}
+
+// UseToken returns the unrevoked token with the supplied secret value after
+// updating its last-used time. nil is returned if no such token exists or if
+// the token's user is disabled.
+func (d *Database) UseToken(secret string) (*common.APIToken, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	hash := hashToken(secret)
+	rows, err := d.db.Query("SELECT "+prefixCols(tokenCols, "t")+" FROM Tokens t "+
+		"JOIN Users u ON u.Id = t.UserId WHERE t.Hash = ? AND t.Revoked = 0 AND u.Disabled = 0", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	t, err := scanToken(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	t.LastUsed = time.Now().Unix()
+	if _, err := d.db.Exec("UPDATE Tokens SET LastUsed = ? WHERE Id = ?", t.LastUsed, t.Id); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetAllTokens returns all of the user's tokens, including revoked ones, with
+// the newest first.
+func (d *Database) GetAllTokens(userId int64) (tokens []common.APIToken, err error) {
+	rows, err := d.db.Query("SELECT "+tokenCols+" FROM Tokens WHERE UserId = ? ORDER BY Id DESC", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken revokes the user's token with the supplied ID.
+func (d *Database) RevokeToken(userId, id int64) error {
+	_, err := d.db.Exec("UPDATE Tokens SET Revoked = 1 WHERE Id = ? AND UserId = ?", id, userId)
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/derat/aread/common"
+)
+
+func TestDatabase_Tokens(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	s1, err := d.AddToken(common.ConfigUserId, "phone", []string{common.ScopeAdd})
+	if err != nil {
+		t.Fatal("AddToken failed: ", err)
+	}
+	s2, err := d.AddToken(common.ConfigUserId, "script", []string{common.ScopeRead, common.ScopeKindle})
+	if err != nil {
+		t.Fatal("AddToken failed: ", err)
+	}
+	if s1 == s2 || len(s1) < 32 {
+		t.Fatalf("AddToken returned bad secrets %q and %q", s1, s2)
+	}
+
+	if tok, err := d.UseToken(s2); err != nil {
+		t.Fatal("UseToken failed: ", err)
+	} else if tok == nil || tok.Name != "script" || tok.LastUsed == 0 ||
+		!reflect.DeepEqual(tok.Scopes, []string{common.ScopeRead, common.ScopeKindle}) {
+		t.Errorf("UseToken(%q) returned %+v", s2, tok)
+	}
+	for _, s := range []string{"", "bogus", hashToken(s1)} {
+		if tok, err := d.UseToken(s); err != nil {
+			t.Errorf("UseToken(%q) failed: %v", s, err)
+		} else if tok != nil {
+			t.Errorf("UseToken(%q) unexpectedly returned %+v", s, tok)
+		}
+	}
+
+	toks, err := d.GetAllTokens(common.ConfigUserId)
+	if err != nil {
+		t.Fatal("GetAllTokens failed: ", err)
+	}
+	if len(toks) != 2 || toks[0].Name != "script" || toks[1].Name != "phone" || toks[1].LastUsed != 0 {
+		t.Fatalf("GetAllTokens returned %+v", toks)
+	}
+
+	if err := d.RevokeToken(common.ConfigUserId, toks[1].Id); err != nil {
+		t.Fatal("RevokeToken failed: ", err)
+	}
+	if tok, err := d.UseToken(s1); err != nil {
+		t.Fatal("UseToken failed: ", err)
+	} else if tok != nil {
+		t.Errorf("UseToken returned revoked token %+v", tok)
+	}
+	if toks, err := d.GetAllTokens(common.ConfigUserId); err != nil {
+		t.Fatal("GetAllTokens failed: ", err)
+	} else if !toks[1].Revoked || toks[0].Revoked {
+		t.Errorf("GetAllTokens returned %+v after revoking %v", toks, toks[1].Id)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/derat/aread/common"
+)
+
+// ErrUserNotFound is returned if a requested user doesn't exist.
+var ErrUserNotFound = errors.New("user not found in database")
+
+const userCols = "Id, Username, Recipient, ConfigFile, Disabled, TimeCreated"
+
+// prefixCols prefixes each of the comma-separated column names in cols with
+// the supplied table alias, e.g. "Id, Name" becomes "t.Id, t.Name".
+func prefixCols(cols, alias string) string {
+	return alias + "." + strings.Replace(cols, ", ", ", "+alias+".", -1)
+}
+
+func scanUser(rows *sql.Rows) (u common.User, err error) {
+	err = rows.Scan(&u.Id, &u.Username, &u.Recipient, &u.ConfigFile, &u.Disabled, &u.TimeCreated)
+	return u, err
+}
+
+// SetConfigUsername sets the username of the user with common.ConfigUserId,
+// i.e. the user described by the config file.
+func (d *Database) SetConfigUsername(name string) error {
+	_, err := d.db.Exec("UPDATE Users SET Username = ? WHERE Id = ?", name, common.ConfigUserId)
+	return err
+}
+
+// AddUser inserts u with the supplied password hash. u.Id and u.TimeCreated are updated.
+func (d *Database) AddUser(u *common.User, passwordHash string) error {
+	u.TimeCreated = time.Now().Unix()
+	res, err := d.db.Exec("INSERT INTO Users (Username, PasswordHash, Recipient, ConfigFile, Disabled, TimeCreated) "+
+		"VALUES(?, ?, ?, ?, ?, ?)", u.Username, passwordHash, u.Recipient, u.ConfigFile, u.Disabled, u.TimeCreated)
+	if err != nil {
+		return err
+	}
+	u.Id, err = res.LastInsertId()
+	return err
+}
+
+// getUser returns the first user matching the supplied WHERE clause,
+// along with its password hash.
+func (d *Database) getUser(where string, args ...interface{}) (*common.User, string, error) {
+	rows, err := d.db.Query("SELECT "+userCols+", PasswordHash FROM Users WHERE "+where, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrUserNotFound
+	}
+	var u common.User
+	var hash string
+	if err := rows.Scan(&u.Id, &u.Username, &u.Recipient, &u.ConfigFile, &u.Disabled, &u.TimeCreated, &hash); err != nil {
+		return nil, "", err
+	}
+	return &u, hash, nil
+}
+
+// GetUser returns the user with the supplied ID.
+func (d *Database) GetUser(id int64) (*common.User, error) {
+	u, _, err := d.getUser("Id = ?", id)
+	return u, err
+}
+
+// GetUserByName returns the user with the supplied username and its password hash.
+func (d *Database) GetUserByName(name string) (u *common.User, passwordHash string, err error) {
+	return d.getUser("Username = ?", name)
+}
+
+// GetAllUsers returns all users, ordered by ID.
+func (d *Database) GetAllUsers() (users []common.User, err error) {
+	rows, err := d.db.Query("SELECT " + userCols + " FROM Users ORDER BY Id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// SetUserDisabled disables or enables the user with the supplied ID.
+// Disabling a user also deletes the user's sessions.
+func (d *Database) SetUserDisabled(id int64, disabled bool) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if res, err := tx.Exec("UPDATE Users SET Disabled = ? WHERE Id = ?", disabled, id); err != nil {
+		return err
+	} else if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	if disabled {
+		if _, err := tx.Exec("DELETE FROM Sessions WHERE UserId = ?", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
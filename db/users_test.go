@@ -0,0 +1,62 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/derat/aread/common"
+)
+
+func TestDatabase_Users(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	if err := d.SetConfigUsername("admin"); err != nil {
+		t.Fatal("SetConfigUsername failed: ", err)
+	}
+	u := common.User{Username: "bob", Recipient: "bob@example.org"}
+	if err := d.AddUser(&u, "hash"); err != nil {
+		t.Fatal("AddUser failed: ", err)
+	}
+	if err := d.AddUser(&common.User{Username: "bob"}, "hash2"); err == nil {
+		t.Error("AddUser unexpectedly succeeded for duplicate username")
+	}
+
+	if got, hash, err := d.GetUserByName("bob"); err != nil {
+		t.Error("GetUserByName failed: ", err)
+	} else if got.Id != u.Id || got.Recipient != u.Recipient || hash != "hash" {
+		t.Errorf("GetUserByName(%q) returned %+v, %q", "bob", got, hash)
+	}
+	if _, _, err := d.GetUserByName("alice"); err != ErrUserNotFound {
+		t.Errorf("GetUserByName(%q) returned %v; want %v", "alice", err, ErrUserNotFound)
+	}
+	if users, err := d.GetAllUsers(); err != nil {
+		t.Error("GetAllUsers failed: ", err)
+	} else if len(users) != 2 || users[0].Username != "admin" || users[1].Username != "bob" {
+		t.Errorf("GetAllUsers returned %+v", users)
+	}
+
+	// Sessions should be associated with users and removed when the user is disabled.
+	if err := d.AddSession("s1", "127.0.0.1", "test", u.Id); err != nil {
+		t.Fatal("AddSession failed: ", err)
+	}
+	if _, got, err := d.UseSession("s1", time.Now(), 0, 0); err != nil {
+		t.Error("UseSession failed: ", err)
+	} else if got == nil || got.Id != u.Id {
+		t.Errorf("UseSession(%q) returned %+v; want user %v", "s1", got, u.Id)
+	}
+	if err := d.SetUserDisabled(u.Id, true); err != nil {
+		t.Fatal("SetUserDisabled failed: ", err)
+	}
+	if _, got, err := d.UseSession("s1", time.Now(), 0, 0); err != nil {
+		t.Error("UseSession failed: ", err)
+	} else if got != nil {
+		t.Errorf("UseSession(%q) returned %+v for disabled user", "s1", got)
+	}
+	if err := d.SetUserDisabled(100, true); err != ErrUserNotFound {
+		t.Errorf("SetUserDisabled(100, true) returned %v; want %v", err, ErrUserNotFound)
+	}
+}
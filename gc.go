@@ -0,0 +1,167 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/derat/aread/common"
+	"github.com/derat/aread/db"
+	"github.com/derat/aread/proc"
+)
+
+const (
+	// defaultTrashDays is the default number of days after which trashed pages are purged.
+	defaultTrashDays = 30
+	// orphanGracePeriod is the minimum age of a page directory without a database
+	// row before it's deleted, so that directories being written by in-progress
+	// jobs aren't removed.
+	orphanGracePeriod = time.Hour
+)
+
+// gcStats summarizes the work performed by collectGarbage.
+type gcStats struct {
+	purgedPages int   // trashed pages that were permanently deleted
+	purgedJobs  int   // failed jobs that won't be retried that were deleted
+	orphanDirs  int   // page directories without database rows that were deleted
+	bytes       int64 // total size of deleted files
+}
+
+// collectGarbage permanently deletes pages that were moved to the trash and jobs
+// that failed without being retried more than trashAge before now, and removes page
+// directories that aren't referenced by the database (including stale temporary
+// directories created by proc.Processor). If dryRun is true, nothing is deleted.
+func collectGarbage(cfg *common.Config, d *db.Database, now time.Time,
+	trashAge time.Duration, dryRun bool) (gcStats, error) {
+	var stats gcStats
+
+	users, err := d.GetAllUsers()
+	if err != nil {
+		return stats, fmt.Errorf("failed getting users: %v", err)
+	}
+	userDirs := make(map[int64]string, len(users))
+	for i := range users {
+		userDirs[users[i].Id] = cfg.GetUserPageDir(&users[i])
+	}
+
+	// removeDir deletes dir (unless dryRun is true) and updates stats.bytes.
+	removeDir := func(dir string) error {
+		size, err := getDirSize(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		stats.bytes += size
+		if dryRun {
+			return nil
+		}
+		return os.RemoveAll(dir)
+	}
+
+	trashed, err := d.GetTrashedPages(now.Add(-trashAge).Unix())
+	if err != nil {
+		return stats, fmt.Errorf("failed getting trashed pages: %v", err)
+	}
+	for _, pi := range trashed {
+		cfg.Logger.Printf("Purging trashed page %v (%v)\n", pi.Id, pi.OriginalURL)
+		if dir, ok := userDirs[pi.UserId]; ok {
+			if err := removeDir(filepath.Join(dir, pi.Id)); err != nil {
+				return stats, fmt.Errorf("failed deleting %v: %v", pi.Id, err)
+			}
+		}
+		if !dryRun {
+			if err := d.DeletePage(pi.Id); err != nil {
+				return stats, fmt.Errorf("failed deleting %v: %v", pi.Id, err)
+			}
+		}
+		stats.purgedPages++
+	}
+
+	exhausted, err := d.GetExhaustedJobs(now.Add(-trashAge).Unix())
+	if err != nil {
+		return stats, fmt.Errorf("failed getting failed jobs: %v", err)
+	}
+	for _, j := range exhausted {
+		cfg.Logger.Printf("Purging failed job %v (%v)\n", j.Id, j.URL)
+		if !dryRun {
+			if err := d.DeleteJob(j.Id); err != nil {
+				return stats, fmt.Errorf("failed deleting job %v: %v", j.Id, err)
+			}
+		}
+		stats.purgedJobs++
+	}
+
+	for _, u := range users {
+		// Pages that are still being processed don't have rows yet.
+		ids, err := d.GetPageIds(u.Id)
+		if err != nil {
+			return stats, fmt.Errorf("failed getting %v's pages: %v", u.Username, err)
+		}
+		jobs, err := d.GetAllJobs(u.Id)
+		if err != nil {
+			return stats, fmt.Errorf("failed getting %v's jobs: %v", u.Username, err)
+		}
+		for _, j := range jobs {
+			ids[j.PageId] = true
+		}
+
+		dir := userDirs[u.Id]
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return stats, err
+		}
+		for _, fi := range entries {
+			// Temporary directories left behind by interrupted processing are always orphaned.
+			name, temp := fi.Name(), false
+			if i := strings.Index(name, proc.TempPageDirSuffix); i >= 0 {
+				name, temp = name[:i], true
+			}
+			if !fi.IsDir() || !pageIDRegexp.MatchString(name) || (ids[name] && !temp) ||
+				now.Sub(fi.ModTime()) < orphanGracePeriod {
+				continue
+			}
+			p := filepath.Join(dir, fi.Name())
+			unlock := func() {}
+			if temp {
+				// Skip directories that are still being written, perhaps by a slow job.
+				u, ok, err := proc.TryLockTempDir(p)
+				if os.IsNotExist(err) || (err == nil && !ok) {
+					continue
+				} else if err != nil {
+					return stats, fmt.Errorf("failed locking %v: %v", p, err)
+				}
+				unlock = u
+			}
+			cfg.Logger.Printf("Deleting orphaned directory %v\n", p)
+			err := removeDir(p)
+			unlock()
+			if err != nil {
+				return stats, fmt.Errorf("failed deleting %v: %v", p, err)
+			}
+			stats.orphanDirs++
+		}
+	}
+	return stats, nil
+}
+
+// getDirSize returns the total size of the regular files under dir.
+func getDirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,137 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derat/aread/common"
+	"github.com/derat/aread/proc"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	const (
+		keptID    = "a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1" // live page
+		trashedID = "a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2" // old trashed page
+		orphanID  = "a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3a3" // old dir without row
+		newID     = "a4a4a4a4a4a4a4a4a4a4a4a4a4a4a4a4a4a4a4a4" // new dir without row
+		jobID     = "a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5" // dir for queued job
+		failedID  = "a6a6a6a6a6a6a6a6a6a6a6a6a6a6a6a6a6a6a6a6" // job that won't be retried
+		retryID   = "a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7a7" // job that will be retried
+	)
+	for _, id := range []string{keptID, trashedID} {
+		if err := h.db.AddPage(common.PageInfo{Id: id, UserId: common.ConfigUserId,
+			OriginalURL: "https://example.org/" + id}); err != nil {
+			t.Fatal("AddPage failed: ", err)
+		}
+	}
+	if err := h.db.SetPageTrashed(trashedID, true); err != nil {
+		t.Fatal("SetPageTrashed failed: ", err)
+	}
+	if err := h.db.AddJob(&common.Job{UserId: common.ConfigUserId, PageId: jobID,
+		URL: "https://example.org/job", State: common.JobQueued}); err != nil {
+		t.Fatal("AddJob failed: ", err)
+	}
+	// Jobs that failed permanently should be purged, but ones that will be retried should be kept.
+	exhausted := common.Job{UserId: common.ConfigUserId, PageId: failedID, URL: "https://example.org/failed"}
+	retrying := common.Job{UserId: common.ConfigUserId, PageId: retryID, URL: "https://example.org/retry"}
+	for _, j := range []*common.Job{&exhausted, &retrying} {
+		if err := h.db.AddJob(j); err != nil {
+			t.Fatal("AddJob failed: ", err)
+		}
+	}
+	if err := h.db.FailJob(exhausted.Id, "oops", 0); err != nil {
+		t.Fatal("FailJob failed: ", err)
+	}
+	if err := h.db.FailJob(retrying.Id, "oops", time.Now().Add(time.Hour).Unix()); err != nil {
+		t.Fatal("FailJob failed: ", err)
+	}
+
+	const fileSize = 10
+	now := time.Now()
+	old := now.Add(-2 * orphanGracePeriod)
+	staleID := keptID + proc.TempPageDirSuffix + "123456"  // left behind by interrupted processing
+	activeID := keptID + proc.TempPageDirSuffix + "654321" // still being written
+	for _, id := range []string{keptID, trashedID, orphanID, newID, jobID, staleID, activeID} {
+		dir := filepath.Join(h.cfg.PageDir, id)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), make([]byte, fileSize), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if id != newID {
+			if err := os.Chtimes(dir, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	unlock, ok, err := proc.TryLockTempDir(filepath.Join(h.cfg.PageDir, activeID))
+	if err != nil || !ok {
+		t.Fatalf("TryLockTempDir returned %v, %v", ok, err)
+	}
+	defer unlock()
+	exists := func(id string) bool {
+		_, err := os.Stat(filepath.Join(h.cfg.PageDir, id))
+		return err == nil
+	}
+
+	// A dry run shouldn't delete anything.
+	stats, err := collectGarbage(h.cfg, h.db, now.Add(time.Minute), 0, true)
+	if err != nil {
+		t.Fatal("collectGarbage failed: ", err)
+	}
+	want := gcStats{purgedPages: 1, purgedJobs: 1, orphanDirs: 2, bytes: 3 * fileSize}
+	if stats != want {
+		t.Errorf("Dry run returned %+v; want %+v", stats, want)
+	}
+	if !exists(trashedID) || !exists(orphanID) || !exists(staleID) {
+		t.Error("Dry run deleted directories")
+	}
+
+	// Trashed pages shouldn't be purged until they're old enough,
+	// and new directories should be left alone.
+	if stats, err = collectGarbage(h.cfg, h.db, now, time.Hour, false); err != nil {
+		t.Fatal("collectGarbage failed: ", err)
+	} else if want := (gcStats{purgedJobs: 1, orphanDirs: 2, bytes: 2 * fileSize}); stats != want {
+		t.Errorf("collectGarbage returned %+v; want %+v", stats, want)
+	}
+	if !exists(trashedID) || !exists(newID) || exists(orphanID) {
+		t.Error("collectGarbage deleted wrong directories")
+	}
+
+	if stats, err = collectGarbage(h.cfg, h.db, now.Add(2*time.Hour), time.Hour, false); err != nil {
+		t.Fatal("collectGarbage failed: ", err)
+	} else if want := (gcStats{purgedPages: 1, orphanDirs: 1, bytes: 2 * fileSize}); stats != want {
+		t.Errorf("collectGarbage returned %+v; want %+v", stats, want)
+	}
+	for id, want := range map[string]bool{
+		keptID:    true,
+		trashedID: false,
+		orphanID:  false,
+		newID:     false,
+		jobID:     true,
+		staleID:   false,
+		activeID:  true,
+	} {
+		if got := exists(id); got != want {
+			t.Errorf("%v exists = %v; want %v", id, got, want)
+		}
+	}
+	if _, err := h.db.GetPage(trashedID); err == nil {
+		t.Error("Purged page still in database")
+	}
+	if jobs, err := h.db.GetAllJobs(common.ConfigUserId); err != nil {
+		t.Error("GetAllJobs failed: ", err)
+	} else if len(jobs) != 2 || jobs[0].Id != retrying.Id || jobs[1].PageId != jobID {
+		t.Errorf("GetAllJobs returned %+v; want retrying and queued jobs", jobs)
+	}
+}
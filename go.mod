@@ -4,6 +4,15 @@ go 1.19
 
 require (
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/image v0.0.0-20200119044424-58c23975cae1
-	golang.org/x/net v0.0.0-20200421231249-e086a090c8fd
+	golang.org/x/net v0.0.0-20210916014120-12bc252f5db8
 )
+
+require (
+	github.com/andybalholm/cascadia v1.3.1
+	github.com/srwiley/oksvg v0.0.0-20200311192757-870daf9aa564
+	github.com/srwiley/rasterx v0.0.0-20200120212402-85cb7272f5e9
+)
+
+require golang.org/x/text v0.13.0 // indirect
@@ -4,36 +4,56 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/derat/aread/common"
 	"github.com/derat/aread/db"
 	"github.com/derat/aread/proc"
+	"golang.org/x/crypto/bcrypt"
 )
 
-const sessionCookieName = "session"
+const (
+	sessionCookieName = "session"
+	// csrfHeader is the header used to pass CSRF tokens with API requests.
+	csrfHeader = "X-CSRF-Token"
+	// sessionIDBytes is the number of random bytes in a session ID.
+	sessionIDBytes = 32
+)
 
 type handler struct {
 	cfg           *common.Config
 	proc          *proc.Processor
 	db            *db.Database
+	queue         *proc.Queue
 	staticHandler http.Handler
-	pageHandler   http.Handler
+	limiter       *loginLimiter
 }
 
-func newHandler(cfg *common.Config, proc *proc.Processor, db *db.Database) handler {
+func newHandler(cfg *common.Config, proc *proc.Processor, db *db.Database, queue *proc.Queue) handler {
 	return handler{
-		cfg:  cfg,
-		proc: proc,
-		db:   db,
+		cfg:   cfg,
+		proc:  proc,
+		db:    db,
+		queue: queue,
 		staticHandler: http.StripPrefix(cfg.GetPath(common.StaticURLPath),
 			http.FileServer(http.Dir(cfg.StaticDir))),
-		pageHandler: http.StripPrefix(cfg.GetPath(common.PagesURLPath),
-			http.FileServer(http.Dir(cfg.PageDir))),
+		limiter: newLoginLimiter(cfg.Logger),
 	}
 }
 
@@ -42,15 +62,12 @@ func (h handler) getStylesheets() []string {
 		h.cfg.GetPath(common.StaticURLPath, common.AppCSSFile)}
 }
 
-func (h handler) getAddToken() string {
-	return common.SHA1String(h.cfg.Username + "|" + h.cfg.Password)
-}
-
 type bookmarkletFlags uint32
 
 const (
 	sendToKindle bookmarkletFlags = 1 << iota
 	archive
+	promptTags
 )
 
 func (h handler) makeBookmarklet(baseURL string, token string, flags bookmarkletFlags) string {
@@ -63,6 +80,9 @@ func (h handler) makeBookmarklet(baseURL string, token string, flags bookmarklet
 	if flags&archive != 0 {
 		addURL += fmt.Sprintf("&%s=1", common.ArchiveParam)
 	}
+	if flags&promptTags != 0 {
+		addURL += fmt.Sprintf(`&%s="+encodeURIComponent(prompt("Tags")||"")+"`, common.TagsParam)
+	}
 	return `javascript:{window.location.href="` + addURL + `";};void(0);`
 }
 
@@ -72,159 +92,425 @@ func (h handler) serveTemplate(w http.ResponseWriter, t string, d interface{}, f
 	}
 }
 
-func (h handler) isAuthenticated(r *http.Request) bool {
+// getSession returns the session identified by r's session cookie and the
+// session's user. nils are returned if r doesn't have a valid session.
+func (h handler) getSession(r *http.Request) (*common.Session, *common.User) {
 	c, err := r.Cookie(sessionCookieName)
 	if err != nil {
-		return false
+		return nil, nil
 	}
-	isAuth, err := h.db.ValidSession(c.Value)
+	idle, max := h.cfg.GetSessionLimits()
+	sess, user, err := h.db.UseSession(c.Value, time.Now(), idle, max)
 	if err != nil {
 		h.cfg.Logger.Println(err)
-		return false
+		return nil, nil
+	}
+	return sess, user
+}
+
+// getCSRFToken returns the CSRF token for r's session. An empty string is
+// returned if r doesn't have a session cookie.
+func getCSRFToken(r *http.Request) string {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("csrf|" + c.Value))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkCSRF returns true if r contains its session's CSRF token in either
+// common.CSRFParam or csrfHeader.
+func checkCSRF(r *http.Request) bool {
+	got := r.Header.Get(csrfHeader)
+	if got == "" {
+		got = r.FormValue(common.CSRFParam)
+	}
+	want := getCSRFToken(r)
+	return want != "" && common.SecureEqual(got, want)
+}
+
+// isSafeMethod returns true if r's method shouldn't change state.
+func isSafeMethod(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// setSessionCookie sets the session cookie to id. If id is empty, the cookie is cleared.
+func (h handler) setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	maxAge := 86400 * 365 * 100
+	if id == "" {
+		maxAge = -1
+	} else if _, max := h.cfg.GetSessionLimits(); max > 0 {
+		maxAge = int(max / time.Second)
+	}
+	cookie := fmt.Sprintf("%s=%s;Path=%s;Max-Age=%d;HttpOnly", sessionCookieName, id, h.cfg.GetPath(), maxAge)
+	if isSecure(r) || strings.HasPrefix(h.cfg.BaseURL, "https:") {
+		cookie += ";Secure"
+	}
+	w.Header()["Set-Cookie"] = []string{cookie}
+}
+
+// getRequestToken returns the unrevoked API token supplied via r's
+// "Authorization: Bearer" header or common.TokenParam parameter.
+// nil is returned if no valid token was supplied.
+func (h handler) getRequestToken(r *http.Request) *common.APIToken {
+	const prefix = "Bearer "
+	secret := r.FormValue(common.TokenParam)
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, prefix) {
+		secret = strings.TrimSpace(auth[len(prefix):])
+	}
+	if secret == "" {
+		return nil
+	}
+	tok, err := h.db.UseToken(secret)
+	if err != nil {
+		h.cfg.Logger.Printf("Unable to check token: %v\n", err)
+		return nil
+	}
+	return tok
+}
+
+// getTokenUser returns the API token supplied via r (see getRequestToken)
+// and the user that it belongs to. nils are returned if no valid token was supplied.
+// The client's earlier failed authentication attempts are cleared on success.
+func (h handler) getTokenUser(r *http.Request) (*common.User, *common.APIToken) {
+	tok := h.getRequestToken(r)
+	if tok == nil {
+		return nil, nil
+	}
+	user, err := h.db.GetUser(tok.UserId)
+	if err != nil {
+		h.cfg.Logger.Printf("Unable to get token's user: %v\n", err)
+		return nil, nil
 	}
-	return isAuth
+	h.limiter.succeed(r.RemoteAddr)
+	return user, tok
+}
+
+// hasRequestToken returns true if r contains a token, either via common.TokenParam
+// or an "Authorization" header.
+func hasRequestToken(r *http.Request) bool {
+	return r.FormValue(common.TokenParam) != "" || r.Header.Get("Authorization") != ""
+}
+
+// checkLockout writes an error and returns false if r's client is locked out
+// due to too many failed authentication attempts. If api is true, a JSON error is written.
+func (h handler) checkLockout(w http.ResponseWriter, r *http.Request, api bool) bool {
+	wait := h.limiter.check(r.RemoteAddr)
+	if wait <= 0 {
+		return true
+	}
+	h.cfg.Logger.Printf("Rejecting authentication attempt from locked-out %v\n", r.RemoteAddr)
+	secs := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	msg := fmt.Sprintf("Too many failed attempts; try again in %d second(s)", secs)
+	if api {
+		writeAPIError(w, http.StatusTooManyRequests, msg)
+	} else {
+		http.Error(w, msg, http.StatusTooManyRequests)
+	}
+	return false
 }
 
 func (h handler) isFriend(r *http.Request) bool {
-	return len(h.cfg.FriendLocalToken) > 0 && r.FormValue(common.TokenParam) == h.cfg.FriendLocalToken
+	return len(h.cfg.FriendLocalToken) > 0 && common.SecureEqual(r.FormValue(common.TokenParam), h.cfg.FriendLocalToken)
+}
+
+// getPage returns the user's page with the supplied ID.
+// db.ErrPageNotFound is returned if the page belongs to a different user.
+func (h handler) getPage(user *common.User, id string) (common.PageInfo, error) {
+	pi, err := h.db.GetPage(id)
+	if err == nil && pi.UserId != user.Id {
+		return common.PageInfo{}, db.ErrPageNotFound
+	}
+	return pi, err
+}
+
+// addPage queues u to be added for user. The returned error is suitable for
+// displaying to the user. db.ErrJobPending is returned unwrapped.
+func (h handler) addPage(user *common.User, u string, fromFriend, archive, kindle bool, tags []string) (common.Job, error) {
+	j, err := h.queue.Add(user, u, fromFriend, archive, kindle, tags)
+	if err == db.ErrJobPending {
+		return j, err
+	} else if err != nil {
+		h.cfg.Logger.Println(err)
+		return j, fmt.Errorf("failed to queue %v: %v", u, err)
+	}
+	return j, nil
+}
+
+// getQueueErrorStatus returns the HTTP status code for err, an error returned
+// by addPage or reprocessPage.
+func getQueueErrorStatus(err error) int {
+	if err == db.ErrJobPending {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
 }
 
-func (h handler) handleAdd(w http.ResponseWriter, r *http.Request) {
+// setPageArchived updates the archived state of the page with the supplied ID.
+func (h handler) setPageArchived(id string, archived bool) error {
+	if err := h.db.SetPageArchived(id, archived); err != nil {
+		h.cfg.Logger.Println(err)
+		return fmt.Errorf("failed to update archived state: %v", err)
+	}
+	return nil
+}
+
+// setPageTrashed moves the page with the supplied ID into or out of the trash.
+func (h handler) setPageTrashed(id string, trashed bool) error {
+	if err := h.db.SetPageTrashed(id, trashed); err != nil {
+		h.cfg.Logger.Println(err)
+		return fmt.Errorf("failed to update trashed state: %v", err)
+	}
+	return nil
+}
+
+// reprocessPage queues the user's page pi to be reprocessed. The returned error
+// is suitable for displaying to the user. db.ErrJobPending is returned unwrapped.
+func (h handler) reprocessPage(user *common.User, pi common.PageInfo) (common.Job, error) {
+	j, err := h.queue.Reprocess(user, pi)
+	if err == db.ErrJobPending {
+		return j, err
+	} else if err != nil {
+		h.cfg.Logger.Println(err)
+		return j, fmt.Errorf("failed to queue reprocessing of %v: %v", pi.Id, err)
+	}
+	return j, nil
+}
+
+// sendPage sends the user's page with the supplied ID to the user's Kindle device.
+func (h handler) sendPage(user *common.User, id string) error {
+	p, err := h.proc.ForUser(user)
+	if err == nil {
+		err = p.SendToKindle(id)
+	}
+	if err != nil {
+		h.cfg.Logger.Println(err)
+		return fmt.Errorf("failed to send to Kindle: %v", err)
+	}
+	return nil
+}
+
+// deletePage deletes the user's page with the supplied ID from the database and disk.
+func (h handler) deletePage(user *common.User, id string) error {
+	p, err := h.proc.ForUser(user)
+	if err != nil {
+		h.cfg.Logger.Println(err)
+		return fmt.Errorf("failed to get user config: %v", err)
+	}
+	if err := h.db.DeletePage(id); err != nil {
+		h.cfg.Logger.Println(err)
+		return fmt.Errorf("failed to delete page: %v", err)
+	}
+	if err := p.RemovePage(id); err != nil {
+		h.cfg.Logger.Println(err)
+		return fmt.Errorf("failed to remove page files: %v", err)
+	}
+	return nil
+}
+
+// handleAdd handles a request to add a page for user. tok is nil if the
+// request was authenticated via a session or friend token.
+// Session-authenticated requests must use POST; token-authenticated requests
+// may use GET so that bookmarklets keep working.
+func (h handler) handleAdd(w http.ResponseWriter, r *http.Request, user *common.User, tok *common.APIToken) {
 	u := r.FormValue(common.AddURLParam)
-	if len(u) > 0 {
-		isFriend := h.isFriend(r)
-		if !isFriend && r.FormValue(common.TokenParam) != h.getAddToken() {
-			h.cfg.Logger.Printf("Bad or missing token in add request from %v\n", r.RemoteAddr)
-			http.Error(w, "Invalid token", http.StatusForbidden)
+	isFriend := h.isFriend(r)
+	if len(u) > 0 && (tok != nil || isFriend || r.Method == http.MethodPost) {
+		kindle := r.FormValue(common.AddKindleParam) == "1"
+		if tok != nil && (!tok.HasScope(common.ScopeAdd) || (kindle && !tok.HasScope(common.ScopeKindle))) {
+			h.cfg.Logger.Printf("Token %q lacks scope for add request from %v\n", tok.Name, r.RemoteAddr)
+			http.Error(w, "Token lacks required scope", http.StatusForbidden)
 			return
 		}
 
-		pi, err := h.proc.ProcessURL(u, isFriend)
-		if err != nil {
-			h.cfg.Logger.Println(err)
-			http.Error(w, fmt.Sprintf("Failed to process %v: %v", u, err), http.StatusInternalServerError)
-			return
-		}
-		if err := h.db.AddPage(pi); err != nil {
-			h.cfg.Logger.Println(err)
-			http.Error(w, fmt.Sprintf("Failed to add to database: %v", err), http.StatusInternalServerError)
+		if _, err := h.addPage(user, u, isFriend, r.FormValue(common.ArchiveParam) == "1",
+			kindle, common.ParseTags(r.FormValue(common.TagsParam))); err != nil {
+			http.Error(w, err.Error(), getQueueErrorStatus(err))
 			return
 		}
-		if r.FormValue(common.ArchiveParam) == "1" {
-			if err := h.db.TogglePageArchived(pi.Id); err != nil {
-				h.cfg.Logger.Println(err)
-				http.Error(w, fmt.Sprintf("Failed to archive page: %v", err), http.StatusInternalServerError)
-				return
-			}
-		}
-		if r.FormValue(common.AddKindleParam) == "1" {
-			if err = h.proc.SendToKindle(pi.Id); err != nil {
-				h.cfg.Logger.Println(err)
-				http.Error(w, fmt.Sprintf("Failed to send to Kindle: %v", err), http.StatusInternalServerError)
-				return
-			}
-		}
 
 		if isFriend {
-			common.WriteHeader(w, h.cfg, h.getStylesheets(), "Added page", "", "")
+			common.WriteHeader(w, h.cfg, h.getStylesheets(), "Added page", "", common.DocInfo{})
 			h.serveTemplate(w, `
   <body>
-	<p>Successfully added {{.URL}}!
+	<p>Queued {{.URL}}!
   </body>
 </html>`, struct{ URL string }{URL: u}, template.FuncMap{})
 		} else {
-			http.Redirect(w, r, h.cfg.GetPath(common.PagesURLPath, pi.Id), http.StatusFound)
+			http.Redirect(w, r, h.cfg.GetPath(), http.StatusFound)
 		}
 		return
 	}
 
-	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Add", "", "")
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Add", "", common.DocInfo{})
 	h.serveTemplate(w, `
   <body>
     <form method="post">
+      <input type="hidden" name="csrf" value="{{.CSRF}}">
       <table>
-        <input type="hidden" name="t" value={{.Token}}>
         <tr>
           <td>URL</td>
-          <td><input type="text" autofocus name="u" id="add-url"></td>
+          <td><input type="text" autofocus name="u" id="add-url" value="{{.URL}}"></td>
+        </tr>
+        <tr>
+          <td>Tags</td>
+          <td><input type="text" name="tags" id="add-tags"></td>
         </tr>
         <tr><td><input type="submit" value="Add"></td></tr>
       </table>
     </form>
   </body>
-</html>`, struct{ Token string }{Token: h.getAddToken()}, template.FuncMap{})
+</html>`, struct{ URL, CSRF string }{URL: u, CSRF: getCSRFToken(r)}, template.FuncMap{})
+}
+
+// serveConfirm writes a page asking the user to confirm an action on pi.
+// Submitting the form POSTs to action.
+func (h handler) serveConfirm(w http.ResponseWriter, r *http.Request, pi common.PageInfo, title, action string) {
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), title, "", common.DocInfo{})
+	h.serveTemplate(w, `
+  <body>
+    <p>{{.Title}}: <a href="{{.PagePath}}">{{.PageTitle}}</a></p>
+    <form method="post" action="{{.Action}}">
+      <input type="hidden" name="i" value="{{.Id}}">
+      <input type="hidden" name="csrf" value="{{.CSRF}}">
+      <input type="hidden" name="r" value="{{.Redirect}}">
+      <input type="submit" value="{{.Title}}">
+    </form>
+  </body>
+</html>`, struct {
+		Title, PageTitle, PagePath, Action, Id, CSRF, Redirect string
+	}{
+		Title:     title,
+		PageTitle: pi.Title,
+		PagePath:  h.cfg.GetPath(common.PagesURLPath, pi.Id) + "/",
+		Action:    action,
+		Id:        pi.Id,
+		CSRF:      getCSRFToken(r),
+		Redirect:  h.getSafeRedirect(r.FormValue(common.RedirectParam)),
+	}, template.FuncMap{})
 }
 
-func (h handler) handleArchive(w http.ResponseWriter, r *http.Request) {
-	pi, err := h.db.GetPage(r.FormValue(common.IDParam))
+func (h handler) handleArchive(w http.ResponseWriter, r *http.Request, user *common.User) {
+	pi, err := h.getPage(user, r.FormValue(common.IDParam))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Unable to find page: %v", err), http.StatusBadRequest)
 		return
 	}
-	if len(pi.Token) > 0 && r.FormValue(common.TokenParam) != pi.Token {
-		h.cfg.Logger.Printf("Bad or missing token in archive request from %v\n", r.RemoteAddr)
-		http.Error(w, "Invalid token", http.StatusBadRequest)
+	if r.Method != http.MethodPost {
+		title := "Archive"
+		if pi.Archived {
+			title = "Unarchive"
+		}
+		h.serveConfirm(w, r, pi, title, h.cfg.GetPath(common.ArchiveURLPath))
 		return
 	}
-	if err := h.db.TogglePageArchived(pi.Id); err != nil {
-		h.cfg.Logger.Println(err)
-		http.Error(w, fmt.Sprintf("Failed to toggle archived state: %v", err), http.StatusInternalServerError)
+	if err := h.setPageArchived(pi.Id, !pi.Archived); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, r.FormValue(common.RedirectParam), http.StatusFound)
+	http.Redirect(w, r, h.getSafeRedirect(r.FormValue(common.RedirectParam)), http.StatusFound)
 }
 
-func (h handler) handleKindle(w http.ResponseWriter, r *http.Request) {
-	pi, err := h.db.GetPage(r.FormValue(common.IDParam))
+func (h handler) handleKindle(w http.ResponseWriter, r *http.Request, user *common.User) {
+	pi, err := h.getPage(user, r.FormValue(common.IDParam))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Unable to find page: %v", err), http.StatusBadRequest)
 		return
 	}
-	if len(pi.Token) > 0 && r.FormValue(common.TokenParam) != pi.Token {
-		h.cfg.Logger.Printf("Bad or missing token in kindle request from %v\n", r.RemoteAddr)
-		http.Error(w, "Invalid token", http.StatusBadRequest)
+	if r.Method != http.MethodPost {
+		h.serveConfirm(w, r, pi, "Send to Kindle", h.cfg.GetPath(common.KindleURLPath))
 		return
 	}
-	if err := h.proc.SendToKindle(pi.Id); err != nil {
-		h.cfg.Logger.Println(err)
-		http.Error(w, fmt.Sprintf("Failed to send to Kindle: %v", err), http.StatusInternalServerError)
+	if err := h.sendPage(user, pi.Id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, r.FormValue(common.RedirectParam), http.StatusFound)
+	http.Redirect(w, r, h.getSafeRedirect(r.FormValue(common.RedirectParam)), http.StatusFound)
 }
 
-func (h handler) handleList(w http.ResponseWriter, r *http.Request) {
+func (h handler) handleReprocess(w http.ResponseWriter, r *http.Request, user *common.User) {
+	pi, err := h.getPage(user, r.FormValue(common.IDParam))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to find page: %v", err), http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.serveConfirm(w, r, pi, "Reprocess", h.cfg.GetPath(common.ReprocessURLPath))
+		return
+	}
+	if _, err := h.reprocessPage(user, pi); err != nil {
+		http.Error(w, err.Error(), getQueueErrorStatus(err))
+		return
+	}
+	http.Redirect(w, r, h.getSafeRedirect(r.FormValue(common.RedirectParam)), http.StatusFound)
+}
+
+func (h handler) handleList(w http.ResponseWriter, r *http.Request, user *common.User) {
 	d := struct {
+		Jobs                  []common.Job
 		Pages                 []common.PageInfo
+		Tags                  []db.TagCount
+		Tag                   string
+		Author                string
+		Sorts                 []listSort
+		ListPath              string
 		PagesPath             string
 		TogglePagePath        string
 		TogglePageString      string
 		ToggleListPath        string
 		ToggleListString      string
 		AddPath               string
-		ReadBookmarkletHref   template.HTMLAttr
-		SaveBookmarkletHref   template.HTMLAttr
-		KindleBookmarkletHref template.HTMLAttr
+		SearchPath            string
+		TokensPath            string
+		SessionsPath          string
+		LogoutPath            string
+		ArchivePath           string
+		ReprocessPath         string
+		TrashPath             string
+		CSRF                  string
 		FriendBookmarkletHref template.HTMLAttr
 	}{
-		PagesPath:             h.cfg.GetPath(common.PagesURLPath),
-		AddPath:               h.cfg.GetPath(common.AddURLPath),
-		ReadBookmarkletHref:   template.HTMLAttr("href=" + h.makeBookmarklet(h.cfg.BaseURL, h.getAddToken(), 0)),
-		SaveBookmarkletHref:   template.HTMLAttr("href=" + h.makeBookmarklet(h.cfg.BaseURL, h.getAddToken(), archive)),
-		KindleBookmarkletHref: template.HTMLAttr("href=" + h.makeBookmarklet(h.cfg.BaseURL, h.getAddToken(), sendToKindle)),
+		PagesPath:     h.cfg.GetPath(common.PagesURLPath),
+		AddPath:       h.cfg.GetPath(common.AddURLPath),
+		SearchPath:    h.cfg.GetPath(common.SearchURLPath),
+		TokensPath:    h.cfg.GetPath(common.TokensURLPath),
+		SessionsPath:  h.cfg.GetPath(common.SessionsURLPath),
+		LogoutPath:    h.cfg.GetPath(common.LogoutURLPath),
+		ArchivePath:   h.cfg.GetPath(common.ArchiveURLPath),
+		TrashPath:     h.cfg.GetPath(common.TrashURLPath),
+		ReprocessPath: h.cfg.GetPath(common.ReprocessURLPath),
+		CSRF:          getCSRFToken(r),
 	}
 
-	archived := r.FormValue("a") == "1"
-	archivedListPath := h.cfg.GetPath() + "?a=1"
-	unarchivedListPath := h.cfg.GetPath()
+	lp := getListParams(r)
+	archived := lp.archived
+	d.Tag = lp.tag
+	d.Author = lp.author
+	d.ListPath = h.getListPath(lp)
+	toggled := lp
+	toggled.archived = !archived
+	d.ToggleListPath = h.getListPath(toggled)
 	if archived {
 		d.TogglePageString = "Unarchive"
 		d.ToggleListString = "View unarchived pages"
-		d.ToggleListPath = unarchivedListPath
 	} else {
 		d.TogglePageString = "Archive"
 		d.ToggleListString = "View archived pages"
-		d.ToggleListPath = archivedListPath
+	}
+	for _, s := range []struct {
+		name  string
+		order db.PageOrder
+	}{
+		{"added", db.OrderAdded},
+		{"published", db.OrderPublished},
+		{"shortest", db.OrderShortest},
+		{"longest", db.OrderLongest},
+	} {
+		sorted := lp
+		sorted.order = s.order
+		d.Sorts = append(d.Sorts, listSort{s.name, h.getListPath(sorted), s.order == lp.order})
 	}
 
 	if len(h.cfg.FriendBaseURL) > 0 && len(h.cfg.FriendRemoteToken) > 0 {
@@ -233,73 +519,659 @@ func (h handler) handleList(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var err error
-	if d.Pages, err = h.db.GetAllPages(archived, h.cfg.MaxListSize); err != nil {
+	if d.Jobs, err = h.db.GetAllJobs(user.Id); err != nil {
+		h.cfg.Logger.Printf("Unable to get jobs: %v\n", err)
+		http.Error(w, fmt.Sprintf("Unable to get job list: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if d.Pages, err = h.db.QueryPages(db.PageQuery{
+		UserId:   user.Id,
+		Archived: archived,
+		Tag:      lp.tag,
+		Author:   lp.author,
+		Order:    lp.order,
+		Max:      h.cfg.MaxListSize,
+	}); err != nil {
 		h.cfg.Logger.Printf("Unable to get pages: %v\n", err)
 		http.Error(w, fmt.Sprintf("Unable to get page list: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if d.Tags, err = h.db.GetTags(user.Id, archived); err != nil {
+		h.cfg.Logger.Printf("Unable to get tags: %v\n", err)
+		http.Error(w, fmt.Sprintf("Unable to get tags: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	fm := template.FuncMap{
 		"host": common.GetHost,
 		"time": func(t int64) string { return time.Unix(t, 0).Format("Monday, Jan 2 at 15:04") },
-		"toggleURL": func(id, token string) string {
-			listPath := unarchivedListPath
-			if archived {
-				listPath = archivedListPath
-			}
-			return fmt.Sprintf("%s?%s=%s&%s=%s&%s=%s", h.cfg.GetPath(common.ArchiveURLPath),
-				common.IDParam, id, common.TokenParam, token, common.RedirectParam, listPath)
+		"tagsURL": func(id string) string {
+			return fmt.Sprintf("%s?%s=%s&%s=%s", h.cfg.GetPath(common.TagsURLPath),
+				common.IDParam, id, common.RedirectParam, url.QueryEscape(d.ListPath))
+		},
+		"date": func(t int64) string { return time.Unix(t, 0).Format("Jan 2, 2006") },
+		"listURL": func(tag string) string {
+			p := lp
+			p.tag = tag
+			return h.getListPath(p)
+		},
+		"authorURL": func(author string) string {
+			p := lp
+			p.author = author
+			return h.getListPath(p)
 		},
 	}
 
-	common.WriteHeader(w, h.cfg, h.getStylesheets(), "aread", "", "")
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), "aread", "", common.DocInfo{})
 	h.serveTemplate(w, `
   <body>
-    <p><a href="{{.ToggleListPath}}">{{.ToggleListString}}</a> - <a href="{{.AddPath}}">Add URL</a></p>
+    <form class="search" method="get" action="{{.SearchPath}}">
+      <a href="{{.ToggleListPath}}">{{.ToggleListString}}</a> - <a href="{{.AddPath}}">Add URL</a> -
+      <a href="{{.TrashPath}}">Trash</a> - <a href="{{.TokensPath}}">Tokens and bookmarklets</a> -
+      <a href="{{.SessionsPath}}">Sessions</a> - <a href="{{.LogoutPath}}">Log out</a> -
+      <input type="search" name="q" placeholder="Search">
+    </form>
+    {{if .Tags}}<p class="tags">Tags:
+      {{if .Tag}}<a href="{{listURL ""}}">all</a>{{end}}
+      {{range .Tags}}<a href="{{listURL .Name}}"{{if eq .Name $.Tag}} class="selected"{{end}}>{{.Name}}</a>&nbsp;({{.Count}}) {{end}}
+    </p>{{end}}
+    <p class="sorts">Sort by:
+      {{range .Sorts}}<a href="{{.Path}}"{{if .Selected}} class="selected"{{end}}>{{.Name}}</a> {{end}}
+      {{if .Author}}- By {{.Author}} (<a href="{{authorURL ""}}">all authors</a>){{end}}
+    </p>
+    {{ range .Jobs }}
+    <div class="list-entry pending">
+      <div class="title">{{.URL}}</div>
+      <div class="orig"><a href="{{.URL}}">{{host .URL}}</a></div>
+      <div class="details">
+        <span class="state">{{if .Reprocess}}Reprocessing{{else}}Pending{{end}}: {{.State}}{{if gt .Attempts 1}} (attempt {{.Attempts}}){{end}}</span> -
+        <span class="time">Added {{time .TimeAdded}}</span>
+        {{if .Error}}<div class="error">{{.Error}}{{if .NextAttempt}} (retrying {{time .NextAttempt}}){{end}}</div>{{end}}
+      </div>
+    </div>
+    {{ end }}
     {{ range .Pages }}
     <div class="list-entry">
+      {{if .LeadImage}}<img class="lead" src="{{$.PagesPath}}/{{.Id}}/{{.LeadImage}}" alt="">{{end}}
       <div class="title"><a href="{{$.PagesPath}}/{{.Id}}/">{{.Title}}</a></div>
       <div class="orig"><a href="{{.OriginalURL}}">{{host .OriginalURL}}</a></div>
+      <div class="meta">
+        {{- if .Author}}By <a href="{{authorURL .Author}}">{{.Author}}</a>{{end}}
+        {{- if .TimePublished}}{{if .Author}} - {{end}}Published {{date .TimePublished}}{{end}}
+        {{- if .WordCount}}{{if or .Author .TimePublished}} - {{end}}{{.ReadingTime}} min read ({{.WordCount}} words){{end -}}
+      </div>
+      {{if .Excerpt}}<div class="excerpt"{{if .Language}} lang="{{.Language}}"{{end}}>{{.Excerpt}}</div>{{end}}
       <div class="details">
-        <a href="{{toggleURL .Id .Token}}">{{$.TogglePageString}}</a> - <span class="time">Added {{time .TimeAdded}}</span>
+        <form class="inline" method="post" action="{{$.ArchivePath}}">
+          <input type="hidden" name="i" value="{{.Id}}">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}">
+          <input type="hidden" name="r" value="{{$.ListPath}}">
+          <button type="submit" class="link">{{$.TogglePageString}}</button>
+        </form> -
+        <a href="{{tagsURL .Id}}">Edit tags</a> -
+        <form class="inline" method="post" action="{{$.ReprocessPath}}">
+          <input type="hidden" name="i" value="{{.Id}}">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}">
+          <input type="hidden" name="r" value="{{$.ListPath}}">
+          <button type="submit" class="link">Reprocess</button>
+        </form> -
+        <form class="inline" method="post" action="{{$.TrashPath}}">
+          <input type="hidden" name="action" value="trash">
+          <input type="hidden" name="i" value="{{.Id}}">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}">
+          <input type="hidden" name="r" value="{{$.ListPath}}">
+          <button type="submit" class="link">Delete</button>
+        </form> -
+        <span class="time">Added {{time .TimeAdded}}</span>
+        {{if .Tags}}<span class="tags">{{range .Tags}}<a href="{{listURL .}}">{{.}}</a> {{end}}</span>{{end}}
       </div>
     </div>
     {{ end }}
-    <div>
+    {{if .FriendBookmarkletHref}}<div>
       <span class="bookmarklets-label">Bookmarklets:</span>
-      <div class="bookmarklet"><a {{.ReadBookmarkletHref}}>Add</a></div>
-      <div class="bookmarklet"><a {{.SaveBookmarkletHref}}>Save</a></div>
-      <div class="bookmarklet"><a {{.KindleBookmarkletHref}}>Kindle</a></div>
-	  {{if .FriendBookmarkletHref}}<div class="bookmarklet"><a {{.FriendBookmarkletHref}}>Friend's Kindle</a></div>{{end}}
+      <div class="bookmarklet"><a {{.FriendBookmarkletHref}}>Friend's Kindle</a></div>
+    </div>{{end}}
+  </body>
+</html>`, d, fm)
+}
+
+// getSafeRedirect returns target if it's a same-origin path under h.cfg.GetPath().
+// Otherwise, the path of the list of pages is returned.
+func (h handler) getSafeRedirect(target string) string {
+	base := h.cfg.GetPath()
+	if base == "" {
+		base = "/"
+	}
+	// Browsers treat backslashes like slashes and ignore some whitespace,
+	// so "/\\host" and "/\t/host" can both be interpreted as "//host".
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") ||
+		strings.IndexFunc(target, func(r rune) bool { return r == '\\' || unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return base
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return base
+	}
+	// Check the decoded path so that e.g. "/%2F%2Fhost" or "/base/../host" is rejected.
+	p := path.Clean(u.Path)
+	if p != base && !strings.HasPrefix(p, strings.TrimSuffix(base, "/")+"/") {
+		return base
+	}
+	if strings.HasSuffix(u.Path, "/") && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return (&url.URL{Path: p, RawQuery: u.RawQuery, Fragment: u.Fragment}).String()
+}
+
+// listSort describes a link used to change the order of the list of pages.
+type listSort struct {
+	Name     string
+	Path     string
+	Selected bool
+}
+
+// listParams describes the pages displayed by handleList.
+type listParams struct {
+	archived bool         // list archived rather than unarchived pages
+	tag      string       // only list pages with this tag
+	author   string       // only list pages by this author
+	order    db.PageOrder // order in which pages are listed
+}
+
+// getListParams returns the listParams specified by r's parameters.
+func getListParams(r *http.Request) listParams {
+	lp := listParams{
+		archived: r.FormValue(common.ArchiveParam) == "1",
+		tag:      r.FormValue(common.TagParam),
+		author:   r.FormValue(common.AuthorParam),
+	}
+	lp.order, _ = db.ParsePageOrder(r.FormValue(common.SortParam))
+	return lp
+}
+
+// getListPath returns the path of the list of pages described by lp.
+func (h handler) getListPath(lp listParams) string {
+	vals := url.Values{}
+	if lp.archived {
+		vals.Set(common.ArchiveParam, "1")
+	}
+	if lp.tag != "" {
+		vals.Set(common.TagParam, lp.tag)
+	}
+	if lp.author != "" {
+		vals.Set(common.AuthorParam, lp.author)
+	}
+	if lp.order != db.OrderAdded {
+		vals.Set(common.SortParam, string(lp.order))
+	}
+	if len(vals) == 0 {
+		return h.cfg.GetPath()
+	}
+	return h.cfg.GetPath() + "?" + vals.Encode()
+}
+
+func (h handler) handleTags(w http.ResponseWriter, r *http.Request, user *common.User) {
+	pi, err := h.getPage(user, r.FormValue(common.IDParam))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to find page: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := h.db.SetPageTags(pi.Id, common.ParseTags(r.FormValue(common.TagsParam))); err != nil {
+			h.cfg.Logger.Println(err)
+			http.Error(w, fmt.Sprintf("Failed to set tags: %v", err), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, h.getSafeRedirect(r.FormValue(common.RedirectParam)), http.StatusFound)
+		return
+	}
+
+	redirect := h.getSafeRedirect(r.FormValue(common.RedirectParam))
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Edit tags", "", common.DocInfo{})
+	h.serveTemplate(w, `
+  <body>
+    <p><a href="{{.PagePath}}">{{.Title}}</a></p>
+    <form method="post">
+      <input type="hidden" name="i" value="{{.Id}}">
+      <input type="hidden" name="csrf" value="{{.CSRF}}">
+      <input type="hidden" name="r" value="{{.Redirect}}">
+      <table>
+        <tr>
+          <td>Tags</td>
+          <td><input type="text" autofocus name="tags" id="edit-tags" value="{{.Tags}}"></td>
+        </tr>
+        <tr><td><input type="submit" value="Save"></td></tr>
+      </table>
+    </form>
+  </body>
+</html>`, struct {
+		Id, CSRF, Title, Tags, PagePath, Redirect string
+	}{
+		Id:       pi.Id,
+		CSRF:     getCSRFToken(r),
+		Title:    pi.Title,
+		Tags:     strings.Join(pi.Tags, ", "),
+		PagePath: h.cfg.GetPath(common.PagesURLPath, pi.Id) + "/",
+		Redirect: redirect,
+	}, template.FuncMap{})
+}
+
+// bookmarklet describes a bookmarklet displayed by handleTokens.
+type bookmarklet struct {
+	Name string
+	Href template.HTMLAttr
+}
+
+func (h handler) handleTokens(w http.ResponseWriter, r *http.Request, user *common.User) {
+	d := struct {
+		Tokens       []common.APIToken
+		AllScopes    []string
+		ListPath     string
+		Name         string // name of newly-created token
+		Secret       string // secret of newly-created token
+		Bookmarklets []bookmarklet
+		CSRF         string
+	}{
+		AllScopes: common.AllScopes,
+		ListPath:  h.cfg.GetPath(),
+		CSRF:      getCSRFToken(r),
+	}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "create":
+			d.Name = strings.TrimSpace(r.FormValue("name"))
+			if d.Name == "" {
+				http.Error(w, "Missing token name", http.StatusBadRequest)
+				return
+			}
+			scopes := r.Form["scope"]
+			for _, sc := range scopes {
+				if !common.IsValidScope(sc) {
+					http.Error(w, fmt.Sprintf("Invalid scope %q", sc), http.StatusBadRequest)
+					return
+				}
+			}
+			if len(scopes) == 0 {
+				http.Error(w, "No scopes selected", http.StatusBadRequest)
+				return
+			}
+			var err error
+			if d.Secret, err = h.db.AddToken(user.Id, d.Name, scopes); err != nil {
+				h.cfg.Logger.Println(err)
+				http.Error(w, fmt.Sprintf("Failed to create token: %v", err), http.StatusInternalServerError)
+				return
+			}
+			h.cfg.Logger.Printf("Created token %q with scopes %v\n", d.Name, scopes)
+
+			tok := common.APIToken{Scopes: scopes}
+			add := func(name string, flags bookmarkletFlags) {
+				d.Bookmarklets = append(d.Bookmarklets, bookmarklet{name,
+					template.HTMLAttr("href=" + h.makeBookmarklet(h.cfg.BaseURL, d.Secret, flags))})
+			}
+			if tok.HasScope(common.ScopeAdd) {
+				add("Add", 0)
+				add("Save", archive)
+				add("Tag", promptTags)
+				if tok.HasScope(common.ScopeKindle) {
+					add("Kindle", sendToKindle)
+				}
+			}
+		case "revoke":
+			id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid token ID", http.StatusBadRequest)
+				return
+			}
+			if err := h.db.RevokeToken(user.Id, id); err != nil {
+				h.cfg.Logger.Println(err)
+				http.Error(w, fmt.Sprintf("Failed to revoke token: %v", err), http.StatusInternalServerError)
+				return
+			}
+			h.cfg.Logger.Printf("Revoked token %v\n", id)
+			http.Redirect(w, r, h.cfg.GetPath(common.TokensURLPath), http.StatusFound)
+			return
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	if d.Tokens, err = h.db.GetAllTokens(user.Id); err != nil {
+		h.cfg.Logger.Printf("Unable to get tokens: %v\n", err)
+		http.Error(w, fmt.Sprintf("Unable to get tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	fm := template.FuncMap{
+		"time": func(t int64) string {
+			if t == 0 {
+				return "Never"
+			}
+			return time.Unix(t, 0).Format("Jan 2, 2006 at 15:04")
+		},
+		"join": strings.Join,
+	}
+
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Tokens", "", common.DocInfo{})
+	h.serveTemplate(w, `
+  <body>
+    <p><a href="{{.ListPath}}">Back to list</a></p>
+    {{if .Secret}}<div class="new-token">
+      <p>Created token "{{.Name}}". Copy it now; it won't be shown again.</p>
+      <pre class="token">{{.Secret}}</pre>
+      {{if .Bookmarklets}}<div>
+        <span class="bookmarklets-label">Bookmarklets:</span>
+        {{range .Bookmarklets}}<div class="bookmarklet"><a {{.Href}}>{{.Name}}</a></div>{{end}}
+      </div>{{end}}
+    </div>{{end}}
+    <form method="post">
+      <input type="hidden" name="action" value="create">
+      <input type="hidden" name="csrf" value="{{.CSRF}}">
+      <table>
+        <tr>
+          <td>Name</td>
+          <td><input type="text" name="name" id="token-name" placeholder="e.g. phone"></td>
+        </tr>
+        <tr>
+          <td>Scopes</td>
+          <td>{{range .AllScopes}}<label><input type="checkbox" name="scope" value="{{.}}"{{if eq . "add"}} checked{{end}}>{{.}}</label> {{end}}</td>
+        </tr>
+        <tr><td><input type="submit" value="Create token"></td></tr>
+      </table>
+    </form>
+    {{if .Tokens}}<table class="tokens">
+      <tr><th>Name</th><th>Scopes</th><th>Created</th><th>Last used</th><th></th></tr>
+      {{range .Tokens}}<tr{{if .Revoked}} class="revoked"{{end}}>
+        <td>{{.Name}}</td>
+        <td>{{join .Scopes ", "}}</td>
+        <td>{{time .TimeCreated}}</td>
+        <td>{{time .LastUsed}}</td>
+        <td>{{if .Revoked}}Revoked{{else}}<form method="post">
+          <input type="hidden" name="action" value="revoke">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}">
+          <input type="hidden" name="id" value="{{.Id}}">
+          <input type="submit" value="Revoke">
+        </form>{{end}}</td>
+      </tr>{{end}}
+    </table>{{end}}
+  </body>
+</html>`, d, fm)
+}
+
+// handleTrash lists the user's trashed pages and handles requests to move pages
+// into or out of the trash or to delete them permanently.
+func (h handler) handleTrash(w http.ResponseWriter, r *http.Request, user *common.User) {
+	if r.Method == http.MethodPost {
+		pi, err := h.getPage(user, r.FormValue(common.IDParam))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to find page: %v", err), http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("action") {
+		case "trash":
+			err = h.setPageTrashed(pi.Id, true)
+		case "restore":
+			err = h.setPageTrashed(pi.Id, false)
+		case "delete":
+			err = h.deletePage(user, pi.Id)
+		default:
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		redirect := h.cfg.GetPath(common.TrashURLPath)
+		if r.FormValue(common.RedirectParam) != "" {
+			redirect = h.getSafeRedirect(r.FormValue(common.RedirectParam))
+		}
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+
+	d := struct {
+		Pages     []common.PageInfo
+		ListPath  string
+		PagesPath string
+		CSRF      string
+	}{
+		ListPath:  h.cfg.GetPath(),
+		PagesPath: h.cfg.GetPath(common.PagesURLPath),
+		CSRF:      getCSRFToken(r),
+	}
+	var err error
+	if d.Pages, err = h.db.QueryPages(db.PageQuery{
+		UserId:  user.Id,
+		Trashed: true,
+		Max:     h.cfg.MaxListSize,
+	}); err != nil {
+		h.cfg.Logger.Printf("Unable to get trashed pages: %v\n", err)
+		http.Error(w, fmt.Sprintf("Unable to get trashed pages: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	fm := template.FuncMap{
+		"host": common.GetHost,
+		"time": func(t int64) string { return time.Unix(t, 0).Format("Monday, Jan 2 at 15:04") },
+	}
+
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Trash", "", common.DocInfo{})
+	h.serveTemplate(w, `
+  <body>
+    <p><a href="{{.ListPath}}">Back to list</a></p>
+    {{if not .Pages}}<p>The trash is empty.</p>{{end}}
+    {{range .Pages}}
+    <div class="list-entry">
+      <div class="title"><a href="{{$.PagesPath}}/{{.Id}}/">{{.Title}}</a></div>
+      <div class="orig"><a href="{{.OriginalURL}}">{{host .OriginalURL}}</a></div>
+      <div class="details">
+        <form class="inline" method="post">
+          <input type="hidden" name="action" value="restore">
+          <input type="hidden" name="i" value="{{.Id}}">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}">
+          <button type="submit" class="link">Restore</button>
+        </form> -
+        <form class="inline" method="post">
+          <input type="hidden" name="action" value="delete">
+          <input type="hidden" name="i" value="{{.Id}}">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}">
+          <button type="submit" class="link">Delete forever</button>
+        </form> -
+        <span class="time">Deleted {{time .TimeDeleted}}</span>
+      </div>
     </div>
+    {{end}}
   </body>
 </html>`, d, fm)
 }
 
+// handleSessions lists the user's sessions and handles requests to revoke them.
+// cur is the session used to make the request.
+func (h handler) handleSessions(w http.ResponseWriter, r *http.Request, user *common.User, cur *common.Session) {
+	if r.Method == http.MethodPost {
+		if r.FormValue("action") != "revoke" {
+			http.Error(w, "Invalid action", http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid session ID", http.StatusBadRequest)
+			return
+		}
+		if err := h.db.RevokeSession(user.Id, id); err != nil {
+			h.cfg.Logger.Println(err)
+			http.Error(w, fmt.Sprintf("Failed to revoke session: %v", err), http.StatusInternalServerError)
+			return
+		}
+		h.cfg.Logger.Printf("Revoked session %v for %v\n", id, user.Username)
+		http.Redirect(w, r, h.cfg.GetPath(common.SessionsURLPath), http.StatusFound)
+		return
+	}
+
+	d := struct {
+		Sessions  []common.Session
+		CurrentId int64
+		ListPath  string
+		CSRF      string
+	}{
+		ListPath: h.cfg.GetPath(),
+		CSRF:     getCSRFToken(r),
+	}
+	if cur != nil {
+		d.CurrentId = cur.Id
+	}
+	var err error
+	if d.Sessions, err = h.db.GetSessions(user.Id); err != nil {
+		h.cfg.Logger.Printf("Unable to get sessions: %v\n", err)
+		http.Error(w, fmt.Sprintf("Unable to get sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	fm := template.FuncMap{
+		"time": func(t int64) string { return time.Unix(t, 0).Format("Jan 2, 2006 at 15:04") },
+	}
+
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Sessions", "", common.DocInfo{})
+	h.serveTemplate(w, `
+  <body>
+    <p><a href="{{.ListPath}}">Back to list</a></p>
+    <table class="sessions">
+      <tr><th>IP address</th><th>User agent</th><th>Created</th><th>Last seen</th><th></th></tr>
+      {{range .Sessions}}<tr{{if eq .Id $.CurrentId}} class="current"{{end}}>
+        <td>{{.IPAddress}}</td>
+        <td class="agent">{{.UserAgent}}</td>
+        <td>{{time .TimeAdded}}</td>
+        <td>{{time .LastSeen}}</td>
+        <td><form method="post">
+          <input type="hidden" name="action" value="revoke">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}">
+          <input type="hidden" name="id" value="{{.Id}}">
+          <input type="submit" value="Revoke">{{if eq .Id $.CurrentId}} (current){{end}}
+        </form></td>
+      </tr>{{end}}
+    </table>
+  </body>
+</html>`, d, fm)
+}
+
+func (h handler) handleSearch(w http.ResponseWriter, r *http.Request, user *common.User) {
+	d := struct {
+		Query     string
+		Results   []db.SearchResult
+		Error     string
+		ListPath  string
+		PagesPath string
+	}{
+		Query:     strings.TrimSpace(r.FormValue(common.SearchParam)),
+		ListPath:  h.cfg.GetPath(),
+		PagesPath: h.cfg.GetPath(common.PagesURLPath),
+	}
+	if d.Query != "" {
+		var err error
+		if d.Results, err = h.db.SearchPages(user.Id, d.Query, h.cfg.MaxListSize); err == db.ErrSearchUnavailable {
+			d.Error = "Search is unavailable."
+		} else if err != nil {
+			h.cfg.Logger.Printf("Search for %q failed: %v\n", d.Query, err)
+			http.Error(w, fmt.Sprintf("Search failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fm := template.FuncMap{
+		"host": common.GetHost,
+		"time": func(t int64) string { return time.Unix(t, 0).Format("Monday, Jan 2, 2006") },
+		"snippet": func(s string) template.HTML {
+			s = template.HTMLEscapeString(s)
+			s = strings.Replace(s, db.SnippetStart, "<mark>", -1)
+			return template.HTML(strings.Replace(s, db.SnippetEnd, "</mark>", -1))
+		},
+	}
+
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Search", "", common.DocInfo{})
+	h.serveTemplate(w, `
+  <body>
+    <form class="search" method="get">
+      <a href="{{.ListPath}}">Back to list</a> -
+      <input type="search" name="q" value="{{.Query}}" autofocus>
+      <input type="submit" value="Search">
+    </form>
+    {{if .Error}}<p>{{.Error}}</p>{{end}}
+    {{if and .Query (not .Error) (not .Results)}}<p>No matching pages.</p>{{end}}
+    {{ range .Results }}
+    <div class="list-entry">
+      <div class="title"><a href="{{$.PagesPath}}/{{.Page.Id}}/">{{.Page.Title}}</a></div>
+      <div class="orig"><a href="{{.Page.OriginalURL}}">{{host .Page.OriginalURL}}</a></div>
+      <div class="snippet">{{snippet .Snippet}}</div>
+      <div class="details">
+        <span class="time">Added {{time .Page.TimeAdded}}{{if .Page.Archived}} (archived){{end}}</span>
+      </div>
+    </div>
+    {{ end }}
+  </body>
+</html>`, d, fm)
+}
+
+// checkPassword returns the enabled user with the supplied username and password.
+// nil is returned if the username or password is incorrect.
+func (h handler) checkPassword(username, password string) (*common.User, error) {
+	if common.SecureEqual(username, h.cfg.Username) && common.CheckPassword(h.cfg.Password, password) {
+		return h.db.GetUser(common.ConfigUserId)
+	}
+	user, hash, err := h.db.GetUserByName(username)
+	if err == db.ErrUserNotFound || (err == nil && (user.Id == common.ConfigUserId || user.Disabled)) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, nil
+	}
+	return user, nil
+}
+
 func (h handler) handleAuth(w http.ResponseWriter, r *http.Request) {
 	if len(r.FormValue("p")) > 0 {
-		if r.FormValue("u") == h.cfg.Username && r.FormValue("p") == h.cfg.Password {
-			id := common.SHA1String(fmt.Sprintf("%s|%s|%d", h.cfg.Username, h.cfg.Password, time.Now().UnixNano()))
-			if err := h.db.AddSession(id, r.RemoteAddr); err != nil {
+		if !h.checkLockout(w, r, false) {
+			return
+		}
+		user, err := h.checkPassword(r.FormValue("u"), r.FormValue("p"))
+		if err != nil {
+			h.cfg.Logger.Printf("Unable to check password: %v\n", err)
+			http.Error(w, fmt.Sprintf("Unable to check password: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if user != nil {
+			id, err := common.RandomString(sessionIDBytes)
+			if err != nil {
+				h.cfg.Logger.Printf("Unable to generate session ID: %v\n", err)
+				http.Error(w, "Unable to generate session ID", http.StatusInternalServerError)
+				return
+			}
+			if err := h.db.AddSession(id, r.RemoteAddr, r.UserAgent(), user.Id); err != nil {
 				h.cfg.Logger.Printf("Unable to insert session: %v\n", err)
 				http.Error(w, fmt.Sprintf("Unable to insert session: %v", err), http.StatusInternalServerError)
 				return
 			}
-			h.cfg.Logger.Printf("Successful authentication attempt from %v\n", r.RemoteAddr)
-			cookie := fmt.Sprintf("%s=%s;Path=%s;Max-Age=%d;Secure;HttpOnly", sessionCookieName, id, h.cfg.GetPath(), 86400*365*100)
-			w.Header()["Set-Cookie"] = []string{cookie}
-			http.Redirect(w, r, r.FormValue("r"), http.StatusFound)
+			h.cfg.Logger.Printf("Successful authentication attempt for %v from %v\n", user.Username, r.RemoteAddr)
+			h.limiter.succeed(r.RemoteAddr)
+			h.setSessionCookie(w, r, id)
+			http.Redirect(w, r, h.getSafeRedirect(r.FormValue(common.RedirectParam)), http.StatusFound)
 			return
 		} else {
 			h.cfg.Logger.Printf("Bad authentication attempt from %v\n", r.RemoteAddr)
+			h.limiter.fail(r.RemoteAddr)
 		}
 	}
 
-	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Auth", "", "")
+	common.WriteHeader(w, h.cfg, h.getStylesheets(), "Auth", "", common.DocInfo{})
 	h.serveTemplate(w, `
   <body>
     <form method="post">
-      <input type="hidden" name="r" value={{.Redirect}}>
+      <input type="hidden" name="r" value="{{.Redirect}}">
       <table class="auth">
         <tr><td>Username</td><td><input type="text" name="u"></td></tr>
         <tr><td>Password</td><td><input type="password" name="p"></td></tr>
@@ -307,7 +1179,38 @@ func (h handler) handleAuth(w http.ResponseWriter, r *http.Request) {
       </table>
     </form>
   </body>
-</html>`, struct{ Redirect string }{Redirect: r.FormValue("r")}, template.FuncMap{})
+</html>`, struct{ Redirect string }{Redirect: h.getSafeRedirect(r.FormValue(common.RedirectParam))}, template.FuncMap{})
+}
+
+// handleLogout deletes the request's session and clears its cookie.
+// GET requests display a form that POSTs back to this handler.
+func (h handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		common.WriteHeader(w, h.cfg, h.getStylesheets(), "Log out", "", common.DocInfo{})
+		h.serveTemplate(w, `
+  <body>
+    <form method="post">
+      <input type="hidden" name="csrf" value="{{.}}">
+      <input type="submit" value="Log out">
+    </form>
+  </body>
+</html>`, getCSRFToken(r), template.FuncMap{})
+		return
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		if !checkCSRF(r) {
+			h.cfg.Logger.Printf("Bad or missing CSRF token in logout request from %v\n", r.RemoteAddr)
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if err := h.db.DeleteSession(c.Value); err != nil {
+			h.cfg.Logger.Printf("Unable to delete session: %v\n", err)
+			http.Error(w, fmt.Sprintf("Unable to delete session: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	h.setSessionCookie(w, r, "")
+	http.Redirect(w, r, h.cfg.GetPath(common.AuthURLPath), http.StatusFound)
 }
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -333,30 +1236,149 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleAuth(w, r)
 		return
 	}
+	if reqPath == common.LogoutURLPath {
+		h.handleLogout(w, r)
+		return
+	}
+
+	// API requests and add requests can be authenticated via tokens. Explicitly-supplied
+	// tokens take precedence over sessions, since bookmarklets and extensions send both.
+	sess, user := h.getSession(r)
+	var tok *common.APIToken
+	if reqPath == common.APIURLPath || strings.HasPrefix(reqPath, common.APIURLPath+"/") {
+		if user == nil || hasRequestToken(r) {
+			if !h.checkLockout(w, r, true) {
+				return
+			}
+			if user, tok = h.getTokenUser(r); user == nil {
+				h.cfg.Logger.Printf("Unauthenticated API request from %v\n", r.RemoteAddr)
+				if hasRequestToken(r) {
+					h.limiter.fail(r.RemoteAddr)
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAPIError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+		} else if !isSafeMethod(r) && !checkCSRF(r) {
+			h.cfg.Logger.Printf("Bad or missing CSRF token in API request from %v\n", r.RemoteAddr)
+			writeAPIError(w, http.StatusForbidden, "missing or invalid "+csrfHeader+" header")
+			return
+		}
+		h.handleAPI(w, r, strings.Trim(reqPath[len(common.APIURLPath):], "/"), user, tok)
+		return
+	}
+	if reqPath == common.AddURLPath && hasRequestToken(r) {
+		if !h.checkLockout(w, r, false) {
+			return
+		}
+		if h.isFriend(r) {
+			h.limiter.succeed(r.RemoteAddr)
+			// Friends' pages are added for the config user.
+			friendUser, err := h.db.GetUser(common.ConfigUserId)
+			if err != nil {
+				h.cfg.Logger.Println(err)
+				http.Error(w, fmt.Sprintf("Unable to get user: %v", err), http.StatusInternalServerError)
+				return
+			}
+			h.handleAdd(w, r, friendUser, nil)
+			return
+		}
+		if tokUser, tok := h.getTokenUser(r); tokUser != nil {
+			h.handleAdd(w, r, tokUser, tok)
+			return
+		}
+		h.limiter.fail(r.RemoteAddr)
+		if r.FormValue(common.AddURLParam) != "" {
+			h.cfg.Logger.Printf("Bad token in add request from %v\n", r.RemoteAddr)
+			http.Error(w, "Invalid token", http.StatusForbidden)
+			return
+		}
+	}
 
 	// Everything else requires authentication.
-	if !h.isAuthenticated(r) && !(reqPath == common.AddURLPath && h.isFriend(r)) {
+	if user == nil {
 		h.cfg.Logger.Printf("Unauthenticated request from %v\n", r.RemoteAddr)
-		path := h.cfg.GetPath(fmt.Sprintf("%s?%s=%s", common.AuthURLPath, common.RedirectParam, r.URL.Path))
+		path := h.cfg.GetPath(fmt.Sprintf("%s?%s=%s", common.AuthURLPath, common.RedirectParam, url.QueryEscape(r.URL.Path)))
 		http.Redirect(w, r, path, http.StatusFound)
 		return
 	}
+	// Requests authenticated via sessions can only change state via POSTs containing a CSRF token.
+	if !isSafeMethod(r) && !checkCSRF(r) {
+		h.cfg.Logger.Printf("Bad or missing CSRF token in request from %v\n", r.RemoteAddr)
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
 
 	if len(reqPath) == 0 {
-		h.handleList(w, r)
+		h.handleList(w, r, user)
 	} else if reqPath == common.AddURLPath {
-		h.handleAdd(w, r)
+		h.handleAdd(w, r, user, nil)
 	} else if reqPath == common.ArchiveURLPath {
-		h.handleArchive(w, r)
+		h.handleArchive(w, r, user)
 	} else if reqPath == common.KindleURLPath {
-		h.handleKindle(w, r)
+		h.handleKindle(w, r, user)
+	} else if reqPath == common.SearchURLPath {
+		h.handleSearch(w, r, user)
+	} else if reqPath == common.TagsURLPath {
+		h.handleTags(w, r, user)
+	} else if reqPath == common.TokensURLPath {
+		h.handleTokens(w, r, user)
+	} else if reqPath == common.ReprocessURLPath {
+		h.handleReprocess(w, r, user)
+	} else if reqPath == common.TrashURLPath {
+		h.handleTrash(w, r, user)
+	} else if reqPath == common.SessionsURLPath {
+		h.handleSessions(w, r, user, sess)
+	} else if reqPath == common.MetricsURLPath && user.Id == common.ConfigUserId {
+		expvar.Handler().ServeHTTP(w, r)
 	} else if strings.HasPrefix(reqPath, common.PagesURLPath+"/") {
-		h.pageHandler.ServeHTTP(w, r)
+		h.servePage(w, r, user, reqPath[len(common.PagesURLPath)+1:])
 	} else {
 		http.Error(w, "Bogus request", http.StatusBadRequest)
 	}
 }
 
+// pageIDRegexp matches valid page IDs.
+var pageIDRegexp = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// pageCSP is the Content-Security-Policy header value used for saved pages.
+const pageCSP = "script-src 'none'; object-src 'none'; base-uri 'none'; form-action 'self'"
+
+// servePage serves a file from one of user's page directories.
+// p contains the portion of the request path after common.PagesURLPath.
+func (h handler) servePage(w http.ResponseWriter, r *http.Request, user *common.User, p string) {
+	// The config user's directory also contains other users' directories,
+	// so only allow access to page directories.
+	parts := strings.SplitN(p, "/", 2)
+	if !pageIDRegexp.MatchString(parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	// Saved pages and their images (including SVGs) come from other sites,
+	// so don't let them run scripts with access to the app's origin.
+	w.Header().Set("Content-Security-Policy", pageCSP)
+	// Insert the CSRF token into the page's forms.
+	if len(parts) == 2 && (parts[1] == "" || parts[1] == "index.html") {
+		fp := filepath.Join(h.cfg.GetUserPageDir(user), parts[0], "index.html")
+		b, err := ioutil.ReadFile(fp)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			h.cfg.Logger.Printf("Unable to read %v: %v\n", fp, err)
+			http.Error(w, "Unable to read page", http.StatusInternalServerError)
+			return
+		}
+		b = bytes.Replace(b, []byte(common.CSRFPlaceholder), []byte(getCSRFToken(r)), -1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Write(b)
+		return
+	}
+	http.StripPrefix(h.cfg.GetPath(common.PagesURLPath),
+		http.FileServer(http.Dir(h.cfg.GetUserPageDir(user)))).ServeHTTP(w, r)
+}
+
 func joinURLAndPath(url, path string) string {
 	// Can't use path.Join, as it changes e.g. "https://" to "https:/".
 	if strings.HasSuffix(url, "/") {
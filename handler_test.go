@@ -3,7 +3,20 @@
 
 package main
 
-import "testing"
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/derat/aread/common"
+	"golang.org/x/crypto/bcrypt"
+)
 
 func TestJoinURLAndPath(t *testing.T) {
 	for _, tc := range []struct {
@@ -22,3 +35,483 @@ func TestJoinURLAndPath(t *testing.T) {
 		}
 	}
 }
+
+// getTestCSRFToken returns the CSRF token for the session with the supplied ID.
+func getTestCSRFToken(sess string) string {
+	req := httptest.NewRequest("GET", "https://example.org/aread/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess})
+	return getCSRFToken(req)
+}
+
+func TestHandleTokens(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	if err := h.db.AddSession("sess", "127.0.0.1", "test", common.ConfigUserId); err != nil {
+		t.Fatal("AddSession failed: ", err)
+	}
+
+	doReq := func(method, body string) *httptest.ResponseRecorder {
+		if method == "POST" {
+			body += "&csrf=" + getTestCSRFToken("sess")
+		}
+		req := httptest.NewRequest(method, "https://example.org/aread/tokens", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "sess"})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := doReq("POST", "action=create&name=phone&scope=add&scope=kindle")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Creating token returned %v: %v", rec.Code, rec.Body.String())
+	}
+	toks, err := h.db.GetAllTokens(common.ConfigUserId)
+	if err != nil {
+		t.Fatal("GetAllTokens failed: ", err)
+	}
+	if len(toks) != 1 || toks[0].Name != "phone" ||
+		!reflect.DeepEqual(toks[0].Scopes, []string{common.ScopeAdd, common.ScopeKindle}) {
+		t.Fatalf("GetAllTokens returned %+v", toks)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "Kindle</a>") {
+		t.Error("Kindle bookmarklet not shown after creating token")
+	}
+
+	for _, body := range []string{
+		"action=create&name=&scope=add",
+		"action=create&name=foo",
+		"action=create&name=foo&scope=bogus",
+		"action=revoke&id=bogus",
+		"action=bogus",
+	} {
+		if rec := doReq("POST", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %q returned %v; want %v", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	if rec := doReq("POST", fmt.Sprintf("action=revoke&id=%d", toks[0].Id)); rec.Code != http.StatusFound {
+		t.Errorf("Revoking token returned %v", rec.Code)
+	}
+	if toks, err := h.db.GetAllTokens(common.ConfigUserId); err != nil {
+		t.Fatal("GetAllTokens failed: ", err)
+	} else if !toks[0].Revoked {
+		t.Error("Token not revoked")
+	}
+	if rec := doReq("GET", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Revoked") {
+		t.Errorf("GET returned %v without revoked token", rec.Code)
+	}
+}
+
+func TestHandler_UserIsolation(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := common.User{Username: "other"}
+	if err := h.db.AddUser(&other, string(hash)); err != nil {
+		t.Fatal("AddUser failed: ", err)
+	}
+	if err := h.db.AddPage(common.PageInfo{Id: "a1", UserId: common.ConfigUserId,
+		OriginalURL: "https://example.com/", Title: "Mine"}); err != nil {
+		t.Fatal("AddPage failed: ", err)
+	}
+
+	// Log in as the second user.
+	req := httptest.NewRequest("POST", "https://example.org/aread/auth", strings.NewReader("u=other&p=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusFound || len(cookies) != 1 {
+		t.Fatalf("Logging in returned %v with cookies %v", rec.Code, cookies)
+	}
+
+	doReq := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://example.org/aread/"+path, nil)
+		req.AddCookie(cookies[0])
+		req.Header.Set(csrfHeader, getTestCSRFToken(cookies[0].Value))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := doReq("GET", ""); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "Mine") {
+		t.Errorf("List returned %v with other user's page", rec.Code)
+	}
+	if rec := doReq("GET", "api/v1/pages/a1"); rec.Code != http.StatusNotFound {
+		t.Errorf("Getting other user's page via API returned %v; want %v", rec.Code, http.StatusNotFound)
+	}
+	if rec := doReq("DELETE", "api/v1/pages/a1"); rec.Code != http.StatusNotFound {
+		t.Errorf("Deleting other user's page via API returned %v; want %v", rec.Code, http.StatusNotFound)
+	}
+	if rec := doReq("GET", "pages/users/"); rec.Code != http.StatusNotFound {
+		t.Errorf("Getting users dir returned %v; want %v", rec.Code, http.StatusNotFound)
+	}
+
+	// Disabled users shouldn't be able to log in.
+	if err := h.db.SetUserDisabled(other.Id, true); err != nil {
+		t.Fatal("SetUserDisabled failed: ", err)
+	}
+	req = httptest.NewRequest("POST", "https://example.org/aread/auth", strings.NewReader("u=other&p=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if len(rec.Result().Cookies()) != 0 {
+		t.Error("Disabled user was able to log in")
+	}
+}
+
+func TestHandleAuth_HashedPassword(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.cfg.Password = string(hash)
+
+	for _, tc := range []struct {
+		body string
+		ok   bool
+	}{
+		{"u=user&p=secret", true},
+		{"u=user&p=" + string(hash), false},
+		{"u=other&p=secret", false},
+	} {
+		req := httptest.NewRequest("POST", "https://example.org/aread/auth", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		cookies := rec.Result().Cookies()
+		if ok := len(cookies) == 1; ok != tc.ok {
+			t.Errorf("POST %q set cookies %v; want success %v", tc.body, cookies, tc.ok)
+		} else if ok && len(cookies[0].Value) < 40 {
+			t.Errorf("POST %q set short session ID %q", tc.body, cookies[0].Value)
+		}
+	}
+}
+
+func TestHandleSessions(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	for _, id := range []string{"sess1", "sess2"} {
+		if err := h.db.AddSession(id, "127.0.0.1", "agent-"+id, common.ConfigUserId); err != nil {
+			t.Fatal("AddSession failed: ", err)
+		}
+	}
+
+	doReq := func(method, path, sess, body string) *httptest.ResponseRecorder {
+		if method == "POST" {
+			body += "&csrf=" + getTestCSRFToken(sess)
+		}
+		req := httptest.NewRequest(method, "https://example.org/aread/"+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := doReq("GET", "sessions", "sess1", "")
+	if body := rec.Body.String(); rec.Code != http.StatusOK ||
+		!strings.Contains(body, "agent-sess1") || !strings.Contains(body, "agent-sess2") {
+		t.Fatalf("GET returned %v: %v", rec.Code, body)
+	}
+
+	// Revoke the second session using the first one.
+	sessions, err := h.db.GetSessions(common.ConfigUserId)
+	if err != nil {
+		t.Fatal("GetSessions failed: ", err)
+	}
+	var id int64
+	for _, s := range sessions {
+		if s.UserAgent == "agent-sess2" {
+			id = s.Id
+		}
+	}
+	if rec := doReq("POST", "sessions", "sess1", fmt.Sprintf("action=revoke&id=%d", id)); rec.Code != http.StatusFound {
+		t.Errorf("Revoking session returned %v", rec.Code)
+	}
+	if rec := doReq("GET", "", "sess2", ""); rec.Code != http.StatusFound {
+		t.Errorf("GET with revoked session returned %v; want %v", rec.Code, http.StatusFound)
+	}
+
+	// Logging out should delete the first session.
+	if rec := doReq("POST", "logout", "sess1", ""); rec.Code != http.StatusFound {
+		t.Errorf("Logging out returned %v", rec.Code)
+	} else if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("Logging out set cookies %v", cookies)
+	}
+	if rec := doReq("GET", "", "sess1", ""); rec.Code != http.StatusFound {
+		t.Errorf("GET after logging out returned %v; want %v", rec.Code, http.StatusFound)
+	}
+}
+
+func TestHandleAuth_Lockout(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	doReq := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "https://example.org/aread/"+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < ipFreeFailures; i++ {
+		if rec := doReq("add", "u=https://example.com/&t=bogus"); rec.Code != http.StatusForbidden {
+			t.Fatalf("Add with bad token returned %v; want %v", rec.Code, http.StatusForbidden)
+		}
+	}
+	// The correct password should be rejected while the client is locked out.
+	if rec := doReq("auth", "u=user&p=pass"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Auth while locked out returned %v; want %v", rec.Code, http.StatusTooManyRequests)
+	} else if rec.Header().Get("Retry-After") == "" {
+		t.Error("Auth while locked out didn't set Retry-After")
+	}
+	if rec := doReq("api/v1/pages", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("API request while locked out returned %v; want %v", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestHandleAuth_TokenClearsFailures(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	secret, err := h.db.AddToken(common.ConfigUserId, "test", []string{common.ScopeRead})
+	if err != nil {
+		t.Fatal("AddToken failed: ", err)
+	}
+
+	doReq := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.org/aread/api/v1/pages", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	// A successful request between failures should keep the client from being locked out.
+	for i := 0; i < 2; i++ {
+		for j := 0; j < ipFreeFailures-1; j++ {
+			if rec := doReq("bogus"); rec.Code != http.StatusUnauthorized {
+				t.Fatalf("Request with bad token returned %v; want %v", rec.Code, http.StatusUnauthorized)
+			}
+		}
+		if rec := doReq(secret); rec.Code != http.StatusOK {
+			t.Fatalf("Request with good token returned %v; want %v", rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestHandleAdd_TokenWithSession(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	if err := h.db.AddSession("sess", "127.0.0.1", "test", common.ConfigUserId); err != nil {
+		t.Fatal("AddSession failed: ", err)
+	}
+	secret := newTestToken(t, h, common.ScopeAdd, common.ScopeKindle)
+
+	// Bookmarklets send the session cookie along with the token, but the token
+	// should still be used to queue the page immediately.
+	req := httptest.NewRequest("GET", "https://example.org/aread/add?u=https://example.com/&k=1&t="+secret, nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "sess"})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Errorf("GET add returned %v; want %v", rec.Code, http.StatusFound)
+	}
+	if jobs, err := h.db.GetAllJobs(common.ConfigUserId); err != nil {
+		t.Fatal("GetAllJobs failed: ", err)
+	} else if len(jobs) != 1 || jobs[0].URL != "https://example.com/" || !jobs[0].Kindle {
+		t.Errorf("GET add queued %+v; want single Kindle job", jobs)
+	}
+}
+
+func TestHandler_CSRF(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	if err := h.db.AddSession("sess", "127.0.0.1", "test", common.ConfigUserId); err != nil {
+		t.Fatal("AddSession failed: ", err)
+	}
+	const id = "0123456789abcdef0123456789abcdef01234567"
+	if err := h.db.AddPage(common.PageInfo{Id: id, UserId: common.ConfigUserId,
+		OriginalURL: "https://example.com/", Title: "Page"}); err != nil {
+		t.Fatal("AddPage failed: ", err)
+	}
+	csrf := getTestCSRFToken("sess")
+
+	doReq := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://example.org/aread/"+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "sess"})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	isArchived := func() bool {
+		pi, err := h.db.GetPage(id)
+		if err != nil {
+			t.Fatal("GetPage failed: ", err)
+		}
+		return pi.Archived
+	}
+
+	// GET requests should only display a confirmation form.
+	if rec := doReq("GET", "archive?i="+id, ""); rec.Code != http.StatusOK ||
+		!strings.Contains(rec.Body.String(), csrf) {
+		t.Errorf("GET archive returned %v without CSRF token", rec.Code)
+	} else if isArchived() {
+		t.Error("GET archive archived page")
+	}
+	for _, body := range []string{"i=" + id, "i=" + id + "&csrf=bogus"} {
+		if rec := doReq("POST", "archive", body); rec.Code != http.StatusForbidden {
+			t.Errorf("POST %q returned %v; want %v", body, rec.Code, http.StatusForbidden)
+		} else if isArchived() {
+			t.Errorf("POST %q archived page", body)
+		}
+	}
+	if rec := doReq("POST", "archive", "i="+id+"&csrf="+csrf); rec.Code != http.StatusFound {
+		t.Errorf("POST with CSRF token returned %v; want %v", rec.Code, http.StatusFound)
+	} else if !isArchived() {
+		t.Error("POST with CSRF token didn't archive page")
+	}
+
+	// Adding via a session requires POST too.
+	if rec := doReq("GET", "add?u=https://example.net/", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET add returned %v", rec.Code)
+	} else if jobs, err := h.db.GetAllJobs(common.ConfigUserId); err != nil {
+		t.Error("GetAllJobs failed: ", err)
+	} else if len(jobs) != 0 {
+		t.Errorf("GET add queued %+v", jobs)
+	}
+
+	// The token should be inserted into saved pages when they're served.
+	dir := filepath.Join(h.cfg.PageDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"),
+		[]byte(`<input name="csrf" value="`+common.CSRFPlaceholder+`">`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doReq("GET", "pages/"+id+"/", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET page returned %v", rec.Code)
+	} else if body := rec.Body.String(); body != `<input name="csrf" value="`+csrf+`">` {
+		t.Errorf("GET page returned %q", body)
+	} else if csp := rec.Header().Get("Content-Security-Policy"); csp != pageCSP {
+		t.Errorf("GET page returned CSP %q; want %q", csp, pageCSP)
+	}
+}
+
+func TestGetSafeRedirect(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	const list = "/aread"
+	for _, tc := range []struct {
+		target string
+		want   string
+	}{
+		{"", list},
+		{"/aread", "/aread"},
+		{"/aread/", "/aread/"},
+		{"/aread?a=1&tag=foo", "/aread?a=1&tag=foo"},
+		{"/aread/pages/0123/", "/aread/pages/0123/"},
+		{"/aread/pages/0123/#end", "/aread/pages/0123/#end"},
+		{"/aread/./pages//0123/", "/aread/pages/0123/"},
+		{"/aread/%2F%2Fevil.com", "/aread/evil.com"},
+		{"/other", list},
+		{"/areadx", list},
+		{"/aread/../evil", list},
+		{"/aread/%2e%2e/evil", list},
+		{"aread", list},
+		{"https://evil.com/aread", list},
+		{"HTTPS://evil.com/aread", list},
+		{"https:/aread", list},
+		{"javascript:alert(1)", list},
+		{"//evil.com/aread", list},
+		{"///evil.com/aread", list},
+		{"/\\evil.com/aread", list},
+		{"/aread\\..\\..\\evil.com", list},
+		{"/\t/evil.com/aread", list},
+		{"/aread\n/evil", list},
+		{"/%2F%2Fevil.com", list},
+		{"/%5Cevil.com", list},
+		{"%2F%2Fevil.com/aread", list},
+		{"/aread@evil.com", list},
+		{" /aread", list},
+	} {
+		if got := h.getSafeRedirect(tc.target); got != tc.want {
+			t.Errorf("getSafeRedirect(%q) = %q; want %q", tc.target, got, tc.want)
+		}
+	}
+	// Logging in should also use a safe redirect.
+	req := httptest.NewRequest("POST", "https://example.org/aread/auth",
+		strings.NewReader("u=user&p=pass&r=https://evil.com/"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusFound || loc != list {
+		t.Errorf("Logging in returned %v with location %q; want %v with %q", rec.Code, loc, http.StatusFound, list)
+	}
+}
+
+func TestHandleTrash(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	if err := h.db.AddSession("sess", "127.0.0.1", "test", common.ConfigUserId); err != nil {
+		t.Fatal("AddSession failed: ", err)
+	}
+	const id = "0123456789abcdef0123456789abcdef01234567"
+	if err := h.db.AddPage(common.PageInfo{Id: id, UserId: common.ConfigUserId,
+		OriginalURL: "https://example.com/", Title: "Doomed page"}); err != nil {
+		t.Fatal("AddPage failed: ", err)
+	}
+	dir := filepath.Join(h.cfg.PageDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	csrf := getTestCSRFToken("sess")
+
+	doReq := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://example.org/aread/"+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "sess"})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	listed := func(path string) bool {
+		rec := doReq("GET", path, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %q returned %v", path, rec.Code)
+		}
+		return strings.Contains(rec.Body.String(), "Doomed page")
+	}
+
+	if rec := doReq("POST", "trash", "action=trash&i="+id+"&csrf="+csrf+"&r=/aread/"); rec.Code != http.StatusFound {
+		t.Fatalf("Trashing page returned %v", rec.Code)
+	} else if loc := rec.Header().Get("Location"); loc != "/aread/" {
+		t.Errorf("Trashing page redirected to %q", loc)
+	}
+	if listed("") || !listed("trash") {
+		t.Error("Trashed page not moved from list to trash")
+	}
+	if rec := doReq("POST", "trash", "action=restore&i="+id+"&csrf="+csrf); rec.Code != http.StatusFound {
+		t.Fatalf("Restoring page returned %v", rec.Code)
+	}
+	if !listed("") || listed("trash") {
+		t.Error("Restored page not moved from trash to list")
+	}
+	if rec := doReq("POST", "trash", "action=delete&i="+id+"&csrf="+csrf); rec.Code != http.StatusFound {
+		t.Fatalf("Deleting page returned %v", rec.Code)
+	}
+	if _, err := h.db.GetPage(id); err == nil {
+		t.Error("Deleted page still in database")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Deleted page's directory still exists: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// ipFreeFailures is the number of failed attempts that a single client
+	// can make before being locked out.
+	ipFreeFailures = 5
+	// ipBaseLockout is the initial lockout duration for a single client.
+	// It doubles with each additional failure.
+	ipBaseLockout = 30 * time.Second
+	// ipMaxLockout is the maximum lockout duration for a single client.
+	ipMaxLockout = time.Hour
+
+	// globalFreeFailures is the number of failed attempts across all clients
+	// before all clients are locked out.
+	globalFreeFailures = 50
+	// globalBaseLockout is the initial lockout duration for all clients.
+	globalBaseLockout = 10 * time.Second
+	// globalMaxLockout is the maximum lockout duration for all clients.
+	globalMaxLockout = 5 * time.Minute
+
+	// failureMemory is the amount of time after the last failed attempt
+	// at which a client's (or the global) failure count is reset.
+	failureMemory = time.Hour
+	// maxTrackedClients is the number of clients above which stale entries are discarded.
+	maxTrackedClients = 1000
+)
+
+// Metrics exported via expvar.
+var (
+	loginFailures          = expvar.NewInt("loginFailures")
+	loginRejected          = expvar.NewInt("loginRejected")
+	loginLockedClients     = expvar.NewInt("loginLockedClients")
+	loginGlobalLockedUntil = expvar.NewInt("loginGlobalLockedUntil")
+)
+
+// failureState tracks failed attempts by a client or by all clients.
+type failureState struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// addFailure records a failure at now. If the number of failures has reached free,
+// a lockout that starts at base and doubles with each failure (up to max) is
+// started and its duration is returned.
+func (fs *failureState) addFailure(now time.Time, free int, base, max time.Duration) time.Duration {
+	if now.Sub(fs.lastFailure) > failureMemory {
+		fs.failures = 0
+	}
+	fs.failures++
+	fs.lastFailure = now
+	if fs.failures < free {
+		return 0
+	}
+	d := base
+	for i := free; i < fs.failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	fs.lockedUntil = now.Add(d)
+	return d
+}
+
+// loginLimiter limits the rate at which clients can make failed attempts to
+// authenticate using passwords or tokens.
+type loginLimiter struct {
+	logger *log.Logger
+	now    func() time.Time // overridden in tests
+
+	mu      sync.Mutex
+	clients map[string]*failureState // keyed by IP address
+	global  failureState
+}
+
+func newLoginLimiter(logger *log.Logger) *loginLimiter {
+	return &loginLimiter{
+		logger:  logger,
+		now:     time.Now,
+		clients: make(map[string]*failureState),
+	}
+}
+
+// getClientIP returns the IP address portion of addr, an http.Request.RemoteAddr value.
+func getClientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// check returns the remaining time for which the client at addr is locked out.
+// 0 is returned if the client may attempt to authenticate.
+func (l *loginLimiter) check(addr string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	wait := l.global.lockedUntil.Sub(now)
+	if fs := l.clients[getClientIP(addr)]; fs != nil {
+		if d := fs.lockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return 0
+	}
+	loginRejected.Add(1)
+	return wait
+}
+
+// fail records a failed attempt by the client at addr.
+func (l *loginLimiter) fail(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	ip := getClientIP(addr)
+	fs := l.clients[ip]
+	if fs == nil {
+		if len(l.clients) >= maxTrackedClients {
+			l.prune(now)
+		}
+		fs = &failureState{}
+		l.clients[ip] = fs
+	}
+	loginFailures.Add(1)
+	if d := fs.addFailure(now, ipFreeFailures, ipBaseLockout, ipMaxLockout); d > 0 {
+		l.logger.Printf("Locking out %v for %v after %d failed attempt(s)\n", ip, d, fs.failures)
+	}
+	if d := l.global.addFailure(now, globalFreeFailures, globalBaseLockout, globalMaxLockout); d > 0 {
+		l.logger.Printf("Locking out all clients for %v after %d failed attempt(s)\n", d, l.global.failures)
+		loginGlobalLockedUntil.Set(l.global.lockedUntil.Unix())
+	}
+	l.updateLockedClients(now)
+}
+
+// succeed records a successful attempt by the client at addr, clearing its failures.
+func (l *loginLimiter) succeed(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, getClientIP(addr))
+	l.updateLockedClients(l.now())
+}
+
+// prune discards clients whose failures have been forgotten.
+// l.mu must be held.
+func (l *loginLimiter) prune(now time.Time) {
+	for ip, fs := range l.clients {
+		if now.Sub(fs.lastFailure) > failureMemory && !now.Before(fs.lockedUntil) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// updateLockedClients updates the loginLockedClients metric.
+// l.mu must be held.
+func (l *loginLimiter) updateLockedClients(now time.Time) {
+	var n int64
+	for _, fs := range l.clients {
+		if now.Before(fs.lockedUntil) {
+			n++
+		}
+	}
+	loginLockedClients.Set(n)
+}
@@ -0,0 +1,65 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLoginLimiter(log.New(ioutil.Discard, "", 0))
+	l.now = func() time.Time { return now }
+
+	const (
+		addr  = "1.2.3.4:5678"
+		other = "5.6.7.8:1234"
+	)
+	for i := 0; i < ipFreeFailures; i++ {
+		if d := l.check(addr); d != 0 {
+			t.Fatalf("check(%q) after %d failure(s) = %v; want 0", addr, i, d)
+		}
+		l.fail(addr)
+	}
+
+	// Each subsequent failure should double the lockout.
+	if d := l.check(addr); d != ipBaseLockout {
+		t.Errorf("check(%q) = %v; want %v", addr, d, ipBaseLockout)
+	}
+	if d := l.check(other); d != 0 {
+		t.Errorf("check(%q) = %v; want 0", other, d)
+	}
+	now = now.Add(ipBaseLockout)
+	if d := l.check(addr); d != 0 {
+		t.Errorf("check(%q) after lockout = %v; want 0", addr, d)
+	}
+	l.fail(addr)
+	if d := l.check(addr); d != 2*ipBaseLockout {
+		t.Errorf("check(%q) = %v; want %v", addr, d, 2*ipBaseLockout)
+	}
+
+	// Success should clear the client's failures.
+	now = now.Add(2 * ipBaseLockout)
+	l.succeed(addr)
+	l.fail(addr)
+	if d := l.check(addr); d != 0 {
+		t.Errorf("check(%q) after success = %v; want 0", addr, d)
+	}
+
+	// Enough failures from different clients should lock out everyone.
+	for i := 0; i < globalFreeFailures; i++ {
+		l.fail("10.0.0.1")
+		now = now.Add(time.Second)
+	}
+	if d := l.check(other); d <= 0 {
+		t.Errorf("check(%q) = %v after global failures; want positive", other, d)
+	}
+	now = now.Add(globalMaxLockout + ipMaxLockout)
+	if d := l.check(other); d != 0 {
+		t.Errorf("check(%q) = %v after global lockout; want 0", other, d)
+	}
+}
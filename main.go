@@ -11,6 +11,7 @@ import (
 	"net/http/fcgi"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/derat/aread/common"
 	"github.com/derat/aread/db"
@@ -18,17 +19,22 @@ import (
 )
 
 func main() {
-	var configPath string
+	var configPath, listenAddr, certFile, keyFile string
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [option]... <url>\n\nOptions:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [option]... <url>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [option]... <command> [arg]...\n\nOptions:\n", os.Args[0])
 		flag.PrintDefaults()
+		printCommands()
 	}
 	flag.StringVar(&configPath, "config", filepath.Join(os.Getenv("HOME"), ".aread.json"), "Path to JSON config file")
+	flag.StringVar(&listenAddr, "listen", "", "Serve HTTP at this address (e.g. \":8080\") instead of FastCGI")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate file for -listen")
+	flag.StringVar(&keyFile, "key", "", "TLS private key file for -listen")
 	flag.Parse()
 
 	var logger *log.Logger
 	daemon := len(flag.Args()) == 0
-	if daemon {
+	if daemon && listenAddr == "" {
 		var err error
 		if logger, err = syslog.NewLogger(syslog.LOG_INFO|syslog.LOG_DAEMON, log.LstdFlags); err != nil {
 			log.Fatalf("Unable to connect to syslog: %v\n", err)
@@ -46,6 +52,13 @@ func main() {
 		cfg.Verbose = true
 	}
 
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		if err := cmd.run(cfg, flag.Args()[1:]); err != nil {
+			logger.Fatalf("%v failed: %v\n", flag.Arg(0), err)
+		}
+		return
+	}
+
 	p := proc.New(cfg)
 
 	if daemon {
@@ -53,8 +66,34 @@ func main() {
 		if err != nil {
 			logger.Fatalln(err)
 		}
-		logger.Println("Accepting connections")
-		fcgi.Serve(nil, newHandler(cfg, p, db))
+		if err := db.SetConfigUsername(cfg.Username); err != nil {
+			logger.Fatalln(err)
+		}
+		if !db.SearchAvailable() {
+			logger.Println("Full-text search is unavailable; rebuild with -tags sqlite_fts5 and run the reindex command")
+		}
+		q := proc.NewQueue(cfg, p, db)
+		if err := q.Start(); err != nil {
+			logger.Fatalln(err)
+		}
+		stopPruning := make(chan struct{})
+		go pruneSessions(cfg, db, stopPruning)
+		h, err := newProxyHandler(newHandler(cfg, p, db, q), cfg.TrustedProxies)
+		if err != nil {
+			logger.Fatalf("Bad trusted proxies: %v\n", err)
+		}
+		if listenAddr != "" {
+			if err := serveHTTP(cfg, h, listenAddr, certFile, keyFile); err != nil {
+				logger.Fatalln(err)
+			}
+			close(stopPruning)
+			q.Stop()
+			db.Close()
+			logger.Println("Exiting")
+		} else {
+			logger.Println("Accepting connections")
+			fcgi.Serve(nil, h)
+		}
 	} else {
 		for i := range flag.Args() {
 			url := flag.Args()[i]
@@ -66,3 +105,23 @@ func main() {
 		}
 	}
 }
+
+// sessionPruneInterval is the frequency with which expired sessions are deleted.
+const sessionPruneInterval = time.Hour
+
+// pruneSessions periodically deletes expired sessions from d until stop is closed.
+func pruneSessions(cfg *common.Config, d *db.Database, stop <-chan struct{}) {
+	for {
+		idle, max := cfg.GetSessionLimits()
+		if n, err := d.PruneSessions(time.Now(), idle, max); err != nil {
+			cfg.Logger.Printf("Unable to prune sessions: %v\n", err)
+		} else if n > 0 {
+			cfg.Logger.Printf("Pruned %v expired session(s)\n", n)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(sessionPruneInterval):
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// einkLevels is the number of gray levels displayed by e-ink screens.
+	einkLevels = 16
+	// einkLevelStep is the difference between adjacent gray levels.
+	einkLevelStep = 255 / (einkLevels - 1)
+	// contrastClip is the fraction of pixels at each end of the histogram that
+	// are clipped by stretchContrast.
+	contrastClip = 0.005
+	// minContrastRange is the minimum range of gray values that stretchContrast
+	// will stretch. Images with less variation (e.g. solid colors) are left alone.
+	minContrastRange = 32
+)
+
+// einkPalette contains the gray levels displayed by e-ink screens.
+var einkPalette color.Palette
+
+func init() {
+	for i := 0; i < einkLevels; i++ {
+		v := uint8(i * einkLevelStep)
+		einkPalette = append(einkPalette, color.Gray{v})
+	}
+}
+
+// makeEInkImage returns a copy of img that's optimized for e-ink screens:
+// it's flattened onto a white background, converted to grayscale, has its
+// contrast stretched, and is reduced to einkLevels gray levels, using
+// Floyd-Steinberg dithering if dither is true.
+func makeEInkImage(img image.Image, dither bool) *image.Gray {
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Over)
+	stretchContrast(gray)
+	if dither {
+		ditherGray(gray)
+	} else {
+		for i, v := range gray.Pix {
+			gray.Pix[i] = quantizeGray(int(v))
+		}
+	}
+	return gray
+}
+
+// makeEInkPaletted converts gray, which should have been returned by makeEInkImage,
+// to a paletted image using einkPalette. PNG files containing paletted images with
+// 16 or fewer colors use 4 bits per pixel.
+func makeEInkPaletted(gray *image.Gray) *image.Paletted {
+	b := gray.Bounds()
+	p := image.NewPaletted(b, einkPalette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p.SetColorIndex(x, y, gray.GrayAt(x, y).Y/einkLevelStep)
+		}
+	}
+	return p
+}
+
+// stretchContrast linearly stretches the gray values in img so the darkest and
+// lightest pixels (ignoring contrastClip outliers at each end) become black and white.
+func stretchContrast(img *image.Gray) {
+	var hist [256]int
+	for _, v := range img.Pix {
+		hist[v]++
+	}
+	clip := int(float64(len(img.Pix)) * contrastClip)
+	lo, hi := 0, 255
+	for n := 0; lo < 255 && n+hist[lo] <= clip; lo++ {
+		n += hist[lo]
+	}
+	for n := 0; hi > 0 && n+hist[hi] <= clip; hi-- {
+		n += hist[hi]
+	}
+	if hi-lo < minContrastRange || (lo == 0 && hi == 255) {
+		return
+	}
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = clampGray((i - lo) * 255 / (hi - lo))
+	}
+	for i, v := range img.Pix {
+		img.Pix[i] = lut[v]
+	}
+}
+
+// ditherGray reduces img to einkLevels gray levels using Floyd-Steinberg dithering.
+func ditherGray(img *image.Gray) {
+	b := img.Bounds()
+	w := b.Dx()
+	// Accumulated error for the current and next rows, with an extra column
+	// on each side to avoid bounds checks.
+	cur, next := make([]int, w+2), make([]int, w+2)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < w; x++ {
+			i := y*img.Stride + x
+			old := int(img.Pix[i]) + cur[x+1]/16
+			nv := quantizeGray(old)
+			img.Pix[i] = nv
+			e := old - int(nv)
+			cur[x+2] += e * 7
+			next[x] += e * 3
+			next[x+1] += e * 5
+			next[x+2] += e
+		}
+		cur, next = next, cur
+		for i := range next {
+			next[i] = 0
+		}
+	}
+}
+
+// quantizeGray returns the einkPalette gray level closest to v.
+func quantizeGray(v int) uint8 {
+	v = int(clampGray(v))
+	return uint8((v + einkLevelStep/2) / einkLevelStep * einkLevelStep)
+}
+
+// clampGray clamps v to [0, 255].
+func clampGray(v int) uint8 {
+	if v < 0 {
+		return 0
+	} else if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
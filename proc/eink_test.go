@@ -0,0 +1,98 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestQuantizeGray(t *testing.T) {
+	for _, tc := range []struct {
+		in   int
+		want uint8
+	}{
+		{-20, 0},
+		{0, 0},
+		{8, 0},
+		{9, 17},
+		{128, 136},
+		{250, 255},
+		{300, 255},
+	} {
+		if got := quantizeGray(tc.in); got != tc.want {
+			t.Errorf("quantizeGray(%v) = %v; want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestStretchContrast(t *testing.T) {
+	// newGray returns a 1x256 image with the supplied values.
+	newGray := func(vals ...uint8) *image.Gray {
+		img := image.NewGray(image.Rect(0, 0, len(vals), 1))
+		copy(img.Pix, vals)
+		return img
+	}
+	for _, tc := range []struct {
+		in, want []uint8
+	}{
+		{[]uint8{64, 128, 192}, []uint8{0, 127, 255}},
+		{[]uint8{0, 128, 255}, []uint8{0, 128, 255}},     // already full range
+		{[]uint8{100, 110, 120}, []uint8{100, 110, 120}}, // too little variation
+	} {
+		img := newGray(tc.in...)
+		stretchContrast(img)
+		if string(img.Pix) != string(tc.want) {
+			t.Errorf("stretchContrast(%v) produced %v; want %v", tc.in, img.Pix, tc.want)
+		}
+	}
+}
+
+func TestMakeEInkImage(t *testing.T) {
+	// Create a horizontal gradient from dark red to light blue with a transparent column.
+	const w, h = 256, 16
+	img := image.NewNRGBA(image.Rect(10, 10, 10+w, 10+h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(32 + x*3/4)
+			img.Set(10+x, 10+y, color.NRGBA{v, 0, v / 2, 255})
+		}
+		img.Set(10, 10+y, color.Transparent)
+	}
+
+	for _, dither := range []bool{false, true} {
+		gray := makeEInkImage(img, dither)
+		if eb := image.Rect(0, 0, w, h); gray.Bounds() != eb {
+			t.Errorf("makeEInkImage(..., %v) returned bounds %v; want %v", dither, gray.Bounds(), eb)
+			continue
+		}
+		levels := make(map[uint8]bool)
+		for _, v := range gray.Pix {
+			if v%einkLevelStep != 0 {
+				t.Errorf("makeEInkImage(..., %v) produced non-palette level %v", dither, v)
+				break
+			}
+			levels[v] = true
+		}
+		if len(levels) < einkLevels/2 {
+			t.Errorf("makeEInkImage(..., %v) only produced %v level(s)", dither, len(levels))
+		}
+		if v := gray.GrayAt(0, 0).Y; v != 255 {
+			t.Errorf("makeEInkImage(..., %v) produced %v for transparent pixel; want 255", dither, v)
+		}
+		if v := gray.GrayAt(1, 0).Y; v != 0 {
+			t.Errorf("makeEInkImage(..., %v) produced %v for darkest pixel; want 0", dither, v)
+		}
+
+		p := makeEInkPaletted(gray)
+		for i := range gray.Pix {
+			x, y := i%w, i/w
+			if got, want := p.At(x, y), gray.At(x, y); got != want {
+				t.Errorf("makeEInkPaletted produced %v at (%v, %v); want %v", got, x, y, want)
+				break
+			}
+		}
+	}
+}
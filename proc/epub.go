@@ -0,0 +1,353 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/derat/aread/common"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	epubContentFile = "content.xhtml"
+	epubMIMEType    = "application/epub+zip"
+)
+
+// Media types of files that can be included in EPUBs, keyed by extension.
+var epubMediaTypes = map[string]string{
+	".bmp":  "image/bmp",
+	".css":  "text/css",
+	".gif":  "image/gif",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+}
+
+// epubItem describes a file in an EPUB's manifest.
+type epubItem struct {
+	ID        string
+	Href      string
+	MediaType string
+}
+
+// epubData is used to fill epubTemplates.
+type epubData struct {
+	Identifier string
+	Title      string
+	Author     string
+	PubDate    string
+	SourceURL  string
+	Language   string
+	Modified   string
+	Items      []epubItem
+}
+
+// epubTemplates contains templates for the EPUB's fixed files, keyed by path
+// within the archive.
+var epubTemplates = map[string]string{
+	"META-INF/container.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`,
+	"OEBPS/content.opf": `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid" xml:lang="{{x .Language}}">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">{{x .Identifier}}</dc:identifier>
+    <dc:title>{{x .Title}}</dc:title>
+    <dc:language>{{x .Language}}</dc:language>
+    {{- if .Author}}
+    <dc:creator>{{x .Author}}</dc:creator>
+    {{- end}}
+    {{- if .PubDate}}
+    <dc:date>{{x .PubDate}}</dc:date>
+    {{- end}}
+    {{- if .SourceURL}}
+    <dc:source>{{x .SourceURL}}</dc:source>
+    {{- end}}
+    <meta property="dcterms:modified">{{.Modified}}</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="content" href="` + epubContentFile + `" media-type="application/xhtml+xml"/>
+    {{- range .Items}}
+    <item id="{{.ID}}" href="{{x .Href}}" media-type="{{.MediaType}}"/>
+    {{- end}}
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="content"/>
+  </spine>
+</package>
+`,
+	"OEBPS/toc.ncx": `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="{{x .Identifier}}"/>
+    <meta name="dtb:depth" content="1"/>
+    <meta name="dtb:totalPageCount" content="0"/>
+    <meta name="dtb:maxPageNumber" content="0"/>
+  </head>
+  <docTitle><text>{{x .Title}}</text></docTitle>
+  {{- if .Author}}
+  <docAuthor><text>{{x .Author}}</text></docAuthor>
+  {{- end}}
+  <navMap>
+    <navPoint id="content" playOrder="1">
+      <navLabel><text>{{x .Title}}</text></navLabel>
+      <content src="` + epubContentFile + `"/>
+    </navPoint>
+  </navMap>
+</ncx>
+`,
+	"OEBPS/nav.xhtml": `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+  <head><title>{{x .Title}}</title></head>
+  <body>
+    <nav epub:type="toc">
+      <ol><li><a href="` + epubContentFile + `">{{x .Title}}</a></li></ol>
+    </nav>
+  </body>
+</html>
+`,
+}
+
+// escapeXML returns s with XML special characters escaped.
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// rawTextElements contains elements whose text is written unescaped by html.Render.
+// They're dropped from EPUB content since they'd produce malformed XML.
+var rawTextElements = map[string]bool{
+	"iframe":    true,
+	"noembed":   true,
+	"noframes":  true,
+	"noscript":  true,
+	"plaintext": true,
+	"script":    true,
+	"style":     true,
+	"xmp":       true,
+}
+
+// isXMLName returns true if s can be used as an element or attribute name in
+// XML without a namespace prefix.
+func isXMLName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if unicode.IsLetter(r) || r == '_' || (i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.')) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// stripInvalidXMLChars returns s without characters that aren't allowed in XML 1.0.
+func stripInvalidXMLChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r <= 0xd7ff) ||
+			(r >= 0xe000 && r <= 0xfffd) || r >= 0x10000 {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// sanitizeXHTML modifies n's descendants so that html.Render will produce
+// well-formed XML: comments and raw text elements are dropped, elements with
+// invalid names are replaced by their children, and invalid, namespaced,
+// duplicate, and xmlns attributes are removed.
+func sanitizeXHTML(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch {
+		case c.Type == html.CommentNode || (c.Type == html.ElementNode && rawTextElements[c.Data]):
+			n.RemoveChild(c)
+		case c.Type == html.ElementNode && !isXMLName(c.Data):
+			sanitizeXHTML(c)
+			for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+				c.RemoveChild(gc)
+				n.InsertBefore(gc, c)
+			}
+			n.RemoveChild(c)
+		case c.Type == html.ElementNode:
+			seen := make(map[string]bool)
+			attrs := c.Attr[:0]
+			for _, a := range c.Attr {
+				if (a.Namespace != "" && a.Namespace != "xml") || !isXMLName(a.Key) ||
+					a.Key == "xmlns" || seen[a.Namespace+":"+a.Key] {
+					continue
+				}
+				seen[a.Namespace+":"+a.Key] = true
+				a.Val = stripInvalidXMLChars(a.Val)
+				attrs = append(attrs, a)
+			}
+			c.Attr = attrs
+			sanitizeXHTML(c)
+		case c.Type == html.TextNode:
+			c.Data = stripInvalidXMLChars(c.Data)
+		}
+		c = next
+	}
+}
+
+// writeEPUB writes an EPUB 3 document to dest containing the HTML document in
+// dir named src, along with the local stylesheets and images that it uses.
+// Metadata is read from src's header as written by common.WriteHeader.
+func writeEPUB(dir, src, dest string) error {
+	f, err := os.Open(filepath.Join(dir, src))
+	if err != nil {
+		return err
+	}
+	doc, err := html.Parse(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	d := epubData{
+		Language: "en",
+		Modified: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	root := findElement(doc, atom.Html)
+	if root == nil {
+		return errors.New("no html element")
+	}
+	if lang := getNodeAttr(root, "lang"); lang != "" {
+		d.Language = lang
+	}
+	if t := findElement(doc, atom.Title); t != nil {
+		d.Title = getText(t)
+	}
+	d.Author = getMetaContent(doc, "DCTERMS.creator", "author")
+	d.PubDate = getMetaContent(doc, "DCTERMS.date")
+	d.SourceURL = getMetaContent(doc, "DCTERMS.source")
+	if d.SourceURL != "" {
+		d.Identifier = d.SourceURL
+	} else {
+		d.Identifier = "urn:sha1:" + common.SHA1String(d.Title)
+	}
+
+	// Find local files and drop references to anything that's missing.
+	seen := make(map[string]bool)
+	addItem := func(n *html.Node, attr string) bool {
+		fn := getNodeAttr(n, attr)
+		mt, ok := epubMediaTypes[strings.ToLower(filepath.Ext(fn))]
+		if !ok || fn != filepath.Base(fn) {
+			return false
+		}
+		if _, err := os.Stat(filepath.Join(dir, fn)); err != nil {
+			return false
+		}
+		if !seen[fn] {
+			seen[fn] = true
+			d.Items = append(d.Items, epubItem{fmt.Sprintf("item%d", len(d.Items)), fn, mt})
+		}
+		return true
+	}
+	for _, n := range findElements(doc, atom.Link) {
+		if strings.EqualFold(getNodeAttr(n, "rel"), "stylesheet") && addItem(n, "href") {
+			continue
+		}
+		n.Parent.RemoveChild(n)
+	}
+	for _, n := range findElements(doc, atom.Img) {
+		if !addItem(n, "src") {
+			n.Parent.RemoveChild(n)
+		}
+	}
+	sanitizeXHTML(doc)
+	root.Attr = append(root.Attr, html.Attribute{Key: "xmlns", Val: "http://www.w3.org/1999/xhtml"})
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(out)
+	if err := writeEPUBFiles(zw, dir, doc, &d); err != nil {
+		zw.Close()
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeEPUBFiles writes the EPUB's files to zw.
+func writeEPUBFiles(zw *zip.Writer, dir string, doc *html.Node, d *epubData) error {
+	// The mimetype file must come first and be uncompressed.
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, epubMIMEType); err != nil {
+		return err
+	}
+
+	fm := template.FuncMap{"x": escapeXML}
+	for _, p := range []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/toc.ncx", "OEBPS/nav.xhtml"} {
+		tmpl, err := template.New("").Funcs(fm).Parse(epubTemplates[p])
+		if err != nil {
+			return err
+		}
+		if w, err = zw.Create(p); err != nil {
+			return err
+		}
+		if err = tmpl.Execute(w, d); err != nil {
+			return fmt.Errorf("failed to write %v: %v", p, err)
+		}
+	}
+
+	if w, err = zw.Create("OEBPS/" + epubContentFile); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"); err != nil {
+		return err
+	}
+	if err := html.Render(w, doc); err != nil {
+		return err
+	}
+
+	for _, item := range d.Items {
+		if w, err = zw.Create("OEBPS/" + item.Href); err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, item.Href))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
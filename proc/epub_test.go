@@ -0,0 +1,125 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/derat/aread/common"
+)
+
+func TestWriteEPUB(t *testing.T) {
+	td, err := ioutil.TempDir("", "epub_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	cfg := &common.Config{BaseURL: "https://example.org/aread", Logger: log.New(os.Stderr, "", log.LstdFlags)}
+	var b bytes.Buffer
+	common.WriteHeader(&b, cfg, []string{"page.css"}, "Title & More", "icon.ico", common.DocInfo{
+		Author:    "Jane Doe",
+		PubDate:   "2020-03-04T05:06:07Z",
+		SourceURL: "https://www.example.com/article",
+	})
+	b.WriteString(`<body><p>Text&nbsp;here<br></p><img src="present.png"><img src="missing.png">
+<div @click="go()" x:foo="1" data-a:b="2" data-ok="3" class="a" class="b"><!-- a -- b -->
+<script>if (a < b && c) {}</script><style>p > a {}</style><noscript><p>No JS</p></noscript>
+<o:p>Word</o:p> markup&#11;</div></body></html>`)
+	for fn, data := range map[string]string{
+		kindleFile:    b.String(),
+		"page.css":    "body { margin: 0 }",
+		"present.png": "not really a png",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(td, fn), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dest := filepath.Join(td, epubFile)
+	if err := writeEPUB(td, kindleFile, dest); err != nil {
+		t.Fatal("writeEPUB failed: ", err)
+	}
+
+	zr, err := zip.OpenReader(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	files := make(map[string]string)
+	for i, f := range zr.File {
+		if i == 0 && (f.Name != "mimetype" || f.Method != zip.Store) {
+			t.Errorf("first file is %q with method %v; want uncompressed mimetype", f.Name, f.Method)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+
+	if got := files["mimetype"]; got != epubMIMEType {
+		t.Errorf("mimetype contains %q; want %q", got, epubMIMEType)
+	}
+	opf := files["OEBPS/content.opf"]
+	for _, s := range []string{
+		"<dc:title>Title &amp; More</dc:title>",
+		"<dc:creator>Jane Doe</dc:creator>",
+		"<dc:date>2020-03-04T05:06:07Z</dc:date>",
+		"<dc:source>https://www.example.com/article</dc:source>",
+		`href="page.css" media-type="text/css"`,
+		`href="present.png" media-type="image/png"`,
+	} {
+		if !strings.Contains(opf, s) {
+			t.Errorf("content.opf doesn't contain %q:\n%v", s, opf)
+		}
+	}
+	if strings.Contains(opf, "missing.png") {
+		t.Errorf("content.opf contains missing image:\n%v", opf)
+	}
+	for _, fn := range []string{"META-INF/container.xml", "OEBPS/toc.ncx", "OEBPS/nav.xhtml", "OEBPS/page.css", "OEBPS/present.png"} {
+		if _, ok := files[fn]; !ok {
+			t.Errorf("%v is missing", fn)
+		}
+	}
+	content := files["OEBPS/"+epubContentFile]
+	dec := xml.NewDecoder(strings.NewReader(content))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("content isn't well-formed XML: %v\n%v", err, content)
+		}
+	}
+	for _, s := range []string{`data-ok="3"`, `class="a"`, "Word markup"} {
+		if !strings.Contains(content, s) {
+			t.Errorf("content doesn't contain %q:\n%v", s, content)
+		}
+	}
+	for _, s := range []string{"<script", "<style", "No JS", "<!--", "@click", "foo", "data-a", `class="b"`} {
+		if strings.Contains(content, s) {
+			t.Errorf("content contains %q:\n%v", s, content)
+		}
+	}
+	if !strings.Contains(content, `xmlns="http://www.w3.org/1999/xhtml"`) ||
+		!strings.Contains(content, "<br/>") || strings.Contains(content, "missing.png") ||
+		strings.Contains(content, "icon.ico") {
+		t.Errorf("bad content:\n%v", content)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/derat/aread/common"
+	"golang.org/x/net/html"
+)
+
+// Article contains content extracted from a web page.
+type Article struct {
+	Error         bool   `json:"error"`
+	Message       string `json:"message"`
+	Content       string `json:"content"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	DatePublished string `json:"date_published"`
+	NextPageURL   string `json:"next_page_url"`
+	Excerpt       string `json:"excerpt"`
+	LeadImageURL  string `json:"lead_image_url"`
+	Language      string `json:"language"`
+	// URL is the URL against which relative URLs in Content should be resolved:
+	// the page's final URL after redirects, or the document's <base> URL.
+	// If empty, the requested URL is used.
+	URL string `json:"url"`
+}
+
+// Extractor extracts articles from web pages.
+type Extractor interface {
+	// Extract returns the article at pageURL.
+	Extract(pageURL string) (*Article, error)
+}
+
+// Extractor types used in Config.ExtractorsFile.
+const (
+	commandExtractorType  = "command"
+	selectorExtractorType = "selector"
+)
+
+// fetchFunc returns the body of the page at the supplied URL along with the URL
+// against which relative URLs in the body should be resolved.
+type fetchFunc func(pageURL string) (body []byte, baseURL string, err error)
+
+// mercuryExtractor runs mercury-parser, which downloads pages itself.
+type mercuryExtractor struct {
+	path string
+}
+
+func (e *mercuryExtractor) Extract(pageURL string) (*Article, error) {
+	b, err := exec.Command(e.path, pageURL).Output()
+	if err != nil {
+		return nil, fmt.Errorf("parser failed: %v", err)
+	}
+	var a Article
+	if err = json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal parser JSON: %v", err)
+	}
+	return &a, nil
+}
+
+// nativeExtractor uses the built-in Readability-style extractor.
+type nativeExtractor struct {
+	fetch fetchFunc
+}
+
+func (e *nativeExtractor) Extract(pageURL string) (*Article, error) {
+	b, baseURL, err := e.fetch(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	return nativeExtract(bytes.NewReader(b), baseURL)
+}
+
+// commandExtractor runs an external command that reads the page's HTML from
+// stdin and writes a JSON object in mercury-parser's format to stdout.
+// The page's URL is passed in the AREAD_URL environment variable.
+type commandExtractor struct {
+	args  []string
+	fetch fetchFunc
+}
+
+func (e *commandExtractor) Extract(pageURL string) (*Article, error) {
+	b, baseURL, err := e.fetch(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(e.args[0], e.args[1:]...)
+	cmd.Env = append(os.Environ(), "AREAD_URL="+pageURL)
+	cmd.Stdin = bytes.NewReader(b)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v failed: %v", e.args[0], err)
+	}
+	var a Article
+	if err = json.Unmarshal(out, &a); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %v JSON: %v", e.args[0], err)
+	}
+	if a.URL == "" {
+		a.URL = baseURL
+	}
+	return &a, nil
+}
+
+// selectorExtractor extracts content matched by CSS selectors.
+// Metadata that isn't matched by a selector is extracted in the same way as
+// by nativeExtractor.
+type selectorExtractor struct {
+	content  cascadia.Selector
+	title    cascadia.Selector // optional
+	author   cascadia.Selector // optional
+	date     cascadia.Selector // optional
+	nextPage cascadia.Selector // optional
+	remove   []cascadia.Selector
+	fetch    fetchFunc
+}
+
+func (e *selectorExtractor) Extract(pageURL string) (*Article, error) {
+	b, baseURL, err := e.fetch(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.ParseWithOptions(bytes.NewReader(b), html.ParseOptionEnableScripting(false))
+	if err != nil {
+		return nil, err
+	}
+
+	// Returns the text of the first node matched by sel, or def if there
+	// isn't one.
+	getSelected := func(sel cascadia.Selector, attr, def string) string {
+		if sel == nil {
+			return def
+		}
+		if n := sel.MatchFirst(doc); n != nil {
+			if v := getNodeAttr(n, attr); attr != "" && v != "" {
+				return v
+			}
+			return getText(n)
+		}
+		return def
+	}
+
+	a := &Article{
+		Title:         getSelected(e.title, "", getDocTitle(doc)),
+		Author:        getSelected(e.author, "", getMetaContent(doc, "author", "article:author")),
+		DatePublished: getSelected(e.date, "datetime", getDocDate(doc)),
+		URL:           baseURL,
+	}
+	setDocMetadata(a, doc, baseURL)
+	if a.NextPageURL = findNextPageURL(doc, baseURL); e.nextPage != nil {
+		if n := e.nextPage.MatchFirst(doc); n != nil {
+			a.NextPageURL = resolveURL(baseURL, getNodeAttr(n, "href"))
+		}
+	}
+
+	for _, sel := range e.remove {
+		for _, n := range sel.MatchAll(doc) {
+			if n.Parent != nil {
+				n.Parent.RemoveChild(n)
+			}
+		}
+	}
+	var content bytes.Buffer
+	for _, n := range e.content.MatchAll(doc) {
+		if err := html.Render(&content, n); err != nil {
+			return nil, err
+		}
+	}
+	a.Content = content.String()
+	return a, nil
+}
+
+// extractorSpec describes an extractor in Config.ExtractorsFile.
+type extractorSpec struct {
+	// Type is "mercury", "native", "command", or "selector".
+	Type string `json:"type"`
+	// Command contains the command and arguments for "command".
+	Command []string `json:"command"`
+	// Content, Title, Author, Date, NextPage, and Remove contain CSS
+	// selectors for "selector". Only Content is required.
+	Content  string   `json:"content"`
+	Title    string   `json:"title"`
+	Author   string   `json:"author"`
+	Date     string   `json:"date"`
+	NextPage string   `json:"nextPage"`
+	Remove   []string `json:"remove"`
+}
+
+// newExtractor returns a new Extractor as described by spec.
+func (p *Processor) newExtractor(spec *extractorSpec) (Extractor, error) {
+	switch spec.Type {
+	case "", common.MercuryExtractor:
+		return &mercuryExtractor{p.cfg.ParserPath}, nil
+	case common.NativeExtractor:
+		return &nativeExtractor{p.fetchPage}, nil
+	case commandExtractorType:
+		if len(spec.Command) == 0 {
+			return nil, errors.New("no command supplied")
+		}
+		return &commandExtractor{spec.Command, p.fetchPage}, nil
+	case selectorExtractorType:
+		if spec.Content == "" {
+			return nil, errors.New("no content selector supplied")
+		}
+		e := &selectorExtractor{fetch: p.fetchPage}
+		var err error
+		for _, s := range []struct {
+			str string
+			sel *cascadia.Selector
+		}{
+			{spec.Content, &e.content},
+			{spec.Title, &e.title},
+			{spec.Author, &e.author},
+			{spec.Date, &e.date},
+			{spec.NextPage, &e.nextPage},
+		} {
+			if s.str == "" {
+				continue
+			}
+			if *s.sel, err = cascadia.Compile(s.str); err != nil {
+				return nil, fmt.Errorf("bad selector %q: %v", s.str, err)
+			}
+		}
+		for _, str := range spec.Remove {
+			sel, err := cascadia.Compile(str)
+			if err != nil {
+				return nil, fmt.Errorf("bad selector %q: %v", str, err)
+			}
+			e.remove = append(e.remove, sel)
+		}
+		return e, nil
+	default:
+		return nil, fmt.Errorf("unknown extractor type %q", spec.Type)
+	}
+}
+
+// getExtractor returns the Extractor that should be used for pageURL.
+func (p *Processor) getExtractor(pageURL string) (Extractor, error) {
+	spec := extractorSpec{Type: p.cfg.Extractor}
+	if len(p.cfg.ExtractorsFile) > 0 {
+		// host -> spec
+		specs := make(map[string]extractorSpec)
+		if err := common.ReadJSONFile(p.cfg.ExtractorsFile, &specs); err != nil {
+			return nil, err
+		}
+		// Use the most-specific matching host.
+		urlHost := common.GetHost(pageURL)
+		best := ""
+		for host, s := range specs {
+			if !common.HostMatches(host, urlHost) {
+				continue
+			}
+			if best == "" || best == "*" || (host != "*" && len(host) > len(best)) {
+				best = host
+				spec = s
+			}
+		}
+		if spec.Type == "" {
+			spec.Type = p.cfg.Extractor
+		}
+	}
+	e, err := p.newExtractor(&spec)
+	if err != nil {
+		return nil, fmt.Errorf("bad %q extractor: %v", spec.Type, err)
+	}
+	return e, nil
+}
+
+// fetchPage downloads and returns the page at pageURL. It implements fetchFunc.
+func (p *Processor) fetchPage(pageURL string) (body []byte, baseURL string, err error) {
+	resp, err := p.openURL(pageURL, nil, maxPageRetries)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, "", err
+	}
+	// Relative URLs are resolved against the final URL after redirects.
+	baseURL = resp.Request.URL.String()
+	if href := findBaseHref(body); href != "" {
+		if u := resolveURL(baseURL, href); u != "" {
+			baseURL = u
+		}
+	}
+	return body, baseURL, nil
+}
+
+// findBaseHref returns the href attribute of the first <base> element in the
+// HTML document in b, or an empty string if there isn't one.
+func findBaseHref(b []byte) string {
+	z := html.NewTokenizer(bytes.NewReader(b))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if t.Data == "body" {
+				return ""
+			} else if t.Data == "base" {
+				if href := strings.TrimSpace(getAttrValue(&t, "href")); href != "" {
+					return href
+				}
+			}
+		}
+	}
+}
+
+// resolveURL resolves ref against base, returning an empty string on failure.
+func resolveURL(base, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	u, err := b.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,110 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/derat/aread/common"
+)
+
+const extractorsFile = "testdata/extractors.json"
+
+func TestProcessor_GetExtractor(t *testing.T) {
+	for _, tc := range []struct {
+		extractor string // Config.Extractor
+		url       string
+		want      string
+	}{
+		{"", "https://www.example.net/", "*proc.nativeExtractor"},
+		{"", "https://example.com/", "*proc.selectorExtractor"},
+		{"", "https://www.example.com/", "*proc.selectorExtractor"},
+		{"", "https://cmd.example.com/", "*proc.commandExtractor"},
+		// Entries without types should use Config.Extractor.
+		{"", "https://untyped.example.com/", "*proc.mercuryExtractor"},
+		{common.NativeExtractor, "https://untyped.example.com/", "*proc.nativeExtractor"},
+		{common.MercuryExtractor, "https://untyped.example.com/", "*proc.mercuryExtractor"},
+	} {
+		p := New(&common.Config{
+			Extractor:      tc.extractor,
+			ExtractorsFile: extractorsFile,
+			Logger:         log.New(os.Stderr, "", log.LstdFlags),
+		})
+		if e, err := p.getExtractor(tc.url); err != nil {
+			t.Errorf("getExtractor(%q) with %q failed: %v", tc.url, tc.extractor, err)
+		} else if got := fmt.Sprintf("%T", e); got != tc.want {
+			t.Errorf("getExtractor(%q) with %q returned %v; want %v", tc.url, tc.extractor, got, tc.want)
+		}
+	}
+}
+
+func TestSelectorExtractor(t *testing.T) {
+	b, err := ioutil.ReadFile(articlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(&common.Config{
+		ExtractorsFile: extractorsFile,
+		Logger:         log.New(os.Stderr, "", log.LstdFlags),
+	})
+	e, err := p.getExtractor(articleURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.(*selectorExtractor).fetch = func(u string) ([]byte, string, error) { return b, u, nil }
+
+	a, err := e.Extract(articleURL)
+	if err != nil {
+		t.Fatal("Extraction failed: ", err)
+	}
+	if want := "Why Cats Sleep So Much"; a.Title != want {
+		t.Errorf("Title = %q; want %q", a.Title, want)
+	}
+	if want := "Jane Doe"; a.Author != want {
+		t.Errorf("Author = %q; want %q", a.Author, want)
+	}
+	if !strings.Contains(a.Content, "Cats sleep for an average") {
+		t.Errorf("Content doesn't contain article text:\n%v", a.Content)
+	}
+	for _, s := range []string{"Share on Facebook", "First comment"} {
+		if strings.Contains(a.Content, s) {
+			t.Errorf("Content unexpectedly contains %q:\n%v", s, a.Content)
+		}
+	}
+}
+
+func TestCommandExtractor(t *testing.T) {
+	e := &commandExtractor{
+		args:  []string{"sh", "-c", `cat >/dev/null; echo "{\"title\": \"$AREAD_URL\", \"content\": \"<p>Hi</p>\"}"`},
+		fetch: func(u string) ([]byte, string, error) { return []byte("<html></html>"), u, nil },
+	}
+	const u = "https://example.org/"
+	a, err := e.Extract(u)
+	if err != nil {
+		t.Fatal("Extraction failed: ", err)
+	}
+	if a.Title != u || a.Content != "<p>Hi</p>" || a.URL != u {
+		t.Errorf("Extract(%q) = %+v", u, a)
+	}
+}
+
+func TestFindBaseHref(t *testing.T) {
+	for _, tc := range []struct {
+		doc  string
+		want string
+	}{
+		{`<html><head><title>Hi</title></head><body></body></html>`, ""},
+		{`<html><head><base target="_blank"><base href=" /foo/ "></head></html>`, "/foo/"},
+		{`<html><body><base href="/foo/"></body></html>`, ""},
+	} {
+		if got := findBaseHref([]byte(tc.doc)); got != tc.want {
+			t.Errorf("findBaseHref(%q) = %q; want %q", tc.doc, got, tc.want)
+		}
+	}
+}
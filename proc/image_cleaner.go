@@ -4,18 +4,53 @@
 package proc
 
 import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/derat/aread/common"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
 
 	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/net/html/charset"
 )
 
+// readerImageFormats contains the image formats (as returned by image.Decode)
+// that e-readers are able to display. Images in other formats are transcoded.
+var readerImageFormats = map[string]bool{
+	"gif":  true,
+	"jpeg": true,
+	"png":  true,
+}
+
+// imageFormatExts maps from the formats that images can be written in to the
+// corresponding filename extensions.
+var imageFormatExts = map[string]string{
+	"gif":  ".gif",
+	"jpeg": ".jpg",
+	"png":  ".png",
+}
+
+// kindleImageSuffix is inserted before the extensions of Kindle-specific copies of images.
+const kindleImageSuffix = "-kindle"
+
 type imageCleaner struct {
 	cfg   *common.Config
 	procs int
@@ -29,14 +64,15 @@ func newImageCleaner(cfg *common.Config) *imageCleaner {
 	return c
 }
 
-// TODO: Break this into separate methods.
-func (c *imageCleaner) updateImage(src image.Image, imgFmt, filename string) error {
+// prepareImage scales src and makes it opaque if needed. filename is only used
+// for logging. src is returned if it didn't need to be modified.
+func (c *imageCleaner) prepareImage(src image.Image, filename string) (img image.Image, changed bool) {
 	sb := src.Bounds()
 	needsScale := sb.Dx() > c.cfg.MaxImageWidth || sb.Dy() > c.cfg.MaxImageHeight
 	needsOpaque := (src.ColorModel() == color.RGBAModel && !src.(*image.RGBA).Opaque()) ||
 		(src.ColorModel() == color.NRGBAModel && !src.(*image.NRGBA).Opaque())
 	if !needsScale && !needsOpaque {
-		return nil
+		return src, false
 	}
 
 	var dst *image.RGBA
@@ -80,7 +116,11 @@ func (c *imageCleaner) updateImage(src image.Image, imgFmt, filename string) err
 			}
 		}
 	}
+	return dst, true
+}
 
+// writeImage encodes img to filename in imgFmt. jpegQuality is used for JPEG images.
+func writeImage(img image.Image, imgFmt, filename string, jpegQuality int) error {
 	f, err := os.Create(filename)
 	if err != nil {
 		return err
@@ -89,16 +129,59 @@ func (c *imageCleaner) updateImage(src image.Image, imgFmt, filename string) err
 
 	switch imgFmt {
 	case "png":
-		err = png.Encode(f, dst)
+		err = png.Encode(f, img)
 	case "jpeg":
-		err = jpeg.Encode(f, dst, &jpeg.Options{Quality: c.cfg.JPEGQuality})
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: jpegQuality})
+	case "gif":
+		err = gif.Encode(f, img, nil)
 	default:
-		c.cfg.Logger.Fatalf("Unhandled image format %v for %v", imgFmt, filename)
+		err = fmt.Errorf("unhandled image format %v", imgFmt)
 	}
 	return err
 }
 
-func (c *imageCleaner) clean(filename string) error {
+// updateImage prepares src using prepareImage and writes it to filename in imgFmt.
+// If force is false, filename is left untouched if src doesn't need to be modified.
+// The prepared image is returned.
+func (c *imageCleaner) updateImage(src image.Image, imgFmt, filename string, force bool) (image.Image, error) {
+	img, changed := c.prepareImage(src, filename)
+	if !changed && !force {
+		return img, nil
+	}
+	return img, writeImage(img, imgFmt, filename, c.cfg.JPEGQuality)
+}
+
+// writeKindleImage writes a Kindle-specific copy of src (in imgFmt) alongside the
+// web image at filename and returns the copy's filename. If Config.EInkImages is
+// true, the copy is optimized for e-ink displays.
+func (c *imageCleaner) writeKindleImage(src image.Image, imgFmt, filename string) (string, error) {
+	img, _ := c.prepareImage(src, filename)
+	quality := c.cfg.JPEGQuality
+	if c.cfg.EInkImages {
+		img = makeEInkImage(img, c.cfg.EInkDither)
+		if imgFmt != "jpeg" {
+			// PNG compresses the reduced palette well.
+			imgFmt = "png"
+			img = makeEInkPaletted(img.(*image.Gray))
+		}
+		quality = c.cfg.EInkJPEGQuality
+	}
+	kfn := getKindleFilename(filename, imageFormatExts[imgFmt])
+	return kfn, writeImage(img, imgFmt, kfn, quality)
+}
+
+// cleanedImage describes the files written by imageCleaner.clean.
+type cleanedImage struct {
+	filename       string // image for web pages
+	kindleFilename string // image for Kindle documents; may be the same as filename
+}
+
+// clean processes the image at filename. Images in formats that e-readers can't
+// display are transcoded to JPEG or PNG and renamed to have a matching extension
+// if needed. Animated GIFs and SVG images are left untouched for the web, and
+// separate static copies are written for Kindle documents. Separate copies are
+// also written for all images if Config.EInkImages is true.
+func (c *imageCleaner) clean(filename string) (cleanedImage, error) {
 	c.cond.L.Lock()
 	for c.procs >= c.cfg.MaxImageProcs {
 		c.cond.Wait()
@@ -113,38 +196,240 @@ func (c *imageCleaner) clean(filename string) error {
 		c.cond.Signal()
 	}()
 
+	ci := cleanedImage{filename, filename}
+	origInfo, err := os.Stat(filename)
+	if err != nil {
+		return ci, err
+	}
+
+	var kindleImg image.Image // source for a Kindle-specific copy, if needed
+	var kindleFmt string
+
+	if isSVG(filename) {
+		if ci.filename, err = renameSVG(filename); err != nil {
+			return ci, err
+		}
+		if img, err := c.rasterizeSVG(ci.filename); err != nil {
+			c.cfg.Logger.Printf("Unable to rasterize %v: %v\n", ci.filename, err)
+		} else {
+			b := img.Bounds()
+			c.cfg.Logger.Printf("Rasterized %v to %vx%v for Kindle\n", ci.filename, b.Dx(), b.Dy())
+			kindleImg, kindleFmt = img, "png"
+		}
+	} else if img, srcFmt, err := decodeImage(filename); err != nil {
+		c.cfg.Logger.Printf("Unable to decode %v: %v\n", filename, err)
+	} else if frames := countGIFFrames(filename, srcFmt); frames > 1 {
+		// Use the first frame (which is all that image.Decode returns) for Kindle.
+		c.cfg.Logger.Printf("Using first of %v frames of %v for Kindle\n", frames, filename)
+		kindleImg, kindleFmt = img, "gif"
+	} else {
+		imgFmt := srcFmt
+		if !readerImageFormats[srcFmt] {
+			imgFmt = getTranscodeFormat(img)
+			ci.filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + imageFormatExts[imgFmt]
+			c.cfg.Logger.Printf("Transcoding %v from %v to %v\n", filename, srcFmt, imgFmt)
+		}
+		if img, err = c.updateImage(img, imgFmt, ci.filename, imgFmt != srcFmt); err != nil {
+			return ci, err
+		}
+		if ci.filename != filename {
+			if err := os.Remove(filename); err != nil {
+				return ci, err
+			}
+		}
+		if c.cfg.EInkImages {
+			kindleImg, kindleFmt = img, imgFmt
+		}
+	}
+
+	ci.kindleFilename = ci.filename
+	if kindleImg != nil {
+		if ci.kindleFilename, err = c.writeKindleImage(kindleImg, kindleFmt, ci.filename); err != nil {
+			return ci, err
+		}
+	}
+
+	fns := []string{ci.filename}
+	if ci.kindleFilename != ci.filename {
+		fns = append(fns, ci.kindleFilename)
+	}
+	for _, fn := range fns {
+		newInfo, err := os.Stat(fn)
+		if err != nil {
+			return ci, err
+		}
+		if fn == ci.filename && origInfo.Size() != newInfo.Size() {
+			c.cfg.Logger.Printf("Resized %v from %v bytes to %v bytes\n", fn, origInfo.Size(), newInfo.Size())
+		}
+		if newInfo.Size() > c.cfg.MaxImageBytes {
+			c.cfg.Logger.Printf("Deleting %v-byte file %v\n", newInfo.Size(), fn)
+			if err = os.Remove(fn); err != nil {
+				return ci, err
+			}
+		}
+	}
+	return ci, nil
+}
+
+// renameSVG renames the SVG image at filename to have a .svg extension if needed,
+// since browsers won't display SVG images that are served with other types.
+// The possibly-updated filename is returned.
+func renameSVG(filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	if strings.EqualFold(ext, ".svg") {
+		return filename, nil
+	}
+	newFilename := strings.TrimSuffix(filename, ext) + ".svg"
+	return newFilename, os.Rename(filename, newFilename)
+}
+
+// rasterizeSVG renders the SVG image at filename onto a white background at its
+// natural size, scaled down to fit within the configured maximum dimensions.
+func (c *imageCleaner) rasterizeSVG(filename string) (*image.RGBA, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	w, h := getSVGSize(b)
+	if w <= 0 || h <= 0 {
+		w, h = icon.ViewBox.W, icon.ViewBox.H
+	}
+	if w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("bad size %vx%v", w, h)
+	}
+	scale := math.Min(1, math.Min(float64(c.cfg.MaxImageWidth)/w, float64(c.cfg.MaxImageHeight)/h))
+	iw, ih := int(math.Max(1, w*scale+0.5)), int(math.Max(1, h*scale+0.5))
+	icon.SetTarget(0, 0, float64(iw), float64(ih))
+
+	img := image.NewRGBA(image.Rect(0, 0, iw, ih))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	icon.Draw(rasterx.NewDasher(iw, ih, rasterx.NewScannerGV(iw, ih, img, img.Bounds())), 1)
+	return img, nil
+}
+
+// getSVGSize returns the width and height in pixels from the root element of the
+// SVG image in b. Zero is returned for dimensions that are missing or that use
+// units other than pixels.
+func getSVGSize(b []byte) (w, h float64) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.CharsetReader = charset.NewReaderLabel
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return 0, 0
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		parse := func(s string) float64 {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "px"), 64)
+			if err != nil {
+				return 0
+			}
+			return f
+		}
+		for _, a := range se.Attr {
+			switch a.Name.Local {
+			case "width":
+				w = parse(a.Value)
+			case "height":
+				h = parse(a.Value)
+			}
+		}
+		return w, h
+	}
+}
+
+// getKindleFilename returns the filename that should be used for a Kindle-specific
+// copy of the image at filename with extension ext.
+func getKindleFilename(filename, ext string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + kindleImageSuffix + ext
+}
+
+// svgSniffLen is the number of bytes examined by isSVG.
+const svgSniffLen = 1024
+
+// isSVG returns true if filename has a .svg extension or appears to contain an
+// SVG image.
+func isSVG(filename string) bool {
+	if strings.EqualFold(filepath.Ext(filename), ".svg") {
+		return true
+	}
 	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return false
 	}
 	defer f.Close()
+	head := make([]byte, svgSniffLen)
+	n, _ := io.ReadFull(f, head)
+	head = bytes.TrimSpace(head[:n])
+	return (bytes.HasPrefix(head, []byte("<?xml")) || bytes.HasPrefix(head, []byte("<svg")) ||
+		bytes.HasPrefix(head, []byte("<!DOCTYPE svg"))) && bytes.Contains(head, []byte("<svg"))
+}
 
-	origInfo, err := f.Stat()
+// countGIFFrames returns the number of frames in the image at filename if imgFmt
+// is "gif" and 1 otherwise.
+func countGIFFrames(filename, imgFmt string) int {
+	if imgFmt != "gif" {
+		return 1
+	}
+	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return 1
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		return 1
 	}
+	return len(g.Image)
+}
 
-	img, imgFmt, err := image.Decode(f)
+// decodeImage decodes the image at filename and returns it along with its format.
+func decodeImage(filename string) (image.Image, string, error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		c.cfg.Logger.Printf("Unable to decode %v\n", filename)
-	} else {
-		if err = c.updateImage(img, imgFmt, filename); err != nil {
-			return err
-		}
+		return nil, "", err
 	}
+	defer f.Close()
 
-	newInfo, err := f.Stat()
+	img, imgFmt, err := image.Decode(f)
+	if err == image.ErrFormat {
+		// There's no pure-Go AVIF decoder, but at least report what the image was.
+		var head [12]byte
+		if _, serr := f.Seek(0, io.SeekStart); serr == nil {
+			if _, rerr := io.ReadFull(f, head[:]); rerr == nil && isAVIF(head[:]) {
+				err = errors.New("AVIF images are unsupported")
+			}
+		}
+	}
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	if origInfo.Size() != newInfo.Size() {
-		c.cfg.Logger.Printf("Resized %v from %v bytes to %v bytes\n", filename, origInfo.Size(), newInfo.Size())
+	return img, imgFmt, nil
+}
+
+// isAVIF returns true if head, the beginning of a file, contains an ISO BMFF
+// "ftyp" box with an AVIF brand.
+func isAVIF(head []byte) bool {
+	return len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")) &&
+		(bytes.Equal(head[8:12], []byte("avif")) || bytes.Equal(head[8:12], []byte("avis")))
+}
+
+// getTranscodeFormat returns the format that img should be transcoded to if it's
+// in a format that e-readers can't display. Images with transparency or palettes
+// are transcoded to PNG and everything else is transcoded to JPEG.
+func getTranscodeFormat(img image.Image) string {
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		return "png"
 	}
-	if newInfo.Size() > c.cfg.MaxImageBytes {
-		c.cfg.Logger.Printf("Deleting %v-byte file %v\n", newInfo.Size(), filename)
-		if err = os.Remove(filename); err != nil {
-			return err
-		}
+	if _, ok := img.(*image.Paletted); ok {
+		return "png"
 	}
-	return nil
+	return "jpeg"
 }
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/color/palette"
+	"image/gif"
 	"image/png"
 	"io/ioutil"
 	"log"
@@ -15,6 +17,8 @@ import (
 	"testing"
 
 	"github.com/derat/aread/common"
+
+	"golang.org/x/image/tiff"
 )
 
 func runClean(w, h int, clr color.Color, maxw, maxh int) (image.Image, error) {
@@ -49,7 +53,7 @@ func runClean(w, h int, clr color.Color, maxw, maxh int) (image.Image, error) {
 		MaxImageWidth:  maxw,
 		MaxImageHeight: maxh,
 	})
-	if err := ic.clean(p); err != nil {
+	if _, err := ic.clean(p); err != nil {
 		return nil, err
 	}
 
@@ -102,3 +106,291 @@ func TestImageCleaner_transparent(t *testing.T) {
 		t.Error("image was not made opaque")
 	}
 }
+
+func TestImageCleaner_transcode(t *testing.T) {
+	td, err := ioutil.TempDir("", "image_cleaner_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// writeTIFF writes a 100x100 TIFF image filled with clr and returns its path.
+	writeTIFF := func(fn string, clr color.Color) string {
+		img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 100; x++ {
+				img.Set(x, y, clr)
+			}
+		}
+		p := filepath.Join(td, fn)
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := tiff.Encode(f, img, nil); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	webp, err := ioutil.ReadFile("testdata/image.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webpPath := filepath.Join(td, "webp.jpg")
+	if err := ioutil.WriteFile(webpPath, webp, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ic := newImageCleaner(&common.Config{
+		JPEGQuality:    90,
+		Logger:         log.New(os.Stderr, "", log.LstdFlags),
+		MaxImageBytes:  256 * 1024,
+		MaxImageProcs:  2,
+		MaxImageWidth:  1000,
+		MaxImageHeight: 1000,
+	})
+	for _, tc := range []struct {
+		path    string
+		wantFn  string
+		wantFmt string
+	}{
+		{webpPath, "webp.jpg", "jpeg"},
+		{writeTIFF("opaque.jpg", color.Black), "opaque.jpg", "jpeg"},
+		{writeTIFF("transparent.jpg", color.Transparent), "transparent.png", "png"},
+	} {
+		ci, err := ic.clean(tc.path)
+		if err != nil {
+			t.Errorf("Cleaning %v failed: %v", tc.path, err)
+			continue
+		}
+		p := ci.filename
+		if fn := filepath.Base(p); fn != tc.wantFn {
+			t.Errorf("Cleaning %v returned %v; want %v", tc.path, fn, tc.wantFn)
+		}
+		if ci.kindleFilename != p {
+			t.Errorf("Cleaning %v returned Kindle file %v; want %v", tc.path, ci.kindleFilename, p)
+		}
+		if p != tc.path {
+			if _, err := os.Stat(tc.path); !os.IsNotExist(err) {
+				t.Errorf("%v wasn't removed after transcoding", tc.path)
+			}
+		}
+		if _, imgFmt, err := decodeImage(p); err != nil {
+			t.Errorf("Unable to decode %v: %v", p, err)
+		} else if imgFmt != tc.wantFmt {
+			t.Errorf("%v has format %q; want %q", p, imgFmt, tc.wantFmt)
+		}
+	}
+}
+
+// writeGIF writes a GIF image to fn in dir with the supplied number of 400x200
+// frames and returns its path.
+func writeGIF(t *testing.T, dir, fn string, frames int) string {
+	var g gif.GIF
+	for i := 0; i < frames; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 400, 200), palette.Plan9)
+		for j := range img.Pix {
+			img.Pix[j] = uint8(i)
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+	}
+	p := filepath.Join(dir, fn)
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := gif.EncodeAll(f, &g); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestImageCleaner_gifAndSVG(t *testing.T) {
+	td, err := ioutil.TempDir("", "image_cleaner_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// writeSVG writes an SVG image to fn and returns its path.
+	writeSVG := func(fn string) string {
+		const svg = `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="400" height="200" viewBox="0 0 40 20">
+  <rect x="0" y="0" width="20" height="20" fill="#000000"/>
+</svg>`
+		p := filepath.Join(td, fn)
+		if err := ioutil.WriteFile(p, []byte(svg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	ic := newImageCleaner(&common.Config{
+		JPEGQuality:    90,
+		Logger:         log.New(os.Stderr, "", log.LstdFlags),
+		MaxImageBytes:  256 * 1024,
+		MaxImageProcs:  2,
+		MaxImageWidth:  200,
+		MaxImageHeight: 200,
+	})
+	for _, tc := range []struct {
+		path         string
+		wantFn       string // web filename
+		wantFrames   int    // frames in web file, or 0 if not GIF
+		wantKindleFn string
+		wantFmt      string // format of Kindle file
+	}{
+		{writeGIF(t, td, "static.gif", 1), "static.gif", 1, "static.gif", "gif"},
+		{writeGIF(t, td, "anim.gif", 3), "anim.gif", 3, "anim-kindle.gif", "gif"},
+		{writeSVG("image.svg"), "image.svg", 0, "image-kindle.png", "png"},
+		{writeSVG("noext.jpg"), "noext.svg", 0, "noext-kindle.png", "png"},
+	} {
+		ci, err := ic.clean(tc.path)
+		if err != nil {
+			t.Errorf("Cleaning %v failed: %v", tc.path, err)
+			continue
+		}
+		if fn := filepath.Base(ci.filename); fn != tc.wantFn {
+			t.Errorf("Cleaning %v returned %v; want %v", tc.path, fn, tc.wantFn)
+		}
+		if tc.wantFrames > 0 {
+			if n := countGIFFrames(ci.filename, "gif"); n != tc.wantFrames {
+				t.Errorf("%v has %v frame(s); want %v", ci.filename, n, tc.wantFrames)
+			}
+		}
+		if fn := filepath.Base(ci.kindleFilename); fn != tc.wantKindleFn {
+			t.Errorf("Cleaning %v returned Kindle file %v; want %v", tc.path, fn, tc.wantKindleFn)
+		}
+		img, imgFmt, err := decodeImage(ci.kindleFilename)
+		if err != nil {
+			t.Errorf("Unable to decode %v: %v", ci.kindleFilename, err)
+			continue
+		}
+		if imgFmt != tc.wantFmt {
+			t.Errorf("%v has format %q; want %q", ci.kindleFilename, imgFmt, tc.wantFmt)
+		}
+		if eb := image.Rect(0, 0, 200, 100); img.Bounds() != eb {
+			t.Errorf("%v has bounds %v; want %v", ci.kindleFilename, img.Bounds(), eb)
+		}
+		if n := countGIFFrames(ci.kindleFilename, imgFmt); n != 1 {
+			t.Errorf("%v has %v frame(s); want 1", ci.kindleFilename, n)
+		}
+	}
+
+	// Check that the SVG was rasterized: its left half is black and its right half is white.
+	img, _, err := decodeImage(filepath.Join(td, "image-kindle.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		x, y int
+		want color.Gray
+	}{
+		{50, 50, color.Gray{0}},
+		{150, 50, color.Gray{255}},
+	} {
+		if got := color.GrayModel.Convert(img.At(tc.x, tc.y)).(color.Gray); got != tc.want {
+			t.Errorf("Rasterized SVG pixel at (%v, %v) is %v; want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestIsAVIF(t *testing.T) {
+	for _, tc := range []struct {
+		head string
+		want bool
+	}{
+		{"\x00\x00\x00\x1cftypavif", true},
+		{"\x00\x00\x00\x20ftypavis", true},
+		{"\x00\x00\x00\x18ftypmp42", false},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\x0d", false},
+		{"short", false},
+	} {
+		if got := isAVIF([]byte(tc.head)); got != tc.want {
+			t.Errorf("isAVIF(%q) = %v; want %v", tc.head, got, tc.want)
+		}
+	}
+}
+
+func TestImageCleaner_eink(t *testing.T) {
+	td, err := ioutil.TempDir("", "image_cleaner_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// writeColorImage writes a 100x100 color gradient to fn in imgFmt and returns its path.
+	writeColorImage := func(fn, imgFmt string) string {
+		img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 100; x++ {
+				img.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 2), 200, 255})
+			}
+		}
+		p := filepath.Join(td, fn)
+		if err := writeImage(img, imgFmt, p, 90); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	ic := newImageCleaner(&common.Config{
+		JPEGQuality:     90,
+		Logger:          log.New(os.Stderr, "", log.LstdFlags),
+		MaxImageBytes:   256 * 1024,
+		MaxImageProcs:   2,
+		MaxImageWidth:   200,
+		MaxImageHeight:  200,
+		EInkImages:      true,
+		EInkDither:      true,
+		EInkJPEGQuality: 75,
+	})
+	for _, tc := range []struct {
+		path         string
+		wantKindleFn string
+		wantFmt      string
+	}{
+		{writeColorImage("photo.jpg", "jpeg"), "photo-kindle.jpg", "jpeg"},
+		{writeColorImage("drawing.png", "png"), "drawing-kindle.png", "png"},
+		{writeGIF(t, td, "anim.gif", 3), "anim-kindle.png", "png"},
+	} {
+		ci, err := ic.clean(tc.path)
+		if err != nil {
+			t.Errorf("Cleaning %v failed: %v", tc.path, err)
+			continue
+		}
+		if ci.filename != tc.path {
+			t.Errorf("Cleaning %v returned %v", tc.path, ci.filename)
+		}
+		if fn := filepath.Base(ci.kindleFilename); fn != tc.wantKindleFn {
+			t.Errorf("Cleaning %v returned Kindle file %v; want %v", tc.path, fn, tc.wantKindleFn)
+		}
+
+		// The web copy should keep its color.
+		if img, _, err := decodeImage(ci.filename); err != nil {
+			t.Errorf("Unable to decode %v: %v", ci.filename, err)
+		} else if img.ColorModel() == color.GrayModel {
+			t.Errorf("%v was converted to grayscale", ci.filename)
+		}
+
+		img, imgFmt, err := decodeImage(ci.kindleFilename)
+		if err != nil {
+			t.Errorf("Unable to decode %v: %v", ci.kindleFilename, err)
+			continue
+		}
+		if imgFmt != tc.wantFmt {
+			t.Errorf("%v has format %q; want %q", ci.kindleFilename, imgFmt, tc.wantFmt)
+		}
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if r, g, bl, _ := img.At(x, y).RGBA(); r != g || g != bl {
+					t.Fatalf("%v has non-gray pixel at (%v, %v)", ci.kindleFilename, x, y)
+				}
+			}
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	// Handle Comodo certs: http://bridge.grumpy-troll.org/2014/05/golang-tls-comodo/
 	_ "crypto/sha512"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -37,7 +36,8 @@ const (
 	maxLineLength    = 80
 	indexFile        = "index.html"
 	kindleFile       = "kindle.html"
-	docFile          = "out.mobi"
+	mobiFile         = "out.mobi"
+	epubFile         = "out.epub"
 	maxPageRetries   = 1
 	httpRetryDelayMs = 1000
 )
@@ -56,15 +56,37 @@ func getFaviconURL(origURL string) (string, error) {
 type Processor struct {
 	cfg    *common.Config
 	client *http.Client
+	userId int64 // owner of processed pages
 }
 
 func New(cfg *common.Config) *Processor {
 	return &Processor{
 		cfg:    cfg,
 		client: &http.Client{},
+		userId: common.ConfigUserId,
 	}
 }
 
+// ForUser returns a new Processor that processes pages for u using u's
+// configuration. See common.Config.ForUser.
+func (p *Processor) ForUser(u *common.User) (*Processor, error) {
+	cfg, err := p.cfg.ForUser(u)
+	if err != nil {
+		return nil, err
+	}
+	return &Processor{cfg: cfg, client: p.client, userId: u.Id}, nil
+}
+
+// getPageID returns the ID of the page with the supplied rewritten URL.
+// IDs of pages belonging to the config user are just hashes of their URLs;
+// other users' IDs also include the user ID so they don't collide.
+func (p *Processor) getPageID(contentURL string) string {
+	if p.userId == common.ConfigUserId {
+		return common.SHA1String(contentURL)
+	}
+	return common.SHA1String(fmt.Sprintf("%d|%s", p.userId, contentURL))
+}
+
 func (p *Processor) rewriteURL(origURL string) (newURL string, err error) {
 	if len(p.cfg.URLPatternsFile) == 0 {
 		return origURL, nil
@@ -91,7 +113,9 @@ func (p *Processor) rewriteURL(origURL string) (newURL string, err error) {
 	return
 }
 
-func (p *Processor) openURL(url string, head *http.Header, maxRetries int) (io.ReadCloser, error) {
+// openURL sends a GET request for url and returns the response if it was
+// successful. The caller must close the response's body.
+func (p *Processor) openURL(url string, head *http.Header, maxRetries int) (*http.Response, error) {
 	for i := 0; ; i++ {
 		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
@@ -110,7 +134,7 @@ func (p *Processor) openURL(url string, head *http.Header, maxRetries int) (io.R
 			err = fmt.Errorf("received status code %d", resp.StatusCode)
 			transientError = resp.StatusCode >= 500 && resp.StatusCode < 600
 		} else {
-			return resp.Body, nil
+			return resp, nil
 		}
 
 		if transientError && i < maxRetries {
@@ -122,20 +146,31 @@ func (p *Processor) openURL(url string, head *http.Header, maxRetries int) (io.R
 	}
 }
 
-func (p *Processor) downloadImages(urls map[string]string, dir string) (totalBytes int64) {
+// downloadImages downloads urls (keyed by local filename) to dir. Images that were
+// transcoded to different formats are renamed, and some images have separate
+// copies for Kindle documents. webFiles and kindleFiles map from the original
+// filenames to the ones that should be used instead.
+func (p *Processor) downloadImages(urls map[string]string, dir string) (
+	totalBytes int64, webFiles, kindleFiles map[string]string) {
+	type result struct {
+		bytes    int64
+		filename string
+		cleaned  cleanedImage
+	}
 	ic := newImageCleaner(p.cfg)
-	c := make(chan int64)
+	c := make(chan result)
 	for filename, url := range urls {
 		go func(filename, url string) {
 			var bytes int64 = 0
-			defer func() { c <- bytes }()
+			var cleaned cleanedImage
+			defer func() { c <- result{bytes, filename, cleaned} }()
 
-			body, err := p.openURL(url, nil, 0)
+			resp, err := p.openURL(url, nil, 0)
 			if err != nil {
 				p.cfg.Logger.Printf("Failed to download image %v: %v\n", url, err)
 				return
 			}
-			defer body.Close()
+			defer resp.Body.Close()
 
 			path := filepath.Join(dir, filename)
 			file, err := os.Create(path)
@@ -145,23 +180,46 @@ func (p *Processor) downloadImages(urls map[string]string, dir string) (totalByt
 			}
 			defer file.Close()
 
-			bytes, err = io.Copy(file, body)
+			bytes, err = io.Copy(file, resp.Body)
 			if err != nil {
 				p.cfg.Logger.Printf("Unable to write image %v to %v: %v\n", url, path, err)
 				return
 			}
-			if err = ic.clean(path); err != nil {
+			if cleaned, err = ic.clean(path); err != nil {
 				p.cfg.Logger.Printf("Unable to process image %v: %v\n", path, err)
 			}
 		}(filename, url)
 	}
 
+	webFiles = make(map[string]string)
+	kindleFiles = make(map[string]string)
 	for i := 0; i < len(urls); i++ {
-		totalBytes += <-c
+		r := <-c
+		totalBytes += r.bytes
+		if fn := filepath.Base(r.cleaned.filename); r.cleaned.filename != "" && fn != r.filename {
+			webFiles[r.filename] = fn
+		}
+		if fn := filepath.Base(r.cleaned.kindleFilename); r.cleaned.kindleFilename != "" && fn != r.filename {
+			kindleFiles[r.filename] = fn
+		}
 	}
 	close(c)
 	runtime.GC()
-	return totalBytes
+	return totalBytes, webFiles, kindleFiles
+}
+
+// replaceImageFilenames returns content with local image filenames replaced
+// according to files. Local filenames are derived from hashes of image URLs,
+// so they can be safely replaced throughout the content.
+func replaceImageFilenames(content string, files map[string]string) string {
+	if len(files) == 0 {
+		return content
+	}
+	pairs := make([]string, 0, 2*len(files))
+	for old, fn := range files {
+		pairs = append(pairs, old, fn)
+	}
+	return strings.NewReplacer(pairs...).Replace(content)
 }
 
 func (p *Processor) checkContent(pi common.PageInfo, content string) error {
@@ -192,30 +250,134 @@ func (p *Processor) checkContent(pi common.PageInfo, content string) error {
 	return nil
 }
 
-// downloadContent downloads the specified page.
-// The page's title is returned.
-func (p *Processor) downloadContent(pi common.PageInfo, dir string) (string, error) {
-	b, err := exec.Command(p.cfg.ParserPath, pi.OriginalURL).Output()
+// extractArticle extracts the article at pageURL using the configured extractor.
+func (p *Processor) extractArticle(pageURL string) (*Article, error) {
+	e, err := p.getExtractor(pageURL)
 	if err != nil {
-		return "", fmt.Errorf("parser failed: %v", err)
+		return nil, err
+	}
+	return e.Extract(pageURL)
+}
+
+// parsePubDate parses the publication date reported by an extractor.
+func parsePubDate(s string) (time.Time, error) {
+	for _, layout := range []string{
+		time.RFC3339,
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05",
+		"2006-01-02",
+		time.RFC1123Z,
+		time.RFC1123,
+		"January 2, 2006",
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
 	}
-	var obj struct {
-		Error         bool   `json:"error"`
-		Message       string `json:"message"`
-		Content       string `json:"content"`
-		Title         string `json:"title"`
-		Author        string `json:"author"`
-		DatePublished string `json:"date_published"`
-		NextPageURL   string `json:"next_page_url"`
+	return time.Time{}, fmt.Errorf("unknown date format %q", s)
+}
+
+// checkArticle returns an error if a (extracted from pageURL) is unusable.
+func (p *Processor) checkArticle(pi common.PageInfo, a *Article) error {
+	if a.Error {
+		return fmt.Errorf("parser failed: %v", a.Message)
 	}
-	if err = json.Unmarshal(b, &obj); err != nil {
-		return "", fmt.Errorf("unable to unmarshal parser JSON: %v", err)
+	if a.Content == "" {
+		return errors.New("no content")
 	}
+	if p.cfg.Verbose {
+		p.cfg.Logger.Printf("Content:\n%v", a.Content)
+	}
+	if err := p.checkContent(pi, a.Content); err != nil {
+		return fmt.Errorf("bad content: %v", err)
+	}
+	return nil
+}
+
+// normalizePageURL strips parts of u that don't affect which page is loaded.
+// It's used to detect loops in next-page links.
+func normalizePageURL(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	pu.Fragment = ""
+	pu.Path = strings.TrimSuffix(pu.Path, "/")
+	return pu.String()
+}
+
+// extractPages extracts pi's article, following next-page links up to
+// Config.MaxPages. The first page's article is returned along with the
+// rewritten content of all pages and a map from local filename to image URL.
+func (p *Processor) extractPages(pi common.PageInfo) (first *Article, content string, imageURLs map[string]string, err error) {
+	rw := rewriter{p.cfg}
+	imageURLs = make(map[string]string)
+	seen := make(map[string]bool)
+	var contents []string
+
+	for pageURL := pi.OriginalURL; pageURL != ""; {
+		norm := normalizePageURL(pageURL)
+		if seen[norm] {
+			p.cfg.Logger.Printf("Next page URL %v was already seen\n", pageURL)
+			break
+		}
+		seen[norm] = true
+
+		a, err := p.extractArticle(pageURL)
+		if err == nil {
+			err = p.checkArticle(pi, a)
+		}
+		if err != nil {
+			if first == nil {
+				return a, "", nil, err
+			}
+			// Keep the pages that we already have.
+			p.cfg.Logger.Printf("Dropping page %v: %v\n", pageURL, err)
+			break
+		}
+		if first == nil {
+			first = a
+		} else {
+			p.cfg.Logger.Printf("Got page %v from %v\n", len(contents)+1, pageURL)
+		}
+
+		baseURL := a.URL
+		if baseURL == "" {
+			baseURL = pageURL
+		}
+		c, urls, err := rw.rewriteContent(a.Content, pageURL, baseURL)
+		if err != nil {
+			return first, "", nil, fmt.Errorf("unable to process content: %v", err)
+		}
+		contents = append(contents, c)
+		for fn, u := range urls {
+			imageURLs[fn] = u
+		}
+		pageURL = a.NextPageURL
+		if pageURL != "" && len(contents) >= p.cfg.MaxPages {
+			p.cfg.Logger.Printf("Not following next page URL %v after %v page(s)\n", pageURL, len(contents))
+			break
+		}
+	}
+
+	if first == nil {
+		return nil, "", nil, errors.New("no pages extracted")
+	}
+	return first, strings.Join(contents, "\n<hr class=\"page-separator\"/>\n"), imageURLs, nil
+}
+
+// downloadContent downloads the specified page to dir.
+// pi's Title, Author, Text, and metadata fields are updated.
+func (p *Processor) downloadContent(pi *common.PageInfo, dir string) error {
+	obj, content, imageURLs, err := p.extractPages(*pi)
+	if err != nil {
+		return err
+	}
+
+	// Don't let the page's content see the CSRF token that's substituted when it's served.
+	noCSRF := func(s string) string { return strings.Replace(s, common.CSRFPlaceholder, "", -1) }
+	content = noCSRF(content)
 
-	queryParams := fmt.Sprintf("?%s=%s&%s=%s&%s=%s",
-		common.IDParam, pi.Id,
-		common.TokenParam, pi.Token,
-		common.RedirectParam, url.QueryEscape(p.cfg.GetPath()))
 	d := struct {
 		Content     template.HTML
 		ForWeb      bool
@@ -224,29 +386,22 @@ func (p *Processor) downloadContent(pi common.PageInfo, dir string) (string, err
 		Title       string
 		Author      string
 		PubDate     string
+		Id          string
+		CSRF        string
 		ArchivePath string
 		KindlePath  string
+		TagsPath    string
 		ListPath    string
 	}{
-		URL:         pi.OriginalURL,
-		Host:        common.GetHost(pi.OriginalURL),
-		ArchivePath: p.cfg.GetPath(common.ArchiveURLPath + queryParams),
-		KindlePath:  p.cfg.GetPath(common.KindleURLPath + queryParams),
-		ListPath:    p.cfg.GetPath(),
-	}
-
-	if obj.Error {
-		return obj.Title, fmt.Errorf("parser failed: %v", obj.Message)
-	}
-	if obj.Content == "" {
-		return obj.Title, errors.New("no content")
-	}
-	if p.cfg.Verbose {
-		p.cfg.Logger.Printf("Content:\n%v", obj.Content)
-	}
-
-	if err = p.checkContent(pi, obj.Content); err != nil {
-		return obj.Title, fmt.Errorf("bad content: %v", err)
+		URL:         noCSRF(pi.OriginalURL),
+		Host:        noCSRF(common.GetHost(pi.OriginalURL)),
+		Id:          pi.Id,
+		CSRF:        common.CSRFPlaceholder,
+		ArchivePath: p.cfg.GetPath(common.ArchiveURLPath),
+		KindlePath:  p.cfg.GetPath(common.KindleURLPath),
+		TagsPath: p.cfg.GetPath(fmt.Sprintf("%s?%s=%s&%s=%s", common.TagsURLPath,
+			common.IDParam, pi.Id, common.RedirectParam, url.QueryEscape(p.cfg.GetPath()))),
+		ListPath: p.cfg.GetPath(),
 	}
 
 	if obj.Title == "" {
@@ -256,27 +411,40 @@ func (p *Processor) downloadContent(pi common.PageInfo, dir string) (string, err
 		obj.Title = p.cfg.FriendTitlePrefix + obj.Title
 	}
 
+	obj.Title = noCSRF(obj.Title)
+	obj.Author = noCSRF(obj.Author)
+	pi.Title = obj.Title
+	pi.Author = obj.Author
+	pi.Text = getTextContent(content)
+	pi.WordCount = len(strings.Fields(pi.Text))
+	pi.ReadingTime = getReadingTime(pi.WordCount)
+	pi.Excerpt = noCSRF(strings.TrimSpace(whitespaceRegexp.ReplaceAllString(obj.Excerpt, " ")))
+	if pi.Excerpt == "" {
+		pi.Excerpt = makeExcerpt(pi.Text)
+	}
+	pi.Language = noCSRF(obj.Language)
+
 	d.Title = obj.Title
 	d.Author = obj.Author
+	docInfo := common.DocInfo{Author: obj.Author, SourceURL: d.URL, Language: pi.Language}
 
 	if obj.DatePublished != "" {
-		if date, err := time.Parse("2006-01-02 15:04:05", obj.DatePublished); err == nil {
+		if date, err := parsePubDate(obj.DatePublished); err == nil {
 			d.PubDate = date.Format("Monday, January 2, 2006")
+			docInfo.PubDate = date.Format(time.RFC3339)
+			pi.TimePublished = date.Unix()
 		}
 	}
 
-	// TODO: Does this ever get set?
-	if obj.NextPageURL != "" {
-		p.cfg.Logger.Printf("Got next page URL %v", obj.NextPageURL)
-	}
-
-	// filename -> URL
-	rw := rewriter{p.cfg}
-	content, imageURLs, err := rw.rewriteContent(obj.Content, pi.OriginalURL)
-	if err != nil {
-		return obj.Title, fmt.Errorf("unable to process content: %v", err)
+	// Use the article's lead image if it has one, or its first image otherwise.
+	if p.cfg.DownloadImages {
+		if obj.LeadImageURL != "" {
+			pi.LeadImage = common.LocalImageFilename(obj.LeadImageURL)
+			imageURLs[pi.LeadImage] = obj.LeadImageURL
+		} else if fn := getFirstImage(content); imageURLs[fn] != "" {
+			pi.LeadImage = fn
+		}
 	}
-	d.Content = template.HTML(content)
 
 	var faviconFilename string
 	if p.cfg.DownloadFavicons {
@@ -288,62 +456,125 @@ func (p *Processor) downloadContent(pi common.PageInfo, dir string) (string, err
 		}
 	}
 
+	webContent, kindleContent := content, content
 	if p.cfg.DownloadImages && len(imageURLs) > 0 {
-		totalBytes := p.downloadImages(imageURLs, dir)
+		totalBytes, webFiles, kindleFiles := p.downloadImages(imageURLs, dir)
 		p.cfg.Logger.Printf("Downloaded %v image(s) totalling %v byte(s)\n", len(imageURLs), totalBytes)
+		webContent = replaceImageFilenames(content, webFiles)
+		kindleContent = replaceImageFilenames(content, kindleFiles)
+		if fn, ok := webFiles[pi.LeadImage]; ok {
+			pi.LeadImage = fn
+		}
+		if fn, ok := webFiles[faviconFilename]; ok {
+			faviconFilename = fn
+		}
 	}
 	if faviconFilename != "" {
 		if _, err := os.Stat(filepath.Join(dir, faviconFilename)); err != nil {
 			faviconFilename = ""
 		}
 	}
+	if pi.LeadImage != "" {
+		if _, err := os.Stat(filepath.Join(dir, pi.LeadImage)); err != nil {
+			pi.LeadImage = ""
+		}
+	}
 
 	cssFiles := []string{common.CommonCSSFile, common.PageCSSFile}
 	for _, file := range cssFiles {
 		if err = copyFile(filepath.Join(dir, file), filepath.Join(p.cfg.StaticDir, file)); err != nil {
-			return obj.Title, err
+			return err
 		}
 	}
 
 	for _, filename := range []string{indexFile, kindleFile} {
 		contentFile, err := os.Create(filepath.Join(dir, filename))
 		if err != nil {
-			return obj.Title, err
+			return err
 		}
 		defer contentFile.Close()
 
-		common.WriteHeader(contentFile, p.cfg, cssFiles, obj.Title, faviconFilename, d.Author)
+		common.WriteHeader(contentFile, p.cfg, cssFiles, obj.Title, faviconFilename, docInfo)
 		t := `
   <body>
     <h1 id="title-header">{{.Title}}</h1>
     <a href="{{.URL}}">{{.Host}}</a><br/>
     {{if .Author}}<b>By {{.Author}}</b><br/>{{end}}
     {{if .PubDate}}<em>Published {{.PubDate}}</em><br/>{{end}}
-	{{if .ForWeb}}<span id="top-links">
+	{{if .ForWeb}}<form id="top-links" method="post" action="{{.KindlePath}}">
+      <input type="hidden" name="i" value="{{.Id}}">
+      <input type="hidden" name="csrf" value="{{.CSRF}}">
       <a href="#end-paragraph">Jump to bottom</a> -
-      <a href="{{.KindlePath}}">Send to Kindle</a>
-    </span>{{end}}
+      <button type="submit" class="link">Send to Kindle</button>
+    </form>{{end}}
     <div class="content">
       {{.Content}}
     </div>
-	{{if .ForWeb}}<p id="end-paragraph">
-      <a href="{{.ArchivePath}}">Toggle archived</a> -
+	{{if .ForWeb}}<form id="end-paragraph" method="post" action="{{.ArchivePath}}">
+      <input type="hidden" name="i" value="{{.Id}}">
+      <input type="hidden" name="csrf" value="{{.CSRF}}">
+      <input type="hidden" name="r" value="{{.ListPath}}">
+      <button type="submit" class="link">Toggle archived</button> -
+      <a href="{{.TagsPath}}">Edit tags</a> -
       <a href="#title-header">Jump to top</a> -
       <a href="{{.ListPath}}">Back to list</a>
-    </p>{{end}}
+    </form>{{end}}
   </body>
 </html>`
 		d.ForWeb = filename != kindleFile
+		if d.Content = template.HTML(webContent); !d.ForWeb {
+			d.Content = template.HTML(kindleContent)
+		}
 		if err := common.WriteTemplate(contentFile, p.cfg, t, d, template.FuncMap{}); err != nil {
-			return obj.Title, fmt.Errorf("failed to execute page template: %v", err)
+			return fmt.Errorf("failed to execute page template: %v", err)
 		}
 	}
 
-	return obj.Title, nil
+	return nil
 }
 
-func (p *Processor) buildDoc(dir string) error {
-	cmd := exec.Command(p.cfg.KindlegenPath, kindleFile, "-o", docFile)
+const (
+	// wordsPerMinute is the reading speed used to estimate reading times.
+	wordsPerMinute = 230
+	// maxExcerptLen is the maximum length in bytes of excerpts generated by makeExcerpt.
+	maxExcerptLen = 300
+)
+
+// getReadingTime returns the estimated number of minutes needed to read words words.
+func getReadingTime(words int) int {
+	return (words + wordsPerMinute - 1) / wordsPerMinute
+}
+
+// makeExcerpt returns the beginning of text, truncated at a word boundary.
+func makeExcerpt(text string) string {
+	if len(text) <= maxExcerptLen {
+		return text
+	}
+	s := text[:maxExcerptLen]
+	if i := strings.LastIndexByte(s, ' '); i > 0 {
+		s = s[:i]
+	}
+	return strings.TrimRight(s, " ,.;:-") + "…"
+}
+
+// buildDoc builds a document in dir in the configured format.
+// The document's filename is returned.
+func (p *Processor) buildDoc(dir string) (string, error) {
+	switch p.cfg.DocFormat {
+	case common.EPUBFormat:
+		if err := writeEPUB(dir, kindleFile, filepath.Join(dir, epubFile)); err != nil {
+			return "", fmt.Errorf("failed to build EPUB: %v", err)
+		}
+		return epubFile, nil
+	case common.MOBIFormat:
+		return mobiFile, p.runKindlegen(dir)
+	default:
+		return "", fmt.Errorf("unknown document format %q", p.cfg.DocFormat)
+	}
+}
+
+func (p *Processor) runKindlegen(dir string) error {
+	cmd := exec.Command(p.cfg.KindlegenPath, kindleFile, "-o", mobiFile)
 	cmd.Dir = dir
 	o, err := cmd.CombinedOutput()
 	p.cfg.Logger.Printf("kindlegen output:%s", strings.Replace("\n"+string(o), "\n", "\n  ", -1))
@@ -404,8 +635,12 @@ func (p *Processor) sendMail(docPath string) error {
 	}
 
 	basename := filepath.Base(docPath)
+	docType := "application/x-mobipocket-ebook"
+	if filepath.Ext(basename) == filepath.Ext(epubFile) {
+		docType = epubMIMEType
+	}
 	ahead := make(textproto.MIMEHeader)
-	ahead.Add("Content-Type", "application/x-mobipocket-ebook; name=\""+basename+"\"")
+	ahead.Add("Content-Type", docType+"; name=\""+basename+"\"")
 	ahead.Add("Content-Disposition", "attachment; filename=\""+basename+"\"")
 	ahead.Add("Content-Transfer-Encoding", "base64")
 	ahead.Add("X-Attachment-Id", basename)
@@ -423,37 +658,197 @@ func (p *Processor) sendMail(docPath string) error {
 	return nil
 }
 
+// GetAutoTags returns the tags from Config.AutoTagsFile that should be applied
+// to the page at contentURL.
+func (p *Processor) GetAutoTags(contentURL string) ([]string, error) {
+	if len(p.cfg.AutoTagsFile) == 0 {
+		return nil, nil
+	}
+	// host -> [tag, tag, ...]
+	data := make(map[string][]string)
+	if err := common.ReadJSONFile(p.cfg.AutoTagsFile, &data); err != nil {
+		return nil, err
+	}
+	urlHost := common.GetHost(contentURL)
+	var tags []string
+	for host, hostTags := range data {
+		if common.HostMatches(host, urlHost) {
+			tags = append(tags, hostTags...)
+		}
+	}
+	return common.ParseTags(strings.Join(tags, ",")), nil
+}
+
+// GetPageID returns the ID that ProcessURL will assign to the page at contentURL.
+func (p *Processor) GetPageID(contentURL string) (string, error) {
+	u, err := p.rewriteURL(contentURL)
+	if err != nil {
+		return "", fmt.Errorf("failed rewriting URL: %v", err)
+	}
+	return p.getPageID(u), nil
+}
+
 func (p *Processor) ProcessURL(contentURL string, fromFriend bool) (pi common.PageInfo, err error) {
 	if contentURL, err = p.rewriteURL(contentURL); err != nil {
 		return pi, fmt.Errorf("failed rewriting URL: %v", err)
 	}
 
-	pi.Id = common.SHA1String(contentURL)
+	pi.Id = p.getPageID(contentURL)
+	pi.UserId = p.userId
 	pi.OriginalURL = contentURL
 	pi.TimeAdded = time.Now().Unix()
-	pi.Token = common.SHA1String(fmt.Sprintf("%s|%s|%s", p.cfg.Username, p.cfg.Password, contentURL))
 	pi.FromFriend = fromFriend
+	return pi, p.writePage(&pi)
+}
+
+// ReprocessPage downloads and processes the existing page pi again using the
+// current configuration. The page keeps its ID, and the previous version is left
+// in place if processing fails. The returned PageInfo should be passed to
+// db.Database.UpdatePage.
+func (p *Processor) ReprocessPage(pi common.PageInfo) (common.PageInfo, error) {
+	if matched, err := regexp.Match("^[a-f0-9]+$", []byte(pi.Id)); err != nil {
+		return pi, err
+	} else if !matched {
+		return pi, errors.New("invalid ID")
+	}
+	u, err := p.rewriteURL(pi.OriginalURL)
+	if err != nil {
+		return pi, fmt.Errorf("failed rewriting URL: %v", err)
+	}
+
+	np := common.PageInfo{
+		Id:          pi.Id,
+		UserId:      pi.UserId,
+		OriginalURL: u,
+		TimeAdded:   pi.TimeAdded,
+		Token:       pi.Token,
+		Archived:    pi.Archived,
+		TimeDeleted: pi.TimeDeleted,
+		FromFriend:  pi.FromFriend,
+		Tags:        pi.Tags,
+	}
+	if err := p.writePage(&np); err != nil {
+		return pi, err
+	}
+	return np, nil
+}
+
+// ReadPageText returns the text of the saved page pi, as would be stored in
+// pi.Text when the page was processed. This is used to rebuild the search index.
+func (p *Processor) ReadPageText(pi common.PageInfo) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(p.cfg.PageDir, pi.Id, indexFile))
+	if err != nil {
+		return "", err
+	}
+	return getPageText(string(b))
+}
+
+// TempPageDirSuffix follows the page ID in the names of the temporary
+// directories used by writePage, e.g. "<id>.tmp123456". writePage holds
+// a lock on each directory while using it; see TryLockTempDir.
+const TempPageDirSuffix = ".tmp"
 
+// lockDir acquires an exclusive advisory lock on dir. If block is false and
+// the lock is held elsewhere, syscall.EWOULDBLOCK is returned. The returned
+// function releases the lock.
+func lockDir(dir string, block bool) (unlock func(), err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// TryLockTempDir attempts to lock dir, a temporary directory created by writePage,
+// so it can be safely deleted. ok is false if the directory is still in use,
+// possibly by another process. Otherwise, unlock must be called to release the lock.
+func TryLockTempDir(dir string) (unlock func(), ok bool, err error) {
+	unlock, err = lockDir(dir, false)
+	if err == syscall.EWOULDBLOCK {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return unlock, true, nil
+}
+
+// writePage downloads pi's content into a temporary directory and then moves it
+// into place, replacing any existing version of the page only after success.
+func (p *Processor) writePage(pi *common.PageInfo) error {
 	outDir := filepath.Join(p.cfg.PageDir, pi.Id)
-	p.cfg.Logger.Printf("Processing %v in %v\n", contentURL, outDir)
+	p.cfg.Logger.Printf("Processing %v in %v\n", pi.OriginalURL, outDir)
 
-	if _, err = os.Stat(outDir); err == nil {
-		p.cfg.Logger.Printf("Deleting existing %v directory\n", outDir)
-		if err = os.RemoveAll(outDir); err != nil {
-			return pi, err
+	// Use a unique directory so concurrent writers of the same page don't collide.
+	if err := os.MkdirAll(p.cfg.PageDir, 0755); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(p.cfg.PageDir, pi.Id+TempPageDirSuffix)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockDir(tmpDir, true)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			p.cfg.Logger.Printf("Failed deleting %v: %v\n", tmpDir, err)
 		}
+		unlock()
+	}()
+	newDir := filepath.Join(tmpDir, "new")
+	oldDir := filepath.Join(tmpDir, "old")
+
+	if err := os.Mkdir(newDir, 0755); err != nil {
+		return err
+	}
+	if err := p.downloadContent(pi, newDir); err != nil {
+		return err
 	}
 
-	if err = os.MkdirAll(outDir, 0755); err != nil {
-		return pi, err
+	replacing := true
+	if err := os.Rename(outDir, oldDir); os.IsNotExist(err) {
+		replacing = false
+	} else if err != nil {
+		return err
 	}
-	if pi.Title, err = p.downloadContent(pi, outDir); err != nil {
-		return pi, err
+	if err := os.Rename(newDir, outDir); err != nil {
+		if replacing {
+			if rerr := os.Rename(oldDir, outDir); rerr != nil {
+				p.cfg.Logger.Printf("Failed restoring %v: %v\n", outDir, rerr)
+			}
+		}
+		return err
 	}
-	return pi, nil
+	return nil
 }
 
 func (p *Processor) SendToKindle(id string) error {
+	return p.sendToKindle(id, nil)
+}
+
+// RemovePage deletes the directory containing the page with the supplied ID.
+func (p *Processor) RemovePage(id string) error {
+	if matched, err := regexp.Match("^[a-f0-9]+$", []byte(id)); err != nil {
+		return err
+	} else if !matched {
+		return errors.New("invalid ID")
+	}
+	return os.RemoveAll(filepath.Join(p.cfg.PageDir, id))
+}
+
+// sendToKindle builds and mails a document for the page with the supplied ID.
+// If sending is non-nil, it is called after the document has been built.
+func (p *Processor) sendToKindle(id string, sending func()) error {
 	if matched, err := regexp.Match("^[a-f0-9]+$", []byte(id)); err != nil {
 		return err
 	} else if !matched {
@@ -465,14 +860,18 @@ func (p *Processor) SendToKindle(id string) error {
 		return errors.New("nonexistent directory")
 	}
 
-	if err := p.buildDoc(outDir); err != nil {
+	docFile, err := p.buildDoc(outDir)
+	if err != nil {
 		return err
 	}
-	// Leave the .mobi file lying around if we're not sending email.
+	// Leave the document lying around if we're not sending email.
 	if len(p.cfg.Recipient) == 0 || len(p.cfg.Sender) == 0 {
 		p.cfg.Logger.Println("Empty recipient or sender; not sending email")
 		return nil
 	}
+	if sending != nil {
+		sending()
+	}
 	docPath := filepath.Join(outDir, docFile)
 	if err := p.sendMail(docPath); err != nil {
 		return fmt.Errorf("unable to send mail: %v", err)
@@ -4,8 +4,13 @@
 package proc
 
 import (
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/derat/aread/common"
@@ -60,3 +65,80 @@ func TestProcessor_CheckContent(t *testing.T) {
 		}
 	}
 }
+
+func TestProcessor_ExtractPages(t *testing.T) {
+	// Each page links to the next one, and the last page links back to the first.
+	const numPages = 3
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("p"))
+		next := (n + 1) % numPages
+		fmt.Fprintf(w, `<html><head><title>Page %d</title><link rel="next" href="%s/?p=%d"></head>
+<body><div><p>This is the text of page number %d, which is long enough to be scored.</p></div></body></html>`,
+			n, srv.URL, next, n)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		maxPages, wantPages int
+	}{
+		{10, numPages}, // stop when the loop is detected
+		{2, 2},
+		{1, 1},
+		{0, 1}, // the first page is always extracted
+	} {
+		p := New(&common.Config{
+			Extractor: common.NativeExtractor,
+			MaxPages:  tc.maxPages,
+			Logger:    log.New(os.Stderr, "", log.LstdFlags),
+		})
+		pi := common.PageInfo{OriginalURL: srv.URL + "/?p=0"}
+		first, content, _, err := p.extractPages(pi)
+		if err != nil {
+			t.Errorf("extractPages with %v max page(s) failed: %v", tc.maxPages, err)
+			continue
+		}
+		if first.Title != "Page 0" {
+			t.Errorf("extractPages with %v max page(s) returned title %q", tc.maxPages, first.Title)
+		}
+		for i := 0; i < numPages; i++ {
+			want := i < tc.wantPages
+			if got := strings.Contains(content, fmt.Sprintf("page number %d,", i)); got != want {
+				t.Errorf("extractPages with %v max page(s) included page %v = %v; want %v", tc.maxPages, i, got, want)
+			}
+		}
+		if got := strings.Count(content, "page-separator"); got != tc.wantPages-1 {
+			t.Errorf("extractPages with %v max page(s) returned %v separator(s); want %v", tc.maxPages, got, tc.wantPages-1)
+		}
+	}
+}
+
+func TestMakeExcerpt(t *testing.T) {
+	long := strings.Repeat("word ", maxExcerptLen/5+10)
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"", ""},
+		{"Short text.", "Short text."},
+		{long, strings.TrimSpace(long[:maxExcerptLen]) + "…"},
+	} {
+		if got := makeExcerpt(tc.text); got != tc.want {
+			t.Errorf("makeExcerpt(%q) = %q; want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestGetReadingTime(t *testing.T) {
+	for _, tc := range []struct {
+		words, mins int
+	}{
+		{0, 0},
+		{1, 1},
+		{wordsPerMinute, 1},
+		{wordsPerMinute + 1, 2},
+	} {
+		if got := getReadingTime(tc.words); got != tc.mins {
+			t.Errorf("getReadingTime(%d) = %d; want %d", tc.words, got, tc.mins)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derat/aread/common"
+	"github.com/derat/aread/db"
+)
+
+const (
+	// jobPollInterval is the interval at which idle workers check for jobs
+	// that are ready to be retried.
+	jobPollInterval = 30 * time.Second
+	// jobRetryDelay is the delay before a failed job is first retried.
+	// It is doubled after each subsequent failure.
+	jobRetryDelay = time.Minute
+	// maxJobRetryDelay is the maximum delay before a failed job is retried.
+	maxJobRetryDelay = 6 * time.Hour
+	// jobHeartbeatInterval is the interval at which running jobs' last-active
+	// times are updated.
+	jobHeartbeatInterval = time.Minute
+	// jobStaleTimeout is the duration after which a running job that hasn't been
+	// updated is assumed to have been interrupted and is requeued. Jobs may also
+	// be run by other processes using the same database, so this should be
+	// comfortably longer than jobHeartbeatInterval.
+	jobStaleTimeout = 5 * jobHeartbeatInterval
+)
+
+// Queue processes add requests asynchronously using a pool of workers.
+// Jobs are stored in the database so they survive restarts.
+type Queue struct {
+	cfg  *common.Config
+	proc *Processor
+	db   *db.Database
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewQueue(cfg *common.Config, p *Processor, d *db.Database) *Queue {
+	return &Queue{
+		cfg:  cfg,
+		proc: p,
+		db:   d,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+}
+
+// Start requeues interrupted jobs and starts cfg.JobWorkers workers.
+func (q *Queue) Start() error {
+	if err := q.resetStaleJobs(); err != nil {
+		return fmt.Errorf("unable to reset jobs: %v", err)
+	}
+	for i := 0; i < q.cfg.JobWorkers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return nil
+}
+
+// Stop stops the workers started by Start, waiting for in-progress jobs
+// to finish.
+func (q *Queue) Stop() {
+	close(q.stop)
+	q.wg.Wait()
+}
+
+// Add queues a request to add contentURL for u. The supplied tags and any
+// tags from the user's Config.AutoTagsFile are applied to the page once it's saved.
+func (q *Queue) Add(u *common.User, contentURL string, fromFriend, archive, kindle bool, tags []string) (common.Job, error) {
+	now := time.Now().Unix()
+	j := common.Job{
+		UserId:      u.Id,
+		URL:         contentURL,
+		FromFriend:  fromFriend,
+		Archive:     archive,
+		Kindle:      kindle,
+		State:       common.JobQueued,
+		TimeAdded:   now,
+		NextAttempt: now,
+	}
+	p, err := q.proc.ForUser(u)
+	if err != nil {
+		return j, err
+	}
+	if j.PageId, err = p.GetPageID(contentURL); err != nil {
+		return j, err
+	}
+	autoTags, err := p.GetAutoTags(contentURL)
+	if err != nil {
+		return j, fmt.Errorf("unable to get auto tags: %v", err)
+	}
+	j.Tags = common.ParseTags(strings.Join(append(tags, autoTags...), ","))
+	if err := q.db.AddJob(&j); err != nil {
+		return j, err
+	}
+	q.cfg.Logger.Printf("Queued job %v for %v\n", j.Id, contentURL)
+	q.wakeWorker()
+	return j, nil
+}
+
+// Reprocess queues a request to reprocess u's existing page pi using the current
+// configuration. See Processor.ReprocessPage.
+func (q *Queue) Reprocess(u *common.User, pi common.PageInfo) (common.Job, error) {
+	now := time.Now().Unix()
+	j := common.Job{
+		UserId:      u.Id,
+		PageId:      pi.Id,
+		URL:         pi.OriginalURL,
+		Reprocess:   true,
+		State:       common.JobQueued,
+		TimeAdded:   now,
+		NextAttempt: now,
+	}
+	if pi.UserId != u.Id {
+		return j, fmt.Errorf("page %v doesn't belong to %v", pi.Id, u.Username)
+	}
+	if err := q.db.AddJob(&j); err != nil {
+		return j, err
+	}
+	q.cfg.Logger.Printf("Queued job %v to reprocess %v\n", j.Id, pi.Id)
+	q.wakeWorker()
+	return j, nil
+}
+
+// wakeWorker wakes an idle worker if there is one.
+func (q *Queue) wakeWorker() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work runs jobs until Stop is called.
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		j, err := q.db.ClaimJob(time.Now().Unix())
+		if err != nil {
+			q.cfg.Logger.Printf("Unable to claim job: %v\n", err)
+		}
+		if j == nil {
+			select {
+			case <-q.wake:
+			case <-q.stop:
+				return
+			case <-time.After(jobPollInterval):
+				if err := q.resetStaleJobs(); err != nil {
+					q.cfg.Logger.Printf("Unable to reset jobs: %v\n", err)
+				}
+			}
+			continue
+		}
+
+		stopHeartbeat := q.startHeartbeat(j.Id)
+		err = q.runJob(j)
+		stopHeartbeat()
+		if err != nil {
+			var next int64
+			if j.Attempts < q.cfg.MaxJobAttempts {
+				next = time.Now().Add(getRetryDelay(j.Attempts)).Unix()
+			}
+			q.cfg.Logger.Printf("Job %v for %v failed on attempt %v: %v\n", j.Id, j.URL, j.Attempts, err)
+			if err := q.db.FailJob(j.Id, err.Error(), next); err != nil {
+				q.cfg.Logger.Printf("Unable to mark job %v as failed: %v\n", j.Id, err)
+			}
+		} else if err := q.db.DeleteJob(j.Id); err != nil {
+			q.cfg.Logger.Printf("Unable to delete job %v: %v\n", j.Id, err)
+		}
+	}
+}
+
+// resetStaleJobs requeues running jobs that haven't been updated within jobStaleTimeout.
+func (q *Queue) resetStaleJobs() error {
+	now := time.Now()
+	n, err := q.db.ResetJobs(now.Unix(), now.Add(-jobStaleTimeout).Unix())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		q.cfg.Logger.Printf("Requeued %v interrupted job(s)\n", n)
+	}
+	return nil
+}
+
+// startHeartbeat starts a goroutine that periodically updates the last-active
+// time of the job with the supplied ID. The returned function stops it.
+func (q *Queue) startHeartbeat(id int64) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(jobHeartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := q.db.TouchJob(id, time.Now().Unix()); err != nil {
+					q.cfg.Logger.Printf("Unable to update job %v: %v\n", id, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// getRetryDelay returns the delay before retrying a job that has failed
+// the supplied number of times.
+func getRetryDelay(attempts int) time.Duration {
+	d := jobRetryDelay
+	for i := 1; i < attempts && d < maxJobRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxJobRetryDelay {
+		d = maxJobRetryDelay
+	}
+	return d
+}
+
+// runJob processes j, which should already be in the common.JobFetching state.
+func (q *Queue) runJob(j *common.Job) error {
+	u, err := q.db.GetUser(j.UserId)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %v", err)
+	} else if u.Disabled {
+		return fmt.Errorf("user %v is disabled", u.Username)
+	}
+	p, err := q.proc.ForUser(u)
+	if err != nil {
+		return err
+	}
+	if j.Reprocess {
+		return q.runReprocessJob(j, p)
+	}
+	var pi common.PageInfo
+	if j.Saved {
+		// Don't download the page again (and reset its time added) if only
+		// sending it to the Kindle failed.
+		if pi, err = q.db.GetPage(j.PageId); err != nil {
+			return fmt.Errorf("failed to get page: %v", err)
+		}
+	} else {
+		if pi, err = p.ProcessURL(j.URL, j.FromFriend); err != nil {
+			return err
+		}
+		if err := q.db.AddPage(pi); err != nil {
+			return fmt.Errorf("failed to add to database: %v", err)
+		}
+		if j.Archive {
+			if err := q.db.SetPageArchived(pi.Id, true); err != nil {
+				return fmt.Errorf("failed to archive page: %v", err)
+			}
+		}
+		if len(j.Tags) > 0 {
+			if err := q.db.AddPageTags(pi.Id, j.Tags); err != nil {
+				return fmt.Errorf("failed to tag page: %v", err)
+			}
+		}
+		if err := q.db.SetJobSaved(j.Id); err != nil {
+			return fmt.Errorf("failed to update job: %v", err)
+		}
+		j.Saved = true
+	}
+	if j.Kindle {
+		q.setState(j, common.JobBuilding)
+		if err := p.sendToKindle(pi.Id, func() { q.setState(j, common.JobSending) }); err != nil {
+			return fmt.Errorf("failed to send to Kindle: %v", err)
+		}
+	}
+	q.cfg.Logger.Printf("Finished job %v for %v (%v)\n", j.Id, j.URL, pi.Title)
+	return nil
+}
+
+// runReprocessJob reprocesses the existing page identified by j using p.
+func (q *Queue) runReprocessJob(j *common.Job, p *Processor) error {
+	pi, err := q.db.GetPage(j.PageId)
+	if err != nil {
+		return fmt.Errorf("failed to get page: %v", err)
+	} else if pi.UserId != j.UserId {
+		return fmt.Errorf("page %v belongs to another user", pi.Id)
+	}
+	if pi, err = p.ReprocessPage(pi); err != nil {
+		return err
+	}
+	if err := q.db.UpdatePage(pi); err != nil {
+		return fmt.Errorf("failed to update database: %v", err)
+	}
+	q.cfg.Logger.Printf("Finished job %v reprocessing %v (%v)\n", j.Id, pi.Id, pi.Title)
+	return nil
+}
+
+func (q *Queue) setState(j *common.Job, state common.JobState) {
+	j.State = state
+	if err := q.db.SetJobState(j.Id, state); err != nil {
+		q.cfg.Logger.Printf("Unable to update job %v: %v\n", j.Id, err)
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derat/aread/common"
+	"github.com/derat/aread/db"
+)
+
+// newTestQueue returns a started Queue with a database and page directory in a
+// new temporary directory. The returned function should be called to clean up.
+func newTestQueue(t *testing.T) (*common.Config, *db.Database, *Queue, func()) {
+	td, err := ioutil.TempDir("", "queue_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{common.CommonCSSFile, common.PageCSSFile} {
+		if err := ioutil.WriteFile(filepath.Join(td, fn), nil, 0644); err != nil {
+			os.RemoveAll(td)
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &common.Config{
+		Extractor:      common.NativeExtractor,
+		BaseURL:        "https://example.org/aread",
+		StaticDir:      td,
+		PageDir:        td,
+		MaxPages:       1,
+		JobWorkers:     2,
+		MaxJobAttempts: 1,
+		Logger:         log.New(os.Stderr, "", log.LstdFlags),
+	}
+	d, err := db.New(filepath.Join(td, "test.db"))
+	if err != nil {
+		os.RemoveAll(td)
+		t.Fatal(err)
+	}
+	q := NewQueue(cfg, New(cfg), d)
+	if err := q.Start(); err != nil {
+		d.Close()
+		os.RemoveAll(td)
+		t.Fatal("Start failed: ", err)
+	}
+	return cfg, d, q, func() {
+		q.Stop()
+		d.Close()
+		os.RemoveAll(td)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `<html><head><title>Page title</title></head>
+<body><div><p>This is the page's text, which is long enough to be scored.</p></div></body></html>`)
+	}))
+	defer srv.Close()
+
+	cfg, d, q, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	u1, err := d.GetUser(common.ConfigUserId)
+	if err != nil {
+		t.Fatal("GetUser failed: ", err)
+	}
+	u2 := &common.User{Username: "other"}
+	if err := d.AddUser(u2, ""); err != nil {
+		t.Fatal("AddUser failed: ", err)
+	}
+
+	good, err := q.Add(u1, srv.URL+"/good", false, true, false, []string{"foo"})
+	if err != nil {
+		t.Fatal("Add failed: ", err)
+	}
+	bad, err := q.Add(u1, srv.URL+"/bad", false, false, false, []string{"bar"})
+	if err != nil {
+		t.Fatal("Add failed: ", err)
+	}
+	other, err := q.Add(u2, srv.URL+"/good", false, false, false, nil)
+	if err != nil {
+		t.Fatal("Add failed: ", err)
+	}
+	if other.PageId == good.PageId {
+		t.Errorf("Users were assigned same page ID %v", good.PageId)
+	}
+
+	// Wait for the good job to be removed and the bad one to fail.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		jobs, err := d.GetAllJobs(u1.Id)
+		if err != nil {
+			t.Fatal("GetAllJobs failed: ", err)
+		}
+		otherJobs, err := d.GetAllJobs(u2.Id)
+		if err != nil {
+			t.Fatal("GetAllJobs failed: ", err)
+		}
+		if len(otherJobs) == 0 && len(jobs) == 1 && jobs[0].Id == bad.Id && jobs[0].State == common.JobFailed {
+			if jobs[0].Error == "" || jobs[0].NextAttempt != 0 {
+				t.Errorf("failed job has error %q and next attempt %v", jobs[0].Error, jobs[0].NextAttempt)
+			}
+			// Tags should be held by the job until its page is saved.
+			if !reflect.DeepEqual(jobs[0].Tags, []string{"bar"}) {
+				t.Errorf("failed job has tags %v; want [bar]", jobs[0].Tags)
+			}
+			if tags, err := d.GetTags(u1.Id, true); err != nil {
+				t.Error("GetTags failed: ", err)
+			} else if len(tags) != 1 || tags[0].Name != "foo" {
+				t.Errorf("GetTags returned %+v; want only foo", tags)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs weren't processed: %+v", jobs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pages, err := d.GetAllPages(u1.Id, true, "", 10)
+	if err != nil {
+		t.Fatal("GetAllPages failed: ", err)
+	}
+	if len(pages) != 1 || pages[0].Id != good.PageId || pages[0].Title != "Page title" ||
+		!reflect.DeepEqual(pages[0].Tags, []string{"foo"}) {
+		t.Errorf("GetAllPages returned %+v; want archived page %v with tag", pages, good.PageId)
+	}
+
+	pages, err = d.GetAllPages(u2.Id, false, "", 10)
+	if err != nil {
+		t.Fatal("GetAllPages failed: ", err)
+	}
+	if len(pages) != 1 || pages[0].Id != other.PageId {
+		t.Errorf("GetAllPages returned %+v; want other user's page %v", pages, other.PageId)
+	}
+	for _, p := range []string{
+		filepath.Join(cfg.PageDir, good.PageId, "index.html"),
+		filepath.Join(cfg.GetUserPageDir(u2), other.PageId, "index.html"),
+	} {
+		if _, err := os.Stat(p); err != nil {
+			t.Error("Page wasn't written: ", err)
+		}
+	}
+}
+
+func TestQueue_Reprocess(t *testing.T) {
+	var title string // title returned by the server; empty to fail
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if title == "" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `<html><head><title>%s</title></head>
+<body><div><p>This is the page's text, which is long enough to be scored.</p></div></body></html>`, title)
+	}))
+	defer srv.Close()
+	setTitle := func(s string) {
+		mu.Lock()
+		title = s
+		mu.Unlock()
+	}
+
+	cfg, d, q, cleanup := newTestQueue(t)
+	defer cleanup()
+	u, err := d.GetUser(common.ConfigUserId)
+	if err != nil {
+		t.Fatal("GetUser failed: ", err)
+	}
+
+	// Waits for all jobs to finish and returns the failed ones.
+	wait := func() []common.Job {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			jobs, err := d.GetAllJobs(u.Id)
+			if err != nil {
+				t.Fatal("GetAllJobs failed: ", err)
+			}
+			done := true
+			for _, j := range jobs {
+				if j.State != common.JobFailed || j.NextAttempt != 0 {
+					done = false
+				}
+			}
+			if done {
+				return jobs
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("jobs weren't processed: %+v", jobs)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	setTitle("Old title")
+	j, err := q.Add(u, srv.URL+"/page", false, true, false, []string{"foo"})
+	if err != nil {
+		t.Fatal("Add failed: ", err)
+	}
+	if failed := wait(); len(failed) != 0 {
+		t.Fatalf("Add failed: %+v", failed)
+	}
+	orig, err := d.GetPage(j.PageId)
+	if err != nil {
+		t.Fatal("GetPage failed: ", err)
+	}
+	index := filepath.Join(cfg.PageDir, j.PageId, "index.html")
+
+	// A failed attempt should leave the old version in place.
+	setTitle("")
+	if _, err := q.Reprocess(u, orig); err != nil {
+		t.Fatal("Reprocess failed: ", err)
+	}
+	if failed := wait(); len(failed) != 1 {
+		t.Errorf("Reprocessing with failing server left jobs %+v", failed)
+	}
+	if b, err := ioutil.ReadFile(index); err != nil {
+		t.Error("Old version was removed: ", err)
+	} else if !strings.Contains(string(b), "Old title") {
+		t.Error("Old version was modified")
+	}
+	if pi, err := d.GetPage(j.PageId); err != nil {
+		t.Fatal("GetPage failed: ", err)
+	} else if pi.Title != "Old title" {
+		t.Errorf("Failed reprocessing changed title to %q", pi.Title)
+	}
+
+	setTitle("New title")
+	if _, err := q.Reprocess(u, orig); err != nil {
+		t.Fatal("Reprocess failed: ", err)
+	}
+	if failed := wait(); len(failed) != 0 {
+		t.Fatalf("Reprocessing failed: %+v", failed)
+	}
+	pi, err := d.GetPage(j.PageId)
+	if err != nil {
+		t.Fatal("GetPage failed: ", err)
+	}
+	if pi.Title != "New title" {
+		t.Errorf("Reprocessed page has title %q; want %q", pi.Title, "New title")
+	}
+	if pi.TimeAdded != orig.TimeAdded || !pi.Archived || !reflect.DeepEqual(pi.Tags, []string{"foo"}) {
+		t.Errorf("Reprocessing didn't preserve metadata: got %+v; orig %+v", pi, orig)
+	}
+	if b, err := ioutil.ReadFile(index); err != nil {
+		t.Error("Reprocessed page wasn't written: ", err)
+	} else if !strings.Contains(string(b), "New title") {
+		t.Error("Reprocessed page wasn't updated")
+	}
+	if tmp, err := filepath.Glob(filepath.Join(cfg.PageDir, j.PageId+TempPageDirSuffix+"*")); err != nil {
+		t.Error("Glob failed: ", err)
+	} else if len(tmp) != 0 {
+		t.Errorf("Temporary directories weren't removed: %v", tmp)
+	}
+}
+
+func TestQueue_KindleRetry(t *testing.T) {
+	var fetches int
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		fmt.Fprint(w, `<html><head><title>Page title</title></head>
+<body><div><p>This is the page's text, which is long enough to be scored.</p></div></body></html>`)
+	}))
+	defer srv.Close()
+	getFetches := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+
+	_, d, q, cleanup := newTestQueue(t)
+	defer cleanup()
+	u, err := d.GetUser(common.ConfigUserId)
+	if err != nil {
+		t.Fatal("GetUser failed: ", err)
+	}
+
+	// The test config doesn't have a document format, so sending to the Kindle fails.
+	if _, err := q.Add(u, srv.URL+"/page", false, false, true, nil); err != nil {
+		t.Fatal("Add failed: ", err)
+	}
+	var j common.Job
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		jobs, err := d.GetAllJobs(u.Id)
+		if err != nil {
+			t.Fatal("GetAllJobs failed: ", err)
+		}
+		if len(jobs) == 1 && jobs[0].State == common.JobFailed {
+			j = jobs[0]
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job wasn't processed: %+v", jobs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !j.Saved || !strings.Contains(j.Error, "Kindle") {
+		t.Fatalf("Job failed without saving page: %+v", j)
+	}
+	orig, err := d.GetPage(j.PageId)
+	if err != nil {
+		t.Fatal("GetPage failed: ", err)
+	}
+
+	// Retrying the job shouldn't download or add the page again.
+	n := getFetches()
+	if err := q.runJob(&j); err == nil || !strings.Contains(err.Error(), "Kindle") {
+		t.Errorf("Retrying job returned %v; want Kindle error", err)
+	}
+	if got := getFetches(); got != n {
+		t.Errorf("Retrying job fetched page %v more time(s)", got-n)
+	}
+	if pi, err := d.GetPage(j.PageId); err != nil {
+		t.Error("GetPage failed: ", err)
+	} else if !reflect.DeepEqual(pi, orig) {
+		t.Errorf("Retrying job changed page from %+v to %+v", orig, pi)
+	}
+}
@@ -0,0 +1,593 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// This file contains a Readability-style extractor loosely based on Mozilla's
+// Readability.js (https://github.com/mozilla/readability). Paragraph-like
+// elements are scored by their length and number of commas, scores are
+// propagated to their ancestors, and the best-scoring ancestor (along with
+// any similar-looking siblings) is used as the article's content.
+
+const (
+	// minParagraphLen is the minimum length of text that's scored.
+	minParagraphLen = 25
+	// maxScoreAncestors is the number of ancestors that paragraph scores are
+	// propagated to.
+	maxScoreAncestors = 5
+)
+
+var (
+	unlikelyCandidatesRegexp = regexp.MustCompile(`(?i)-ad-|ai2html|banner|breadcrumbs|combx|comment|community|cover-wrap|disqus|extra|footer|gdpr|header|legends|menu|related|remark|replies|rss|shoutbox|sidebar|skyscraper|social|sponsor|supplemental|ad-break|agegate|pagination|pager|popup|yom-remote`)
+	maybeCandidateRegexp     = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow`)
+	positiveRegexp           = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|pagination|post|text|blog|story`)
+	negativeRegexp           = regexp.MustCompile(`(?i)-ad-|hidden|^hid$| hid$| hid |^hid |banner|combx|comment|com-|contact|foot|footer|footnote|gdpr|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+	bylineRegexp             = regexp.MustCompile(`(?i)byline|author|dateline|writtenby|p-author`)
+	bylinePrefixRegexp       = regexp.MustCompile(`(?i)^\s*by:?\s+`)
+	nextLinkTextRegexp       = regexp.MustCompile(`(?i)^\s*(next( page)?|continue|more)?\s*(›|»|>|→)?\s*$`)
+	titleSeparatorRegexp     = regexp.MustCompile(`\s+[|\-–—/»:]\s+`)
+	sentenceEndRegexp        = regexp.MustCompile(`\.( |$)`)
+	whitespaceRegexp         = regexp.MustCompile(`\s+`)
+)
+
+// Elements that are removed before scoring.
+var removedAtoms = map[atom.Atom]bool{
+	atom.Aside:    true,
+	atom.Button:   true,
+	atom.Footer:   true,
+	atom.Input:    true,
+	atom.Link:     true,
+	atom.Meta:     true,
+	atom.Nav:      true,
+	atom.Object:   true,
+	atom.Script:   true,
+	atom.Select:   true,
+	atom.Style:    true,
+	atom.Textarea: true,
+}
+
+// Block-level elements that prevent a <div> from being scored as a paragraph.
+var blockAtoms = map[atom.Atom]bool{
+	atom.Blockquote: true,
+	atom.Dl:         true,
+	atom.Div:        true,
+	atom.Img:        true,
+	atom.Ol:         true,
+	atom.P:          true,
+	atom.Pre:        true,
+	atom.Table:      true,
+	atom.Ul:         true,
+	atom.Figure:     true,
+	atom.Section:    true,
+	atom.Article:    true,
+}
+
+// Elements whose text is scored.
+var scoredAtoms = map[atom.Atom]bool{
+	atom.H2:      true,
+	atom.H3:      true,
+	atom.H4:      true,
+	atom.H5:      true,
+	atom.H6:      true,
+	atom.P:       true,
+	atom.Pre:     true,
+	atom.Section: true,
+	atom.Td:      true,
+}
+
+// Elements that are considered for removal after the content has been chosen.
+var conditionallyCleanedAtoms = map[atom.Atom]bool{
+	atom.Div:     true,
+	atom.Form:    true,
+	atom.Ol:      true,
+	atom.Section: true,
+	atom.Table:   true,
+	atom.Ul:      true,
+}
+
+// nativeExtract extracts an article from the HTML document in r. Relative URLs in
+// the document are resolved against pageURL.
+func nativeExtract(r io.Reader, pageURL string) (*Article, error) {
+	// Disable scripting so <noscript> contents (frequently used for
+	// lazily-loaded images) are parsed as elements.
+	doc, err := html.ParseWithOptions(r, html.ParseOptionEnableScripting(false))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Article{
+		Title:         getDocTitle(doc),
+		Author:        getMetaContent(doc, "author", "article:author", "byline", "parsely-author", "sailthru.author", "dc.creator"),
+		DatePublished: getDocDate(doc),
+		NextPageURL:   findNextPageURL(doc, pageURL),
+		URL:           pageURL,
+	}
+	setDocMetadata(a, doc, pageURL)
+	// Some sites use profile URLs for article:author.
+	if strings.HasPrefix(a.Author, "http://") || strings.HasPrefix(a.Author, "https://") {
+		a.Author = ""
+	}
+
+	body := findElement(doc, atom.Body)
+	if body == nil {
+		return nil, errors.New("no body")
+	}
+	byline := prepareBody(body)
+	if a.Author == "" {
+		a.Author = byline
+	}
+
+	content := grabArticle(body)
+	cleanArticle(content)
+
+	var b bytes.Buffer
+	if err := html.Render(&b, content); err != nil {
+		return nil, err
+	}
+	a.Content = b.String()
+	return a, nil
+}
+
+// findElement returns the first element under n with the supplied atom.
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := findElement(c, a); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// findElements returns all elements under n (including n) with the supplied atom.
+func findElements(n *html.Node, a atom.Atom) []*html.Node {
+	var found []*html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == a {
+			found = append(found, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return found
+}
+
+func getNodeAttrOK(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func getNodeAttr(n *html.Node, key string) string {
+	v, _ := getNodeAttrOK(n, key)
+	return v
+}
+
+// getText returns n's text content with whitespace collapsed.
+func getText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			b.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.TrimSpace(whitespaceRegexp.ReplaceAllString(b.String(), " "))
+}
+
+// getLinkDensity returns the fraction of n's text that is contained in links.
+func getLinkDensity(n *html.Node) float64 {
+	textLen := len(getText(n))
+	if textLen == 0 {
+		return 0
+	}
+	linkLen := 0
+	for _, a := range findElements(n, atom.A) {
+		linkLen += len(getText(a))
+	}
+	return float64(linkLen) / float64(textLen)
+}
+
+// getClassWeight returns a positive or negative weight based on n's class and ID.
+func getClassWeight(n *html.Node) float64 {
+	var w float64
+	for _, s := range []string{getNodeAttr(n, "class"), getNodeAttr(n, "id")} {
+		if s == "" {
+			continue
+		}
+		if negativeRegexp.MatchString(s) {
+			w -= 25
+		}
+		if positiveRegexp.MatchString(s) {
+			w += 25
+		}
+	}
+	return w
+}
+
+// getMetaContent returns the content of the first <meta> element whose name
+// or property matches one of names (case-insensitively).
+func getMetaContent(doc *html.Node, names ...string) string {
+	metas := findElements(doc, atom.Meta)
+	for _, name := range names {
+		for _, m := range metas {
+			for _, key := range []string{"name", "property", "itemprop"} {
+				if strings.EqualFold(getNodeAttr(m, key), name) {
+					if c := strings.TrimSpace(getNodeAttr(m, "content")); c != "" {
+						return c
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// getDocTitle returns the article's title.
+func getDocTitle(doc *html.Node) string {
+	if t := getMetaContent(doc, "og:title", "twitter:title", "dc.title"); t != "" {
+		return t
+	}
+	if n := findElement(doc, atom.Title); n != nil {
+		// Strip site names from titles like "Article Title | Site Name" as
+		// long as a reasonable-looking title remains.
+		t := getText(n)
+		if locs := titleSeparatorRegexp.FindAllStringIndex(t, -1); len(locs) > 0 {
+			if s := t[:locs[len(locs)-1][0]]; len(strings.Fields(s)) >= 3 {
+				return s
+			}
+		}
+		if t != "" {
+			return t
+		}
+	}
+	if n := findElement(doc, atom.H1); n != nil {
+		return getText(n)
+	}
+	return ""
+}
+
+// setDocMetadata sets a's Excerpt, LeadImageURL, and Language fields from doc's
+// metadata, which was loaded from pageURL.
+func setDocMetadata(a *Article, doc *html.Node, pageURL string) {
+	a.Excerpt = getMetaContent(doc, "description", "og:description", "twitter:description")
+	if img := getMetaContent(doc, "og:image", "twitter:image", "image"); img != "" {
+		a.LeadImageURL = resolveURL(pageURL, img)
+	}
+	if n := findElement(doc, atom.Html); n != nil {
+		a.Language = strings.TrimSpace(getNodeAttr(n, "lang"))
+	}
+	if a.Language == "" {
+		a.Language = getMetaContent(doc, "og:locale", "language", "content-language")
+	}
+}
+
+// getDocDate returns the article's publication date as a string.
+func getDocDate(doc *html.Node) string {
+	if d := getMetaContent(doc, "article:published_time", "datePublished", "date", "pubdate",
+		"publishdate", "dc.date.issued", "parsely-pub-date", "sailthru.date"); d != "" {
+		return d
+	}
+	for _, t := range findElements(doc, atom.Time) {
+		if d := getNodeAttr(t, "datetime"); d != "" {
+			return d
+		}
+	}
+	return ""
+}
+
+// findNextPageURL returns the absolute URL of the article's next page, if any.
+func findNextPageURL(doc *html.Node, pageURL string) string {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	resolve := func(href string) string {
+		u, err := base.Parse(strings.TrimSpace(href))
+		if err != nil || u.Host != base.Host || (u.Scheme != "http" && u.Scheme != "https") {
+			return ""
+		}
+		u.Fragment = ""
+		if s := u.String(); s != pageURL {
+			return s
+		}
+		return ""
+	}
+
+	for _, a := range []atom.Atom{atom.Link, atom.A} {
+		for _, n := range findElements(doc, a) {
+			for _, rel := range strings.Fields(getNodeAttr(n, "rel")) {
+				if strings.EqualFold(rel, "next") {
+					if u := resolve(getNodeAttr(n, "href")); u != "" {
+						return u
+					}
+				}
+			}
+		}
+	}
+
+	// Fall back to links within pagination containers with text like "Next".
+	var next string
+	var walk func(n *html.Node, inPager bool)
+	walk = func(n *html.Node, inPager bool) {
+		if next != "" {
+			return
+		}
+		if n.Type == html.ElementNode {
+			ci := getNodeAttr(n, "class") + " " + getNodeAttr(n, "id")
+			if strings.Contains(strings.ToLower(ci), "pagination") || strings.Contains(strings.ToLower(ci), "pager") {
+				inPager = true
+			}
+			if n.DataAtom == atom.A && inPager {
+				if t := getText(n); t != "" && nextLinkTextRegexp.MatchString(t) {
+					next = resolve(getNodeAttr(n, "href"))
+					return
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, inPager)
+		}
+	}
+	walk(doc, false)
+	return next
+}
+
+// isHidden returns true if n is an element that won't be displayed.
+func isHidden(n *html.Node) bool {
+	if _, ok := getNodeAttrOK(n, "hidden"); ok {
+		return true
+	}
+	if getNodeAttr(n, "aria-hidden") == "true" {
+		return true
+	}
+	style := strings.ToLower(strings.Replace(getNodeAttr(n, "style"), " ", "", -1))
+	return strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden")
+}
+
+// prepareBody removes elements from body that are unlikely to be part of the
+// article. The text of the first byline element that's found is returned.
+func prepareBody(body *html.Node) (byline string) {
+	var walk func(n *html.Node, inTable bool)
+	walk = func(n *html.Node, inTable bool) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			remove := false
+			switch c.Type {
+			case html.CommentNode:
+				remove = true
+			case html.ElementNode:
+				ci := getNodeAttr(c, "class") + " " + getNodeAttr(c, "id")
+				if removedAtoms[c.DataAtom] || isHidden(c) {
+					remove = true
+				} else if byline == "" && bylineRegexp.MatchString(ci) {
+					if t := getText(c); t != "" && len(t) < 100 {
+						byline = bylinePrefixRegexp.ReplaceAllString(t, "")
+						remove = true
+					}
+				}
+				if !remove && !inTable && c.DataAtom != atom.A && c.DataAtom != atom.Article &&
+					unlikelyCandidatesRegexp.MatchString(ci) && !maybeCandidateRegexp.MatchString(ci) {
+					remove = true
+				}
+			}
+			if remove {
+				n.RemoveChild(c)
+			} else {
+				walk(c, inTable || c.DataAtom == atom.Table || c.DataAtom == atom.Code)
+			}
+			c = next
+		}
+	}
+	walk(body, false)
+	return byline
+}
+
+// isParagraphLike returns true if n's text should be scored.
+func isParagraphLike(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if scoredAtoms[n.DataAtom] {
+		return true
+	}
+	if n.DataAtom != atom.Div {
+		return false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && blockAtoms[c.DataAtom] {
+			return false
+		}
+	}
+	return true
+}
+
+// getInitialScore returns the score assigned to n before paragraph scores are added.
+func getInitialScore(n *html.Node) float64 {
+	var s float64
+	switch n.DataAtom {
+	case atom.Div, atom.Article:
+		s = 5
+	case atom.Pre, atom.Td, atom.Blockquote:
+		s = 3
+	case atom.Address, atom.Ol, atom.Ul, atom.Dl, atom.Dd, atom.Dt, atom.Li, atom.Form:
+		s = -3
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Th:
+		s = -5
+	}
+	return s + getClassWeight(n)
+}
+
+// grabArticle returns a new <div> element containing the best-scoring content from body.
+func grabArticle(body *html.Node) *html.Node {
+	scores := make(map[*html.Node]float64)
+	var candidates []*html.Node
+
+	var paragraphs []*html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if isParagraphLike(n) {
+			paragraphs = append(paragraphs, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(body)
+
+	for _, p := range paragraphs {
+		text := getText(p)
+		if len(text) < minParagraphLen {
+			continue
+		}
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(len(text)/100), 3)
+		level := 0
+		for anc := p.Parent; anc != nil && anc.Type == html.ElementNode && level < maxScoreAncestors; anc = anc.Parent {
+			if _, ok := scores[anc]; !ok {
+				scores[anc] = getInitialScore(anc)
+				candidates = append(candidates, anc)
+			}
+			divider := 1.0
+			if level == 1 {
+				divider = 2
+			} else if level > 1 {
+				divider = float64(level * 3)
+			}
+			scores[anc] += score / divider
+			level++
+		}
+	}
+
+	var top *html.Node
+	for _, c := range candidates {
+		scores[c] *= 1 - getLinkDensity(c)
+		if top == nil || scores[c] > scores[top] {
+			top = c
+		}
+	}
+
+	article := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	if top == nil || top == body || top.Parent == nil {
+		for c := body.FirstChild; c != nil; {
+			next := c.NextSibling
+			body.RemoveChild(c)
+			article.AppendChild(c)
+			c = next
+		}
+		return article
+	}
+
+	// Include siblings that look like they're also part of the article.
+	topScore := scores[top]
+	threshold := math.Max(10, topScore*0.2)
+	topClass := getNodeAttr(top, "class")
+	var keep []*html.Node
+	for s := top.Parent.FirstChild; s != nil; s = s.NextSibling {
+		if s == top {
+			keep = append(keep, s)
+			continue
+		}
+		if s.Type != html.ElementNode {
+			continue
+		}
+		bonus := 0.0
+		if topClass != "" && getNodeAttr(s, "class") == topClass {
+			bonus = topScore * 0.2
+		}
+		if score, ok := scores[s]; ok && score+bonus >= threshold {
+			keep = append(keep, s)
+		} else if s.DataAtom == atom.P {
+			text := getText(s)
+			density := getLinkDensity(s)
+			if (len(text) > 80 && density < 0.25) ||
+				(len(text) > 0 && density == 0 && sentenceEndRegexp.MatchString(text)) {
+				keep = append(keep, s)
+			}
+		}
+	}
+	for _, n := range keep {
+		n.Parent.RemoveChild(n)
+		article.AppendChild(n)
+	}
+	return article
+}
+
+// hasEmbeddedContent returns true if n contains images or other media.
+func hasEmbeddedContent(n *html.Node) bool {
+	for _, a := range []atom.Atom{atom.Img, atom.Picture, atom.Video, atom.Audio, atom.Svg} {
+		if findElement(n, a) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanArticle removes link-heavy and empty elements from the chosen content.
+func cleanArticle(article *html.Node) {
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type == html.ElementNode && shouldCleanNode(c) {
+				n.RemoveChild(c)
+			} else {
+				walk(c)
+			}
+			c = next
+		}
+	}
+	walk(article)
+}
+
+func shouldCleanNode(n *html.Node) bool {
+	text := getText(n)
+	if n.DataAtom == atom.P {
+		return text == "" && !hasEmbeddedContent(n)
+	}
+	if !conditionallyCleanedAtoms[n.DataAtom] {
+		return false
+	}
+	if getClassWeight(n) < 0 {
+		return true
+	}
+	if text == "" {
+		return !hasEmbeddedContent(n)
+	}
+	density := getLinkDensity(n)
+	if n.DataAtom == atom.Ul || n.DataAtom == atom.Ol {
+		// Lists of links are usually navigation or related articles.
+		return density > 0.5 && len(findElements(n, atom.Li)) > 2
+	}
+	if n.DataAtom == atom.Form {
+		// Forms without any sentences are usually search or signup boxes
+		// (their inputs have already been removed).
+		return density > 0.5 || !sentenceEndRegexp.MatchString(text)
+	}
+	return density > 0.5
+}
@@ -0,0 +1,123 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	articlePath     = "testdata/article.html"
+	articleURL      = "https://news.example.com/cats"
+	formArticlePath = "testdata/form_article.html"
+	formArticleURL  = "https://news.example.com/dogs"
+)
+
+func TestNativeExtract(t *testing.T) {
+	f, err := os.Open(articlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	a, err := nativeExtract(f, articleURL)
+	if err != nil {
+		t.Fatal("Extraction failed: ", err)
+	}
+	if want := "Why Cats Sleep So Much"; a.Title != want {
+		t.Errorf("Title = %q; want %q", a.Title, want)
+	}
+	if want := "Jane Doe"; a.Author != want {
+		t.Errorf("Author = %q; want %q", a.Author, want)
+	}
+	if want := "2020-03-04T05:06:07Z"; a.DatePublished != want {
+		t.Errorf("DatePublished = %q; want %q", a.DatePublished, want)
+	}
+	if want := "https://news.example.com/cats?page=2"; a.NextPageURL != want {
+		t.Errorf("NextPageURL = %q; want %q", a.NextPageURL, want)
+	}
+	if want := "Cats spend most of the day asleep."; a.Excerpt != want {
+		t.Errorf("Excerpt = %q; want %q", a.Excerpt, want)
+	}
+	if want := "https://news.example.com/images/sleeping-cat.jpg"; a.LeadImageURL != want {
+		t.Errorf("LeadImageURL = %q; want %q", a.LeadImageURL, want)
+	}
+	if want := "en"; a.Language != want {
+		t.Errorf("Language = %q; want %q", a.Language, want)
+	}
+
+	for _, s := range []string{
+		"Cats sleep for an average",
+		"Scientists believe",
+		`<img src="/images/sleeping-cat.jpg"`,
+		"comfortable lifestyles",
+	} {
+		if !strings.Contains(a.Content, s) {
+			t.Errorf("Content doesn't contain %q:\n%v", s, a.Content)
+		}
+	}
+	for _, s := range []string{
+		"tracking",
+		"Popular stories",
+		"Share on Facebook",
+		"Email address",
+		"First comment",
+		"Copyright",
+	} {
+		if strings.Contains(a.Content, s) {
+			t.Errorf("Content unexpectedly contains %q:\n%v", s, a.Content)
+		}
+	}
+}
+
+func TestNativeExtract_BodyForm(t *testing.T) {
+	// Some sites (e.g. ASP.NET ones) wrap the entire body in a <form>.
+	f, err := os.Open(formArticlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	a, err := nativeExtract(f, formArticleURL)
+	if err != nil {
+		t.Fatal("Extraction failed: ", err)
+	}
+	for _, s := range []string{
+		"Dogs learn new tricks",
+		"Trainers recommend",
+		"Older dogs can still learn",
+	} {
+		if !strings.Contains(a.Content, s) {
+			t.Errorf("Content doesn't contain %q:\n%v", s, a.Content)
+		}
+	}
+	for _, s := range []string{
+		"Sports",
+		"VIEWSTATE",
+	} {
+		if strings.Contains(a.Content, s) {
+			t.Errorf("Content unexpectedly contains %q:\n%v", s, a.Content)
+		}
+	}
+}
+
+func TestParsePubDate(t *testing.T) {
+	for _, s := range []string{
+		"2020-03-04T05:06:07Z",
+		"2020-03-04T05:06:07.000Z",
+		"2020-03-04 05:06:07",
+		"2020-03-04",
+	} {
+		if d, err := parsePubDate(s); err != nil {
+			t.Errorf("parsePubDate(%q) failed: %v", s, err)
+		} else if d.Year() != 2020 || d.Month() != 3 || d.Day() != 4 {
+			t.Errorf("parsePubDate(%q) = %v", s, d)
+		}
+	}
+	if _, err := parsePubDate("last Tuesday"); err == nil {
+		t.Error("parsePubDate didn't fail for bogus date")
+	}
+}
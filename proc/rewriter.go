@@ -4,8 +4,10 @@
 package proc
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"regexp"
 	"strings"
 
@@ -48,10 +50,184 @@ func getAttrValue(token *html.Token, name string) string {
 	return ""
 }
 
+// getTextContent returns the text within the HTML in content with whitespace collapsed.
+func getTextContent(content string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(whitespaceRegexp.ReplaceAllString(b.String(), " "))
+		case html.TextToken:
+			b.Write(z.Text())
+			b.WriteByte(' ')
+		}
+	}
+}
+
+// getPageText returns the text within the content <div> of an index file written
+// by downloadContent, matching the text that was originally saved in PageInfo.Text.
+func getPageText(doc string) (string, error) {
+	root, err := html.Parse(strings.NewReader(doc))
+	if err != nil {
+		return "", err
+	}
+	var find func(n *html.Node) *html.Node
+	find = func(n *html.Node) *html.Node {
+		if n.Type == html.ElementNode && n.Data == "div" {
+			for _, attr := range n.Attr {
+				if attr.Key == "class" && attr.Val == "content" {
+					return n
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if m := find(c); m != nil {
+				return m
+			}
+		}
+		return nil
+	}
+	n := find(root)
+	if n == nil {
+		return "", errors.New("no content found")
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&b, c); err != nil {
+			return "", err
+		}
+	}
+	return getTextContent(b.String()), nil
+}
+
+// getFirstImage returns the src attribute of the first <img> tag in content.
+func getFirstImage(content string) string {
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if t := z.Token(); t.Data == "img" {
+				if src := getAttrValue(&t, "src"); src != "" {
+					return src
+				}
+			}
+		}
+	}
+}
+
 type rewriter struct {
 	cfg *common.Config
 }
 
+// urlAttrs contains the attributes whose URLs are resolved by rewriteContent.
+var urlAttrs = map[string]bool{"href": true, "poster": true, "src": true}
+
+// unsafeElements contains elements that are dropped along with their contents
+// since they could run scripts or load external content when pages are displayed.
+var unsafeElements = map[string]bool{
+	"applet": true,
+	"embed":  true,
+	"meta":   true,
+	"object": true,
+	"script": true,
+	"style":  true,
+}
+
+// scriptURLAttrs contains the attributes that are dropped if they hold script URLs.
+var scriptURLAttrs = map[string]bool{
+	"action":     true,
+	"background": true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"poster":     true,
+	"src":        true,
+	"xlink:href": true,
+}
+
+// isScriptURL returns true if u uses the javascript: or vbscript: scheme.
+// Browsers ignore whitespace and control characters within schemes.
+func isScriptURL(u string) bool {
+	u = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, u))
+	return strings.HasPrefix(u, "javascript:") || strings.HasPrefix(u, "vbscript:")
+}
+
+// sanitizeAttrs removes event handlers and script URLs from t's attributes.
+func sanitizeAttrs(t *html.Token) {
+	attrs := t.Attr[:0]
+	for _, attr := range t.Attr {
+		if strings.HasPrefix(attr.Key, "on") || (scriptURLAttrs[attr.Key] && isScriptURL(attr.Val)) {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	t.Attr = attrs
+}
+
+// urlResolver resolves relative URLs within an article's content.
+type urlResolver struct {
+	base *url.URL        // nil if the base URL couldn't be parsed
+	docs map[string]bool // fragment-less URLs referring to the article's page
+}
+
+// newURLResolver returns a urlResolver that resolves URLs against baseURL.
+// pageURL is the URL from which the article was loaded.
+func newURLResolver(pageURL, baseURL string) *urlResolver {
+	ur := urlResolver{docs: make(map[string]bool)}
+	for _, s := range []string{pageURL, baseURL} {
+		if u, err := url.Parse(s); err == nil && u.IsAbs() {
+			u.Fragment = ""
+			ur.docs[u.String()] = true
+			ur.base = u
+		}
+	}
+	return &ur
+}
+
+// resolve returns the absolute form of ref. ref is returned unchanged if it
+// can't be resolved.
+func (ur *urlResolver) resolve(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ur.base == nil || ref == "" {
+		return ref
+	}
+	u, err := ur.base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
+
+// resolveLink is similar to resolve, but links to fragments within the article's
+// page are returned as bare fragments (e.g. "#section") so they'll continue to
+// work when the content is served from a different location.
+func (ur *urlResolver) resolveLink(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "#") || ur.base == nil {
+		return ref
+	}
+	u, err := ur.base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	if u.Fragment != "" {
+		doc := *u
+		doc.Fragment, doc.RawFragment = "", ""
+		if ur.docs[doc.String()] {
+			return "#" + u.EscapedFragment()
+		}
+	}
+	return u.String()
+}
+
 // readHiddenTagsFile returns maps containing the tags that should be hidden for url.
 func (rw *rewriter) readHiddenTagsFile(url string) (*hiddenIdsMap, *hiddenTagsMap, error) {
 	ids := make(hiddenIdsMap)
@@ -72,7 +248,7 @@ func (rw *rewriter) readHiddenTagsFile(url string) (*hiddenIdsMap, *hiddenTagsMa
 
 	urlHost := common.GetHost(url)
 	for host, entries := range data {
-		if host != "*" && host != urlHost && !strings.HasSuffix(urlHost, "."+host) {
+		if !common.HostMatches(host, urlHost) {
 			continue
 		}
 
@@ -125,32 +301,99 @@ func (rw *rewriter) shouldHideToken(t *html.Token, ids *hiddenIdsMap, tags *hidd
 	return false
 }
 
-// fixImageURL fixes up <img> elements that Readability decided to break because
-// they had srcset attributes. Specifically, an <img> element with both src and
-// srcset attributes seems to end up with just a src attribute containing a
-// URL-escaped copy of the srcset value. That makes absolutely no sense.
-func (rw *rewriter) fixImageURL(url string) string {
-	if m, _ := regexp.MatchString("%20\\d+[wx](,|$)", url); !m {
-		return url
+// Attributes that are commonly used to hold the URLs of lazily-loaded images,
+// in order of preference.
+var (
+	lazySrcAttrs    = []string{"data-src", "data-lazy-src", "data-original", "data-lazy", "data-hi-res-src", "data-url"}
+	lazySrcsetAttrs = []string{"data-srcset", "data-lazy-srcset"}
+)
+
+// imageURLAttrs contains <img> attributes that are replaced by a single src
+// attribute containing the URL chosen by getImageURL.
+var imageURLAttrs = map[string]bool{"src": true, "srcset": true, "sizes": true, "loading": true}
+
+func init() {
+	for _, a := range append(lazySrcAttrs, lazySrcsetAttrs...) {
+		imageURLAttrs[a] = true
+	}
+}
+
+// supportedSourceTypes contains the MIME types of <picture> <source> elements
+// whose images can be used.
+var supportedSourceTypes = map[string]bool{
+	"":           true,
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/jpg":  true,
+	"image/png":  true,
+}
+
+// brokenSrcRegexp matches src attributes that Readability broke because the
+// <img> element also had a srcset attribute: the src attribute ends up holding
+// a URL-escaped copy of the srcset value.
+var brokenSrcRegexp = regexp.MustCompile(`%20\d+(\.\d+)?[wx](,|$)`)
+
+// getSrcsetAttr returns t's srcset value, preferring lazily-loaded values.
+func getSrcsetAttr(t *html.Token) string {
+	for _, a := range lazySrcsetAttrs {
+		if v := getAttrValue(t, a); strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return getAttrValue(t, "srcset")
+}
+
+// getImageURL returns the URL of the image that should be displayed for the <img>
+// token t, considering lazy-loading attributes, srcset, and candidates from
+// preceding <source> elements within the same <picture> element.
+// An empty string is returned if t only references a placeholder.
+func (rw *rewriter) getImageURL(t *html.Token, sources []imageCandidate) string {
+	src := strings.TrimSpace(getAttrValue(t, "src"))
+	for _, a := range lazySrcAttrs {
+		if v := strings.TrimSpace(getAttrValue(t, a)); !isPlaceholderImage(v) {
+			src = v
+			break
+		}
 	}
-	// Just chop off the first space and everything after it.
-	index := strings.Index(url, "%20")
-	newURL := url[0:index]
-	rw.cfg.Logger.Printf("Rewrote broken-looking image URL %q to %q\n", url, newURL)
-	return newURL
+
+	cands := append([]imageCandidate{}, sources...)
+	if brokenSrcRegexp.MatchString(src) {
+		if u, err := url.PathUnescape(src); err == nil {
+			cands = append(cands, parseSrcset(u)...)
+			src = ""
+		}
+	}
+	cands = append(cands, parseSrcset(getSrcsetAttr(t))...)
+	if !isPlaceholderImage(src) {
+		cands = append(cands, imageCandidate{url: src})
+	}
+	var valid []imageCandidate
+	for _, c := range cands {
+		if !isPlaceholderImage(c.url) {
+			valid = append(valid, c)
+		}
+	}
+	return chooseImageCandidate(valid, rw.cfg.MaxImageWidth)
 }
 
-// rewriteContent rewrites HTML that is passed to it. imageURLs maps from local
-// filename to the original remote image URL.
-func (rw *rewriter) rewriteContent(input, url string) (content string, imageURLs map[string]string, err error) {
-	hiddenIds, hiddenTags, err := rw.readHiddenTagsFile(url)
+// rewriteContent rewrites HTML that is passed to it. pageURL is the URL from which
+// the content was loaded, and relative URLs are resolved against baseURL.
+// imageURLs maps from local filename to the original remote image URL.
+func (rw *rewriter) rewriteContent(input, pageURL, baseURL string) (content string, imageURLs map[string]string, err error) {
+	hiddenIds, hiddenTags, err := rw.readHiddenTagsFile(pageURL)
 	if err != nil {
 		return "", nil, err
 	}
+	ur := newURLResolver(pageURL, baseURL)
 
 	imageURLs = make(map[string]string)
 	hideDepth := 0
 
+	var sources []imageCandidate // from <source> elements in the current <picture>
+	inPicture := false
+	inNoscript := false
+	lastImageURL := "" // URL of the last-written image
+
 	z := html.NewTokenizer(strings.NewReader(input))
 	for {
 		if z.Next() == html.ErrorToken {
@@ -174,6 +417,14 @@ func (rw *rewriter) rewriteContent(input, url string) (content string, imageURLs
 			continue
 		}
 
+		// Saved pages are served from the same origin as the rest of the app.
+		if unsafeElements[t.Data] && (isStart || isEnd || t.Type == html.SelfClosingTagToken) {
+			if isStart && !isVoid {
+				hideDepth = 1
+			}
+			continue
+		}
+
 		if rw.shouldHideToken(&t, hiddenIds, hiddenTags) {
 			rw.cfg.Logger.Printf("Hiding <%v> token with id %q and class(es) %q\n",
 				t.Data, getAttrValue(&t, "id"), getAttrValue(&t, "class"))
@@ -185,36 +436,48 @@ func (rw *rewriter) rewriteContent(input, url string) (content string, imageURLs
 
 		extraText := ""
 
-		if isStart && t.Data == "img" {
-			hasSrc := false
-			numAttr := 0
-			for i := range t.Attr {
-				attr := &t.Attr[i]
-				if attr.Key == "src" && len(attr.Val) > 0 {
-					hasSrc = true
-					if rw.cfg.DownloadImages {
-						imageURL := rw.fixImageURL(attr.Val)
-						filename := common.LocalImageFilename(imageURL)
-						imageURLs[filename] = imageURL
-						attr.Val = filename
-					}
-				} else if attr.Key == "title" && len(attr.Val) > 0 {
-					extraText = "\n<div class=\"img-title\">" +
-						html.EscapeString(attr.Val) + "</div>\n"
-				} else if attr.Key == "srcset" {
-					// Drop srcset attributes, since browsers will load them
-					// preferentially over rewritten src attributes.
-					continue
-				}
-				t.Attr[numAttr] = *attr
-				numAttr++
+		if (isStart || isEnd) && t.Data == "picture" {
+			// Drop <picture> elements but keep their <img> fallbacks.
+			inPicture = isStart
+			sources = nil
+			continue
+		} else if (isStart || t.Type == html.SelfClosingTagToken) && t.Data == "source" && inPicture {
+			if supportedSourceTypes[strings.ToLower(strings.TrimSpace(getAttrValue(&t, "type")))] {
+				sources = append(sources, parseSrcset(getSrcsetAttr(&t))...)
 			}
-			if !hasSrc {
+			continue
+		} else if (isStart || t.Type == html.SelfClosingTagToken) && t.Data == "img" {
+			imageURL := ur.resolve(rw.getImageURL(&t, sources))
+			sources = nil
+			if imageURL == "" {
 				// kindlegen barfs on empty <img> tags. One appears in
 				// http://online.wsj.com/articles/google-to-collect-data-to-define-healthy-human-1406246214.
+				// Images that only reference placeholders are also useless.
+				continue
+			}
+			if inNoscript && imageURL == lastImageURL {
+				// Skip <noscript> copies of lazily-loaded images that were already written.
 				continue
 			}
-			t.Attr = t.Attr[:numAttr]
+			lastImageURL = imageURL
+
+			src := imageURL
+			if rw.cfg.DownloadImages {
+				src = common.LocalImageFilename(imageURL)
+				imageURLs[src] = imageURL
+			}
+			attrs := []html.Attribute{{Key: "src", Val: src}}
+			for _, attr := range t.Attr {
+				if imageURLAttrs[attr.Key] {
+					continue
+				}
+				if attr.Key == "title" && len(attr.Val) > 0 {
+					extraText = "\n<div class=\"img-title\">" +
+						html.EscapeString(attr.Val) + "</div>\n"
+				}
+				attrs = append(attrs, attr)
+			}
+			t.Attr = attrs
 		} else if (isStart || isEnd) && t.Data == "h1" {
 			// Downgrade <h1> to <h2>.
 			t.Data = "h2"
@@ -222,16 +485,20 @@ func (rw *rewriter) rewriteContent(input, url string) (content string, imageURLs
 			// <h6> seems to mainly be used by people who don't know what
 			// they're doing. Upgrade <h4>, <h5>, and <h6> to <h3>.
 			t.Data = "h3"
+		} else if (isStart || t.Type == html.SelfClosingTagToken) && t.Data == "base" {
+			// Relative URLs have already been resolved.
+			continue
 		} else if isStart && t.Data == "iframe" {
 			// Readability puts YouTube videos into iframes but kindlegen
 			// doesn't know what to do with them.
 			continue
 		} else if (isStart || isEnd) && t.Data == "noscript" {
 			// Tell the tokenizer to interpret nested elements. This handles the
-			// non-JS tags for lazily-loaded images on theverge.com.
+			// non-JS tags for lazily-loaded images on many sites.
 			if isStart {
 				z.NextIsNotRawText()
 			}
+			inNoscript = isStart
 			// Keep kindlegen from complaining about <noscript>.
 			continue
 		} else if (isStart || isEnd) && t.Data == "body" {
@@ -239,9 +506,19 @@ func (rw *rewriter) rewriteContent(input, url string) (content string, imageURLs
 			// sometimes? See e.g.
 			// http://kirtimukha.com/surfings/Cogitation/wisdom_of_insecurity_by_alan_wat.htm
 			continue
+		} else if isStart || t.Type == html.SelfClosingTagToken {
+			for i := range t.Attr {
+				if attr := &t.Attr[i]; attr.Key == "href" {
+					attr.Val = ur.resolveLink(attr.Val)
+				} else if urlAttrs[attr.Key] {
+					attr.Val = ur.resolve(attr.Val)
+				}
+			}
 		}
 
+		if isStart || t.Type == html.SelfClosingTagToken {
+			sanitizeAttrs(&t)
+		}
 		content += t.String() + extraText
 	}
-	return content, imageURLs, nil
 }
@@ -22,9 +22,15 @@ const (
 
 var expectedImages []string = []string{
 	"http://www.example.com/img.png",
-	"http://assets.bwbx.io/images/i6vlZjCDxVKs/v1/488x-1.jpg",
+	"http://assets.bwbx.io/images/i6vlZjCDxVKs/v1/628x-1.jpg",
 	"http://cdn.arstechnica.net/wp-content/uploads/2016/01/Screen-Shot-2016-01-30-at-11.30.32-PM-1280x562.png",
-	"http://a.com/drop-srcset.png",
+	"http://a.com/img-2x.png",
+	"http://a.com/lazy.jpg",
+	"http://a.com/lazy-2x.jpg",
+	"http://a.com/original.png",
+	"http://a.com/pic-small.jpg",
+	"http://www.example.com/images/relative.png",
+	"http://cdn.example.com/protocol-relative.jpg",
 }
 
 func TestBasic(t *testing.T) {
@@ -32,13 +38,14 @@ func TestBasic(t *testing.T) {
 		HiddenTagsFile: hiddenTagsPath,
 		Logger:         log.New(os.Stderr, "", log.LstdFlags),
 		DownloadImages: true,
+		MaxImageWidth:  640,
 	}}
 
 	input, err := ioutil.ReadFile(inputPath)
 	if err != nil {
 		t.Fatal(err)
 	}
-	output, imageURLs, err := rw.rewriteContent(string(input), inputURL)
+	output, imageURLs, err := rw.rewriteContent(string(input), inputURL, inputURL)
 
 	// Whitespace is a pain. Ignore empty lines.
 	emptyLineRegexp := regexp.MustCompile("\n\\s*\n")
@@ -65,3 +72,59 @@ func TestBasic(t *testing.T) {
 		}
 	}
 }
+
+func TestURLResolver(t *testing.T) {
+	const (
+		pageURL = "https://www.example.com/2020/01/article.html?page=2"
+		baseURL = "https://cdn.example.com/static/"
+	)
+	ur := newURLResolver(pageURL, baseURL)
+	for _, tc := range []struct {
+		ref  string
+		link bool // call resolveLink instead of resolve
+		want string
+	}{
+		{"img.png", false, "https://cdn.example.com/static/img.png"},
+		{"/img.png", false, "https://cdn.example.com/img.png"},
+		{"//other.example.com/img.png", false, "https://other.example.com/img.png"},
+		{" http://a.com/img.png ", false, "http://a.com/img.png"},
+		{"", false, ""},
+		{"#top", true, "#top"},
+		{"../page.html", true, "https://cdn.example.com/page.html"},
+		{pageURL + "#fn1", true, "#fn1"},
+		{baseURL + "#fn%202", true, "#fn%202"},
+		{"https://www.example.com/2020/01/article.html#fn1", true,
+			"https://www.example.com/2020/01/article.html#fn1"},
+		{"mailto:me@example.com", true, "mailto:me@example.com"},
+	} {
+		got := ur.resolve(tc.ref)
+		if tc.link {
+			got = ur.resolveLink(tc.ref)
+		}
+		if got != tc.want {
+			t.Errorf("Resolving %q (link=%v) returned %q; want %q", tc.ref, tc.link, got, tc.want)
+		}
+	}
+}
+
+func TestGetPageText(t *testing.T) {
+	const doc = `<html><head><title>Title</title></head><body>
+<h1 id="title-header">Title</h1>
+<form id="top-links"><button type="submit">Send to Kindle</button></form>
+<div class="content">
+  <p>First   paragraph.</p>
+  <div class="img-title">Caption</div>
+  <p>Second <b>paragraph</b>.</p>
+</div>
+<form id="end-paragraph"><button type="submit">Toggle archived</button></form>
+</body></html>`
+	const want = "First paragraph. Caption Second paragraph ."
+	if got, err := getPageText(doc); err != nil {
+		t.Errorf("getPageText failed: %v", err)
+	} else if got != want {
+		t.Errorf("getPageText returned %q; want %q", got, want)
+	}
+	if _, err := getPageText("<html><body><p>No content</p></body></html>"); err == nil {
+		t.Error("getPageText unexpectedly succeeded without content")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxImageDensity is the highest pixel density that chooseImageCandidate will
+// select when candidates only have density descriptors.
+const maxImageDensity = 2
+
+// imageCandidate describes an image URL from a srcset attribute or an <img>
+// element's src attribute.
+type imageCandidate struct {
+	url     string
+	width   int     // width in pixels from a "w" descriptor, or 0 if unspecified
+	density float64 // pixel density from an "x" descriptor, or 0 if unspecified
+}
+
+// parseSrcset parses s, the value of a srcset attribute, as described at
+// https://html.spec.whatwg.org/multipage/images.html#parsing-a-srcset-attribute.
+// Candidates with invalid descriptors are skipped.
+func parseSrcset(s string) []imageCandidate {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+
+	var cands []imageCandidate
+	for i := 0; i < len(s); {
+		// Skip whitespace and commas preceding the URL.
+		for i < len(s) && (isSpace(s[i]) || s[i] == ',') {
+			i++
+		}
+		if i == len(s) {
+			break
+		}
+		start := i
+		for i < len(s) && !isSpace(s[i]) {
+			i++
+		}
+		u := s[start:i]
+
+		// A URL ending in commas has no descriptors.
+		var desc string
+		if strings.HasSuffix(u, ",") {
+			u = strings.TrimRight(u, ",")
+		} else {
+			// Descriptors run until the next comma that isn't within parentheses.
+			start = i
+			depth := 0
+			for ; i < len(s) && (s[i] != ',' || depth > 0); i++ {
+				if s[i] == '(' {
+					depth++
+				} else if s[i] == ')' && depth > 0 {
+					depth--
+				}
+			}
+			desc = s[start:i]
+		}
+		if u == "" {
+			continue
+		}
+
+		c := imageCandidate{url: u}
+		valid := true
+		for _, d := range strings.Fields(desc) {
+			if len(d) < 2 {
+				valid = false
+				break
+			}
+			switch num := d[:len(d)-1]; d[len(d)-1] {
+			case 'w':
+				n, err := strconv.Atoi(num)
+				if err != nil || n <= 0 || c.width != 0 || c.density != 0 {
+					valid = false
+				}
+				c.width = n
+			case 'x':
+				f, err := strconv.ParseFloat(num, 64)
+				if err != nil || f <= 0 || c.width != 0 || c.density != 0 {
+					valid = false
+				}
+				c.density = f
+			case 'h':
+				// Height descriptors are reserved for future use and ignored.
+			default:
+				valid = false
+			}
+		}
+		if valid {
+			cands = append(cands, c)
+		}
+	}
+	return cands
+}
+
+// chooseImageCandidate returns the URL of the best candidate for display at
+// up to maxWidth pixels wide (unlimited if 0 or negative). Candidates with width
+// descriptors are preferred: the widest one that fits is returned, or the narrowest
+// one if none fit. Otherwise, the densest candidate up to maxImageDensity is returned,
+// with candidates lacking descriptors treated as 1x. An empty string is returned if
+// cands is empty.
+func chooseImageCandidate(cands []imageCandidate, maxWidth int) string {
+	var best, narrowest *imageCandidate
+	for i := range cands {
+		c := &cands[i]
+		if c.width == 0 {
+			continue
+		}
+		if narrowest == nil || c.width < narrowest.width {
+			narrowest = c
+		}
+		if (maxWidth <= 0 || c.width <= maxWidth) && (best == nil || c.width > best.width) {
+			best = c
+		}
+	}
+	if best != nil {
+		return best.url
+	} else if narrowest != nil {
+		return narrowest.url
+	}
+
+	density := func(c *imageCandidate) float64 {
+		if c.density == 0 {
+			return 1
+		}
+		return c.density
+	}
+	var lowest *imageCandidate
+	for i := range cands {
+		c := &cands[i]
+		if lowest == nil || density(c) < density(lowest) {
+			lowest = c
+		}
+		if density(c) <= maxImageDensity && (best == nil || density(c) > density(best)) {
+			best = c
+		}
+	}
+	if best != nil {
+		return best.url
+	} else if lowest != nil {
+		return lowest.url
+	}
+	return ""
+}
+
+// placeholderImageRegexp matches the URLs of images that are commonly used as
+// placeholders for lazily-loaded images.
+var placeholderImageRegexp = regexp.MustCompile(
+	`(?i)(^data:|^about:|^#|(^|/)(spacer|blank|pixel|placeholder|transparent|lazy[-_]?load[^/]*)\.(gif|png|svg)(\?|$))`)
+
+// isPlaceholderImage returns true if u is empty or appears to be a placeholder
+// that's displayed until a lazily-loaded image has been loaded.
+func isPlaceholderImage(u string) bool {
+	return u == "" || placeholderImageRegexp.MatchString(u)
+}
@@ -0,0 +1,76 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package proc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSrcset(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []imageCandidate
+	}{
+		{"", nil},
+		{"a.jpg", []imageCandidate{{url: "a.jpg"}}},
+		{"a.jpg 100w, b.jpg 200w", []imageCandidate{{url: "a.jpg", width: 100}, {url: "b.jpg", width: 200}}},
+		{" a.jpg 1x,b.jpg   1.5x ", []imageCandidate{{url: "a.jpg", density: 1}, {url: "b.jpg", density: 1.5}}},
+		{"a.jpg, b.jpg 2x", []imageCandidate{{url: "a.jpg"}, {url: "b.jpg", density: 2}}},
+		{"a.jpg,b.jpg 2x", []imageCandidate{{url: "a.jpg,b.jpg", density: 2}}},
+		{"a.jpg 100w 50h", []imageCandidate{{url: "a.jpg", width: 100}}},
+		{"https://a.com/img,w_100.jpg 100w", []imageCandidate{{url: "https://a.com/img,w_100.jpg", width: 100}}},
+		{"a.jpg 100w 2x, b.jpg foo, c.jpg -1w, d.jpg 0x, e.jpg 300w",
+			[]imageCandidate{{url: "e.jpg", width: 300}}},
+	} {
+		if got := parseSrcset(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseSrcset(%q) = %+v; want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestChooseImageCandidate(t *testing.T) {
+	widths := []imageCandidate{{url: "s", width: 300}, {url: "l", width: 1200}, {url: "m", width: 600}}
+	densities := []imageCandidate{{url: "1x"}, {url: "3x", density: 3}, {url: "2x", density: 2}}
+	for _, tc := range []struct {
+		cands    []imageCandidate
+		maxWidth int
+		want     string
+	}{
+		{nil, 640, ""},
+		{widths, 640, "m"},
+		{widths, 600, "m"},
+		{widths, 0, "l"},
+		{widths, 100, "s"},
+		{append(densities, widths...), 640, "m"},
+		{densities, 640, "2x"},
+		{[]imageCandidate{{url: "3x", density: 3}, {url: "4x", density: 4}}, 640, "3x"},
+	} {
+		if got := chooseImageCandidate(tc.cands, tc.maxWidth); got != tc.want {
+			t.Errorf("chooseImageCandidate(%+v, %v) = %q; want %q", tc.cands, tc.maxWidth, got, tc.want)
+		}
+	}
+}
+
+func TestIsPlaceholderImage(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want bool
+	}{
+		{"", true},
+		{"data:image/gif;base64,R0lGODlhAQABAAAAACw=", true},
+		{"about:blank", true},
+		{"#", true},
+		{"https://a.com/images/spacer.gif", true},
+		{"https://a.com/Blank.PNG?v=2", true},
+		{"https://a.com/lazyload-placeholder.svg", true},
+		{"https://a.com/img.jpg", false},
+		{"https://a.com/blanket.gif", false},
+		{"https://a.com/pixel-art.png", false},
+	} {
+		if got := isPlaceholderImage(tc.url); got != tc.want {
+			t.Errorf("isPlaceholderImage(%q) = %v; want %v", tc.url, got, tc.want)
+		}
+	}
+}
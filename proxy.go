@@ -0,0 +1,100 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// proxyHandler wraps another handler and rewrites requests forwarded by
+// trusted reverse proxies so that RemoteAddr contains the client's address
+// and URL.Scheme contains the scheme used by the client.
+type proxyHandler struct {
+	handler http.Handler
+	trusted []*net.IPNet
+}
+
+// newProxyHandler returns a proxyHandler that trusts the supplied IP addresses
+// and CIDR ranges.
+func newProxyHandler(h http.Handler, trusted []string) (*proxyHandler, error) {
+	ph := &proxyHandler{handler: h}
+	for _, s := range trusted {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ph.trusted = append(ph.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ph.trusted = append(ph.trusted, n)
+	}
+	return ph, nil
+}
+
+// isTrusted returns true if addr (optionally including a port) belongs to a
+// trusted proxy.
+func (ph *proxyHandler) isTrusted(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range ph.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ph *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(ph.trusted) == 0 || !ph.isTrusted(r.RemoteAddr) {
+		ph.handler.ServeHTTP(w, r)
+		return
+	}
+
+	r = r.Clone(r.Context())
+
+	// Proxies append the address that they received the request from, so walk
+	// the list backwards to find the first address that isn't a trusted proxy.
+	var addrs []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		addrs = append(addrs, strings.Split(v, ",")...)
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		r.RemoteAddr = addr
+		if !ph.isTrusted(addr) {
+			break
+		}
+	}
+
+	if proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto == "http" || proto == "https" {
+		r.URL.Scheme = proto
+	}
+	ph.handler.ServeHTTP(w, r)
+}
+
+// isSecure returns true if r was received over HTTPS, either directly or via a
+// trusted proxy.
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https"
+}
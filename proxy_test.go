@@ -0,0 +1,58 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHandler(t *testing.T) {
+	var gotAddr string
+	var gotSecure bool
+	ph, err := newProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAddr = r.RemoteAddr
+		gotSecure = isSecure(r)
+	}), []string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatal("newProxyHandler failed: ", err)
+	}
+
+	for _, tc := range []struct {
+		remote string
+		xff    string
+		proto  string
+		addr   string
+		secure bool
+	}{
+		{"1.2.3.4:1000", "", "", "1.2.3.4:1000", false},
+		{"1.2.3.4:1000", "5.6.7.8", "https", "1.2.3.4:1000", false}, // untrusted
+		{"10.1.2.3:1000", "5.6.7.8", "https", "5.6.7.8", true},
+		{"192.168.1.1:1000", "5.6.7.8", "http", "5.6.7.8", false},
+		{"[::1]:1000", "5.6.7.8", "https", "5.6.7.8", true},
+		{"10.1.2.3:1000", "9.9.9.9, 5.6.7.8, 10.0.0.2", "", "5.6.7.8", false},
+		{"10.1.2.3:1000", "10.0.0.3, 10.0.0.2", "", "10.0.0.3", false},
+		{"10.1.2.3:1000", "bogus", "", "10.1.2.3:1000", false},
+		{"192.168.1.2:1000", "5.6.7.8", "https", "192.168.1.2:1000", false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		ph.ServeHTTP(httptest.NewRecorder(), req)
+		if gotAddr != tc.addr || gotSecure != tc.secure {
+			t.Errorf("%v with X-Forwarded-For %q and X-Forwarded-Proto %q produced (%q, %v); want (%q, %v)",
+				tc.remote, tc.xff, tc.proto, gotAddr, gotSecure, tc.addr, tc.secure)
+		}
+	}
+
+	if _, err := newProxyHandler(nil, []string{"bogus"}); err == nil {
+		t.Error("newProxyHandler unexpectedly accepted bad address")
+	}
+}
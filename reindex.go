@@ -0,0 +1,52 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"github.com/derat/aread/common"
+	"github.com/derat/aread/db"
+	"github.com/derat/aread/proc"
+)
+
+// reindexPages rebuilds d's full-text search index from all users' saved pages.
+// Trashed pages are included so they can still be found after being restored.
+// The numbers of indexed pages and pages that couldn't be indexed are returned.
+func reindexPages(cfg *common.Config, d *db.Database) (done, failed int, err error) {
+	users, err := d.GetAllUsers()
+	if err != nil {
+		return 0, 0, err
+	}
+	pages, err := d.GetEveryPage()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	p := proc.New(cfg)
+	procs := make(map[int64]*proc.Processor) // keyed by user ID
+	for i := range users {
+		if procs[users[i].Id], err = p.ForUser(&users[i]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := d.ResetSearch(); err != nil {
+		return 0, 0, err
+	}
+	for _, pi := range pages {
+		up := procs[pi.UserId]
+		if up == nil {
+			continue
+		}
+		pi.Text, err = up.ReadPageText(pi)
+		if err == nil {
+			err = d.IndexPage(pi)
+		}
+		if err != nil {
+			cfg.Logger.Printf("Failed indexing %v: %v\n", pi.Id, err)
+			failed++
+			continue
+		}
+		done++
+	}
+	return done, failed, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/derat/aread/common"
+)
+
+func TestReindexPages(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	if !h.db.SearchAvailable() {
+		t.Skip("Search unavailable; build with -tags sqlite_fts5")
+	}
+
+	const id = "0123456789abcdef0123456789abcdef01234567"
+	if err := h.db.AddPage(common.PageInfo{Id: id, UserId: common.ConfigUserId,
+		OriginalURL: "https://example.com/", Title: "Page"}); err != nil {
+		t.Fatal("AddPage failed: ", err)
+	}
+	dir := filepath.Join(h.cfg.PageDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"),
+		[]byte(`<html><body><div class="content"><p>Whiskers purr.</p></div></body></html>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Trashed pages should be indexed so they can be found after being restored.
+	if err := h.db.SetPageTrashed(id, true); err != nil {
+		t.Fatal("SetPageTrashed failed: ", err)
+	}
+	if done, failed, err := reindexPages(h.cfg, h.db); err != nil {
+		t.Fatal("reindexPages failed: ", err)
+	} else if done != 1 || failed != 0 {
+		t.Errorf("reindexPages indexed %v page(s) with %v failure(s); want 1 and 0", done, failed)
+	}
+	if err := h.db.SetPageTrashed(id, false); err != nil {
+		t.Fatal("SetPageTrashed failed: ", err)
+	}
+	if res, err := h.db.SearchPages(common.ConfigUserId, "whiskers", 10); err != nil {
+		t.Fatal("SearchPages failed: ", err)
+	} else if len(res) != 1 || res[0].Page.Id != id {
+		t.Errorf("SearchPages returned %+v; want page %v", res, id)
+	}
+}
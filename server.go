@@ -0,0 +1,52 @@
+// Copyright 2026 Daniel Erat.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/derat/aread/common"
+)
+
+// shutdownTimeout is the maximum time to wait for in-flight requests to
+// complete after receiving a signal.
+const shutdownTimeout = 30 * time.Second
+
+// serveHTTP serves h at addr using net/http until SIGTERM or SIGINT is
+// received. If certFile and keyFile are non-empty, TLS is used.
+func serveHTTP(cfg *common.Config, h http.Handler, addr, certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("-cert and -key must be supplied together")
+	}
+
+	srv := &http.Server{Addr: addr, Handler: h}
+	done := make(chan error, 1)
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-ch
+		cfg.Logger.Printf("Got %v; shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+
+	cfg.Logger.Printf("Listening at %v\n", addr)
+	var err error
+	if certFile != "" {
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}